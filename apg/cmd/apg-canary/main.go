@@ -0,0 +1,81 @@
+// Command apg-canary checks a text corpus, such as a leak dump or a set of
+// model transcripts, against the APG canary registry. Every canary found is
+// traced back to the request and provider it was issued to.
+//
+// Usage:
+//
+//	apg-canary -registry canaries.jsonl [file ...]
+//
+// With no files, the corpus is read from standard input. The exit status is 0
+// when no canary is found, 1 when at least one is found and 2 on error.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/canary"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("apg-canary", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	registryPath := flags.String("registry", os.Getenv("APG_CANARY_REGISTRY"), "path to the canary registry (defaults to $APG_CANARY_REGISTRY)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *registryPath == "" {
+		fmt.Fprintln(stderr, "apg-canary: -registry is required")
+		return 2
+	}
+
+	registry, err := canary.Load(*registryPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "apg-canary: %v\n", err)
+		return 2
+	}
+
+	type source struct {
+		name string
+		open func() (io.ReadCloser, error)
+	}
+	var sources []source
+	if flags.NArg() == 0 {
+		sources = append(sources, source{"<stdin>", func() (io.ReadCloser, error) { return io.NopCloser(stdin), nil }})
+	}
+	for _, name := range flags.Args() {
+		sources = append(sources, source{name, func() (io.ReadCloser, error) { return os.Open(name) }})
+	}
+
+	found := false
+	for _, src := range sources {
+		rc, err := src.open()
+		if err != nil {
+			fmt.Fprintf(stderr, "apg-canary: %v\n", err)
+			return 2
+		}
+		corpus, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			fmt.Fprintf(stderr, "apg-canary: failed to read %s: %v\n", src.name, err)
+			return 2
+		}
+		for _, c := range registry.Scan(string(corpus)) {
+			found = true
+			fmt.Fprintf(stdout, "%s: %s canary %s issued %s for request %s to %s (model %s)\n",
+				src.name, c.Kind, c.Token, c.IssuedAt.Format(time.RFC3339), c.RequestID, c.Provider, c.Model)
+		}
+	}
+
+	if found {
+		return 1
+	}
+	return 0
+}
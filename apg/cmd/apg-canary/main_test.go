@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/canary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	registryPath := filepath.Join(dir, "canaries.jsonl")
+	issuer, err := canary.NewIssuer(registryPath, "canary.example.org")
+	require.NoError(t, err)
+	issued, err := issuer.Issue("req_7a8b9c0d1e2f", "OpenRouter", "openai/gpt-4o")
+	require.NoError(t, err)
+
+	dump := filepath.Join(dir, "dump.txt")
+	require.NoError(t, os.WriteFile(dump, []byte("id,email\n1,"+issued[0].Token+"\n"), 0o600))
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"-registry", registryPath, dump}, nil, &stdout, &stderr)
+	assert.Equal(t, 1, code, stderr.String())
+	assert.Contains(t, stdout.String(), "req_7a8b9c0d1e2f")
+	assert.Contains(t, stdout.String(), "OpenRouter")
+
+	stdout.Reset()
+	code = run([]string{"-registry", registryPath}, strings.NewReader("a clean transcript"), &stdout, &stderr)
+	assert.Equal(t, 0, code)
+	assert.Empty(t, stdout.String())
+
+	code = run([]string{"-registry", filepath.Join(dir, "missing.jsonl")}, strings.NewReader(""), &stdout, &stderr)
+	assert.Equal(t, 2, code)
+}
@@ -0,0 +1,161 @@
+// Command apg-kms manages the encrypted keystore of the APG local KMS.
+//
+// Usage:
+//
+//	apg-kms genroot
+//	apg-kms kekid <user-id> [<circle-id>]
+//	apg-kms [-keystore path] [-root-key-file path] init
+//	apg-kms [-keystore path] [-root-key-file path] create <kek-id>
+//	apg-kms [-keystore path] [-root-key-file path] list
+//	apg-kms [-keystore path] [-root-key-file path] disable <kek-id>
+//
+// genroot prints a new random root key. kekid prints the ID of the KEK the
+// gateway provisions for a user, or for a user in a circle, so that it can be
+// disabled to erase their data; it reads $APG_KEK_SCOPE and $APG_KEK_ID_KEY
+// like the gateway, and without circle scope a circle ID is ignored. The
+// other commands unlock the keystore with the root key in $APG_KMS_ROOT_KEY
+// or, failing that, the one read from -root-key-file ("-" for standard
+// input). init creates an empty keystore, and create creates it too if it
+// does not exist yet; the gateway itself never does. The exit status is 0 on
+// success and 2 on error.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("apg-kms", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	keystorePath := flags.String("keystore", os.Getenv("APG_KMS_KEYSTORE"), "path to the keystore (defaults to $APG_KMS_KEYSTORE)")
+	rootKeyFile := flags.String("root-key-file", os.Getenv("APG_KMS_ROOT_KEY_FILE"), `file holding the root key, "-" for stdin (defaults to $APG_KMS_ROOT_KEY_FILE)`)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		fmt.Fprintln(stderr, "apg-kms: want a command: genroot, kekid, init, create, list or disable")
+		return 2
+	}
+	command, operands := flags.Arg(0), flags.Args()[1:]
+
+	if command == "genroot" {
+		key, err := crypto.GenerateRootKey()
+		if err != nil {
+			fmt.Fprintf(stderr, "apg-kms: %v\n", err)
+			return 2
+		}
+		fmt.Fprintln(stdout, key)
+		return 0
+	}
+
+	if command == "kekid" {
+		if len(operands) < 1 || len(operands) > 2 {
+			fmt.Fprintln(stderr, "apg-kms: kekid takes a user ID and optionally a circle ID")
+			return 2
+		}
+		var circleID *string
+		if len(operands) == 2 {
+			circleID = &operands[1]
+		}
+		// The ID is derived as the gateway derives it, so the scope and ID
+		// key must be the gateway's.
+		scope, err := crypto.ParseKEKScope(os.Getenv("APG_KEK_SCOPE"))
+		if err != nil {
+			fmt.Fprintf(stderr, "apg-kms: APG_KEK_SCOPE: %v\n", err)
+			return 2
+		}
+		idKey, err := crypto.ParseKEKIDKey(os.Getenv("APG_KEK_ID_KEY"))
+		if err != nil {
+			fmt.Fprintf(stderr, "apg-kms: APG_KEK_ID_KEY: %v\n", err)
+			return 2
+		}
+		kekID, err := crypto.NewKEKRegistry(nil, scope, idKey).KEKID(operands[0], circleID)
+		if err != nil {
+			fmt.Fprintf(stderr, "apg-kms: %v\n", err)
+			return 2
+		}
+		fmt.Fprintln(stdout, kekID)
+		return 0
+	}
+
+	wantOperands := map[string]int{"init": 0, "create": 1, "list": 0, "disable": 1}
+	n, ok := wantOperands[command]
+	if !ok {
+		fmt.Fprintf(stderr, "apg-kms: unknown command %q\n", command)
+		return 2
+	}
+	if len(operands) != n {
+		fmt.Fprintf(stderr, "apg-kms: %s takes %d argument(s)\n", command, n)
+		return 2
+	}
+	if *keystorePath == "" {
+		fmt.Fprintln(stderr, "apg-kms: -keystore is required")
+		return 2
+	}
+	rootKey, err := crypto.LoadRootKey(os.Getenv("APG_KMS_ROOT_KEY"), *rootKeyFile, stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "apg-kms: %v\n", err)
+		return 2
+	}
+	var kms *crypto.LocalKMS
+	switch {
+	case command == "init":
+		kms, err = crypto.InitLocalKMS(*keystorePath, rootKey)
+	case command == "create":
+		kms, err = crypto.OpenLocalKMS(*keystorePath, rootKey)
+		if errors.Is(err, os.ErrNotExist) {
+			kms, err = crypto.InitLocalKMS(*keystorePath, rootKey)
+		}
+	default:
+		kms, err = crypto.OpenLocalKMS(*keystorePath, rootKey)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "apg-kms: %v\n", err)
+		return 2
+	}
+
+	switch command {
+	case "init":
+		fmt.Fprintf(stdout, "created keystore %s\n", *keystorePath)
+	case "create":
+		if err := kms.CreateKEK(operands[0]); err != nil {
+			fmt.Fprintf(stderr, "apg-kms: %v\n", err)
+			return 2
+		}
+		fmt.Fprintf(stdout, "created KEK %s\n", operands[0])
+	case "list":
+		w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tSTATE")
+		for _, info := range kms.ListKEKs() {
+			state := "enabled"
+			if info.Disabled != nil {
+				state = "disabled " + info.Disabled.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", info.ID, info.Created.Format(time.RFC3339), state)
+		}
+		w.Flush()
+	case "disable":
+		if err := kms.DisableKEK(operands[0]); err != nil {
+			if errors.Is(err, crypto.ErrKEKNotFound) {
+				fmt.Fprintf(stderr, "apg-kms: no KEK %s in %s\n", operands[0], *keystorePath)
+			} else {
+				fmt.Fprintf(stderr, "apg-kms: %v\n", err)
+			}
+			return 2
+		}
+		fmt.Fprintf(stdout, "disabled KEK %s\n", operands[0])
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	t.Setenv("APG_KMS_ROOT_KEY", "")
+	t.Setenv("APG_KEK_SCOPE", "")
+	t.Setenv("APG_KEK_ID_KEY", "")
+	keystore := filepath.Join(t.TempDir(), "keystore.json")
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, run([]string{"genroot"}, nil, &stdout, &stderr), stderr.String())
+	rootKey := strings.TrimSpace(stdout.String())
+
+	cmd := func(args ...string) int {
+		stdout.Reset()
+		stderr.Reset()
+		args = append([]string{"-keystore", keystore, "-root-key-file", "-"}, args...)
+		return run(args, strings.NewReader(rootKey), &stdout, &stderr)
+	}
+
+	// Only init and create make a keystore.
+	assert.Equal(t, 2, cmd("list"))
+	assert.Contains(t, stderr.String(), "does not exist")
+	assert.Equal(t, 0, cmd("init"), stderr.String())
+	assert.Equal(t, 2, cmd("init"))
+	assert.Equal(t, 0, cmd("list"), stderr.String())
+
+	assert.Equal(t, 0, cmd("create", "default-user-kek"), stderr.String())
+	assert.Equal(t, 2, cmd("create", "default-user-kek"))
+	assert.Contains(t, stderr.String(), "already exists")
+
+	assert.Equal(t, 0, cmd("disable", "default-user-kek"), stderr.String())
+	assert.Equal(t, 2, cmd("disable", "missing"))
+
+	assert.Equal(t, 0, cmd("list"), stderr.String())
+	assert.Contains(t, stdout.String(), "default-user-kek")
+	assert.Contains(t, stdout.String(), "disabled")
+
+	stdout.Reset()
+	code := run([]string{"-keystore", keystore, "-root-key-file", "-", "list"}, strings.NewReader("AAAA"), &stdout, &stderr)
+	assert.Equal(t, 2, code)
+	assert.Equal(t, 2, cmd("rotate"))
+
+	// kekid needs the gateway's ID key and follows its scope.
+	assert.Equal(t, 2, cmd("kekid", "user_abc"))
+	t.Setenv("APG_KEK_ID_KEY", "0123456789abcdef0123")
+	assert.Equal(t, 0, cmd("kekid", "user_abc"), stderr.String())
+	userKEK := strings.TrimSpace(stdout.String())
+	assert.Regexp(t, `^user-[0-9a-f]{32}$`, userKEK)
+	want, err := crypto.NewKEKRegistry(nil, crypto.KEKScopeUser, []byte("0123456789abcdef0123")).KEKID("user_abc", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want, userKEK)
+	assert.Equal(t, 0, cmd("kekid", "user_abc", "circle-7"), stderr.String())
+	assert.Equal(t, userKEK, strings.TrimSpace(stdout.String()))
+	t.Setenv("APG_KEK_SCOPE", "circle")
+	assert.Equal(t, 0, cmd("kekid", "user_abc", "circle-7"), stderr.String())
+	assert.Regexp(t, `^`+userKEK+`-circle-[0-9a-f]{32}$`, strings.TrimSpace(stdout.String()))
+	assert.Equal(t, 2, cmd("kekid"))
+}
@@ -0,0 +1,16 @@
+//go:build !pkcs11
+
+package main
+
+import (
+	"errors"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
+	"go.uber.org/zap"
+)
+
+// newPKCS11KMS is unavailable without cgo and the PKCS#11 headers, so it is
+// only built with the pkcs11 tag.
+func newPKCS11KMS(*zap.Logger) (crypto.KMS, error) {
+	return nil, errors.New("APG_KMS=pkcs11 needs a build with -tags pkcs11")
+}
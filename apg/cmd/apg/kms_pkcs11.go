@@ -0,0 +1,37 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
+	"go.uber.org/zap"
+)
+
+// newPKCS11KMS opens the PKCS#11 token configured by APG_PKCS11_MODULE,
+// APG_PKCS11_TOKEN_LABEL or APG_PKCS11_SLOT, and APG_PKCS11_PIN.
+func newPKCS11KMS(logger *zap.Logger) (crypto.KMS, error) {
+	cfg := crypto.PKCS11Config{
+		ModulePath:     os.Getenv("APG_PKCS11_MODULE"),
+		TokenLabel:     os.Getenv("APG_PKCS11_TOKEN_LABEL"),
+		PIN:            os.Getenv("APG_PKCS11_PIN"),
+		KeyLabelPrefix: os.Getenv("APG_PKCS11_KEY_PREFIX"),
+	}
+	if v := os.Getenv("APG_PKCS11_SLOT"); v != "" {
+		slot, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid APG_PKCS11_SLOT %q", v)
+		}
+		cfg.Slot = uint(slot)
+	}
+	os.Unsetenv("APG_PKCS11_PIN")
+	kms, err := crypto.NewPKCS11KMS(cfg)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Using a PKCS#11 token as the KMS", zap.String("module", cfg.ModulePath))
+	return kms, nil
+}
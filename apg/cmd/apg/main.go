@@ -2,14 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/canary"
 	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
 	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/openrouter"
 	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/processor"
@@ -33,6 +40,20 @@ var (
 			Buckets: prometheus.DefBuckets,
 		},
 	)
+	outputFindingsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apg_output_pii_findings_total",
+			Help: "Total number of identifiers found in model output, by category and action taken.",
+		},
+		[]string{"category", "action"},
+	)
+	injectionFlagsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "apg_prompt_injection_flags_total",
+			Help: "Total number of requests flagged by prompt-injection screening, by action taken.",
+		},
+		[]string{"action"},
+	)
 	errorsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "apg_errors_total",
@@ -46,22 +67,75 @@ func init() {
 	prometheus.MustRegister(requestsTotal)
 	prometheus.MustRegister(requestLatency)
 	prometheus.MustRegister(errorsTotal)
+	prometheus.MustRegister(outputFindingsTotal)
+	prometheus.MustRegister(injectionFlagsTotal)
 }
 
 // Server holds the dependencies for the gateway service.
 type Server struct {
-	kms      crypto.KMS
-	orClient *openrouter.Client
-	logger   *zap.Logger
+	kms       crypto.KMS
+	orClient  *openrouter.Client
+	processor *processor.Processor
+	// outputAction decides what happens to identifiers found in model output.
+	outputAction processor.LeakAction
+	// canaries, when set, plants and records canary tokens in every Zone A request.
+	canaries *canary.Issuer
+	// keks gives every user a KEK of their own.
+	keks   *crypto.KEKRegistry
+	logger *zap.Logger
+}
+
+// ServerOption customises a Server created by NewServer.
+type ServerOption func(*Server)
+
+// WithProcessor sets the processor used to split requests. By default the
+// server uses a processor enforcing processor.DefaultPolicy.
+func WithProcessor(p *processor.Processor) ServerOption {
+	return func(s *Server) {
+		s.processor = p
+	}
+}
+
+// WithOutputLeakAction sets how identifiers found in model output are handled.
+// The default is processor.LeakActionRedact.
+func WithOutputLeakAction(action processor.LeakAction) ServerOption {
+	return func(s *Server) {
+		s.outputAction = action
+	}
+}
+
+// WithKEKRegistry sets how users are mapped to KEKs. By default every user
+// gets a KEK of their own, created in the KMS on their first request.
+func WithKEKRegistry(keks *crypto.KEKRegistry) ServerOption {
+	return func(s *Server) {
+		s.keks = keks
+	}
+}
+
+// WithCanaryIssuer enables canary tokens: each request sent to the provider
+// carries unique synthetic identifiers that issuer records.
+func WithCanaryIssuer(issuer *canary.Issuer) ServerOption {
+	return func(s *Server) {
+		s.canaries = issuer
+	}
 }
 
 // NewServer creates a new server with all its dependencies.
-func NewServer(logger *zap.Logger, kms crypto.KMS, orClient *openrouter.Client) *Server {
-	return &Server{
-		kms:      kms,
-		orClient: orClient,
-		logger:   logger,
+func NewServer(logger *zap.Logger, kms crypto.KMS, orClient *openrouter.Client, opts ...ServerOption) *Server {
+	s := &Server{
+		kms:          kms,
+		orClient:     orClient,
+		processor:    processor.New(nil),
+		outputAction: processor.LeakActionRedact,
+		logger:       logger,
 	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.keks == nil {
+		s.keks = crypto.NewKEKRegistry(kms, crypto.KEKScopeUser, nil)
+	}
+	return s
 }
 
 func main() {
@@ -84,17 +158,147 @@ func main() {
 	}
 
 	// Initialize dependencies.
-	kms := crypto.NewMockKMS() // Using mock KMS for now.
+	kms, err := newKMS(logger)
+	if err != nil {
+		logger.Fatal("Failed to initialize KMS", zap.Error(err))
+	}
+	if _, ok := kms.(crypto.KEKCreator); !ok {
+		logger.Fatal("The KMS cannot create the per-user KEKs the gateway needs")
+	}
 	orClient, err := openrouter.NewClient(apiKey)
 	if err != nil {
 		logger.Fatal("Failed to create OpenRouter client", zap.Error(err))
 	}
 
+	// Load the data classification policy. Privacy reviewers can change the
+	// zone mapping through this file; a malformed file stops startup.
+	policy := processor.DefaultPolicy()
+	if path := os.Getenv("APG_POLICY_FILE"); path != "" {
+		policy, err = processor.LoadPolicy(path)
+		if err != nil {
+			logger.Fatal("Failed to load classification policy", zap.Error(err))
+		}
+	}
+	logger.Info("Loaded classification policy",
+		zap.String("source", policy.Source),
+		zap.Strings("zoneAFields", policy.ZoneAFields()),
+	)
+
+	// Each deployment chooses how identifiers in model output are handled.
+	outputAction := processor.LeakActionRedact
+	if v := os.Getenv("APG_OUTPUT_LEAK_ACTION"); v != "" {
+		outputAction, err = processor.ParseLeakAction(v)
+		if err != nil {
+			logger.Fatal("Invalid APG_OUTPUT_LEAK_ACTION", zap.Error(err))
+		}
+	}
+
+	// Scrubbers run in the order given by APG_SCRUBBERS; any left out are
+	// disabled. Word lists in APG_WORDLIST_DIR add deployment-specific
+	// scrubbers, which by default run right after the Zone B terms.
+	scrubbers := []processor.Scrubber{processor.TermScrubber()}
+	if dir := os.Getenv("APG_WORDLIST_DIR"); dir != "" {
+		wordLists, err := processor.LoadWordLists(dir)
+		if err != nil {
+			logger.Fatal("Failed to load word lists", zap.Error(err))
+		}
+		scrubbers = append(scrubbers, wordLists...)
+	}
+	scrubbers = append(scrubbers, processor.CoarseScrubber(), processor.LocaleScrubber())
+
+	// APG_FPE_MODE (ff1 or ff3-1) replaces phone and order numbers with
+	// format-preserving surrogates instead of placeholders, so the model can
+	// still work with their shape.
+	fpeMode := os.Getenv("APG_FPE_MODE")
+	if fpeMode != "" {
+		if _, err := crypto.NewFPE(fpeMode, make([]byte, 16), 10); err != nil {
+			logger.Fatal("Invalid APG_FPE_MODE", zap.Error(err))
+		}
+		scrubbers = append(scrubbers, processor.FPEScrubber())
+	}
+	scrubbers = append(scrubbers, processor.DetectorScrubber(processor.ScrubberPII, processor.DefaultDetectors()))
+	pipeline, err := processor.ParsePipeline(os.Getenv("APG_SCRUBBERS"), scrubbers...)
+	if err != nil {
+		logger.Fatal("Invalid APG_SCRUBBERS", zap.Error(err))
+	}
+	logger.Info("Configured scrubbing pipeline", zap.Strings("scrubbers", pipeline.Names()))
+
+	// Prompt-injection screening tags flagged requests unless the deployment
+	// chooses to block or sanitize them, or turns screening off.
+	screen := processor.DefaultInjectionScreen()
+	if v := os.Getenv("APG_INJECTION_ACTION"); v == "off" {
+		screen = nil
+	} else if v != "" {
+		screen.Action, err = processor.ParseInjectionAction(v)
+		if err != nil {
+			logger.Fatal("Invalid APG_INJECTION_ACTION", zap.Error(err))
+		}
+	}
+	if v := os.Getenv("APG_INJECTION_THRESHOLD"); v != "" && screen != nil {
+		screen.Threshold, err = strconv.ParseFloat(v, 64)
+		if err != nil || screen.Threshold <= 0 || screen.Threshold > 1 {
+			logger.Fatal("Invalid APG_INJECTION_THRESHOLD: want a number in (0, 1]", zap.String("value", v))
+		}
+	}
+
+	// APG_KEK_SCOPE=circle gives a user a separate KEK for each circle, in
+	// addition to the one for requests outside any circle.
+	kekScope, err := crypto.ParseKEKScope(os.Getenv("APG_KEK_SCOPE"))
+	if err != nil {
+		logger.Fatal("Invalid APG_KEK_SCOPE", zap.Error(err))
+	}
+	// APG_KEK_ID_KEY keys the hashes in KEK IDs, so that a user ID cannot be
+	// confirmed from KMS key names. It must never change.
+	kekIDKey, err := crypto.ParseKEKIDKey(os.Getenv("APG_KEK_ID_KEY"))
+	if err != nil {
+		logger.Fatal("Invalid APG_KEK_ID_KEY", zap.Error(err))
+	}
+	keks := crypto.NewKEKRegistry(kms, kekScope, kekIDKey)
+
+	processorOpts := []processor.Option{
+		processor.WithPipeline(pipeline),
+		processor.WithInjectionScreen(screen),
+	}
+	if fpeMode != "" {
+		processorOpts = append(processorOpts, processor.WithFPE(kms, "", fpeMode), processor.WithKEKRegistry(keks))
+	}
+	// APG_PSEUDONYMS=surrogate replaces names, emails and locations with
+	// realistic fake values instead of bracketed placeholders.
+	switch v := os.Getenv("APG_PSEUDONYMS"); v {
+	case "", "placeholder":
+	case "surrogate":
+		processorOpts = append(processorOpts, processor.WithSurrogates())
+	default:
+		logger.Fatal("Invalid APG_PSEUDONYMS: want placeholder or surrogate", zap.String("value", v))
+	}
+	opts := []ServerOption{
+		WithProcessor(processor.New(policy, processorOpts...)),
+		WithOutputLeakAction(outputAction),
+		WithKEKRegistry(keks),
+	}
+
+	// Optional canary tokens to detect provider-side leakage. Canary emails
+	// must use a mail domain the deployment controls, so there is no default.
+	if path := os.Getenv("APG_CANARY_REGISTRY"); path != "" {
+		domain := os.Getenv("APG_CANARY_DOMAIN")
+		if domain == "" {
+			logger.Fatal("APG_CANARY_DOMAIN must be set when APG_CANARY_REGISTRY is")
+		}
+		issuer, err := canary.NewIssuer(path, domain)
+		if err != nil {
+			logger.Fatal("Failed to open canary registry", zap.Error(err))
+		}
+		logger.Info("Canary tokens enabled", zap.String("domain", domain))
+		opts = append(opts, WithCanaryIssuer(issuer))
+	}
+
 	// Create the server which holds our dependencies.
-	server := NewServer(logger, kms, orClient)
+	server := NewServer(logger, kms, orClient, opts...)
 
 	// The handler function for our privacy gateway endpoint.
 	http.HandleFunc("/v1/gateway", server.gatewayHandler)
+	// The preview endpoint shows what would be shared, without calling the provider.
+	http.HandleFunc("/v1/gateway/preview", server.previewHandler)
 	// Add the /metrics endpoint for Prometheus scraping.
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -111,56 +315,37 @@ func (s *Server) gatewayHandler(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		requestLatency.Observe(time.Since(startTime).Seconds())
 	}()
-
-	// 1. Basic request validation
-	if r.Method != http.MethodPost {
-		errorsTotal.WithLabelValues("bad_request").Inc()
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+	requestID, err := newRequestID()
+	if err != nil {
+		s.logger.Error("Failed to generate request ID", zap.Error(err))
+		errorsTotal.WithLabelValues("processing_error").Inc()
+		http.Error(w, "Failed to process request", http.StatusInternalServerError)
 		return
 	}
 
-	// 2. Decode the incoming request body
-	var request types.AuraGatewayRequest
-	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		s.logger.Error("Failed to decode request body", zap.Error(err))
-		errorsTotal.WithLabelValues("bad_request").Inc()
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	// 1-2. Validate and decode the incoming request.
+	request, ok := s.decodeRequest(w, r)
+	if !ok {
 		return
 	}
-	defer r.Body.Close()
 
 	// Redacted logging: UserID is Zone B (private), so it's not logged.
 	s.logger.Info("Received gateway request",
+		zap.String("requestId", requestID),
 		zap.String("requestedModel", request.RequestedModel),
 	)
 
-	// 3. Split the request into Zone A (public) and Zone B (private).
-	zoneARequest, zoneBPayload, err := processor.SplitAndScrub(&request)
-	if err != nil {
-		s.logger.Error("Failed to process request", zap.Error(err))
-		errorsTotal.WithLabelValues("processing_error").Inc()
-		http.Error(w, "Failed to process request", http.StatusInternalServerError)
+	// 3-5. Split, encrypt Zone B and hash Zone A.
+	prepared, ok := s.prepare(r.Context(), w, request, false)
+	if !ok {
 		return
 	}
-
-	// 4. Encrypt Zone B data.
-	// For this example, we use a default KEK ID. In a real system, this would be user-specific.
-	const userKekID = "default-user-kek"
-	ciphertext, wrappedDEK, nonce, err := crypto.Encrypt(zoneBPayload, nil, s.kms, userKekID)
-	if err != nil {
-		s.logger.Error("Failed to encrypt Zone B data", zap.Error(err))
-		errorsTotal.WithLabelValues("encryption_error").Inc()
-		http.Error(w, "Failed to encrypt sensitive data", http.StatusInternalServerError)
+	if !s.plantCanaries(w, requestID, prepared) {
 		return
 	}
 
-	// 5. Hash Zone A data for provenance.
-	zoneABytes, _ := json.Marshal(zoneARequest)
-	zoneAHash := sha256.Sum256(zoneABytes)
-	zoneAHashStr := hex.EncodeToString(zoneAHash[:])
-
 	// 6. Call the external OpenRouter API with Zone A data.
-	orResp, err := s.orClient.Call(r.Context(), zoneARequest)
+	orResp, err := s.orClient.Call(r.Context(), prepared.split.ZoneA)
 	if err != nil {
 		s.logger.Error("Failed to call OpenRouter", zap.Error(err))
 		errorsTotal.WithLabelValues("provider_error").Inc()
@@ -168,9 +353,25 @@ func (s *Server) gatewayHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(prepared.canaries) > 0 {
+		s.removeEchoedCanaries(requestID, prepared.canaries, orResp)
+	}
+
+	// 6b. Scan the model output for identifiers it invented or leaked. This runs
+	// before rehydration, so the user's own values are never flagged.
+	outputScan, blocked := s.scanOutput(request, orResp, prepared.split.Surrogates)
+	if blocked {
+		errorsTotal.WithLabelValues("output_blocked").Inc()
+		http.Error(w, "AI provider response withheld: it contained personal data", http.StatusBadGateway)
+		return
+	}
+
 	// 7. Decrypt Zone B data. (In a stateless system, we'd retrieve it from temporary storage).
-	// Here, we just use the variables from the encryption step.
-	decryptedPayload, err := crypto.Decrypt(ciphertext, wrappedDEK, nonce, nil, s.kms, userKekID)
+	// Here, we just use the record from the encryption step.
+	// KMS calls are bound to the client's request, so they stop retrying once
+	// the client has gone.
+	kms := crypto.BindContext(s.kms, r.Context())
+	decryptedPayload, err := decryptZoneB(&prepared.record, kms)
 	if err != nil {
 		s.logger.Error("Failed to decrypt Zone B data", zap.Error(err))
 		errorsTotal.WithLabelValues("decryption_error").Inc()
@@ -179,30 +380,52 @@ func (s *Server) gatewayHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify integrity: Check if decrypted data matches original.
-	if !bytes.Equal(decryptedPayload, zoneBPayload) {
+	if !bytes.Equal(decryptedPayload, prepared.split.ZoneB) {
 		s.logger.Fatal("Decrypted payload does not match original Zone B payload. Integrity check failed.")
 		errorsTotal.WithLabelValues("integrity_error").Inc()
 		http.Error(w, "Data integrity check failed", http.StatusInternalServerError)
 		return
 	}
 
+	var zoneB processor.ZoneBContext
+	if err := json.Unmarshal(decryptedPayload, &zoneB); err != nil {
+		s.logger.Error("Failed to decode Zone B data", zap.Error(err))
+		errorsTotal.WithLabelValues("decryption_error").Inc()
+		http.Error(w, "Failed to decrypt sensitive data", http.StatusInternalServerError)
+		return
+	}
+
 	// 8. Recombine and send the final response.
+	// Placeholders the model echoed back are swapped for the original values,
+	// and format-preserving surrogates are decrypted.
 	var finalContent string
 	if len(orResp.Choices) > 0 {
-		finalContent = orResp.Choices[0].Message.Content
+		finalContent = processor.Rehydrate(orResp.Choices[0].Message.Content, zoneB.Pseudonyms)
+		finalContent, err = processor.RestoreSurrogates(finalContent, zoneB.FPE, kms)
+		if err != nil {
+			s.logger.Error("Failed to restore surrogates", zap.Error(err))
+			errorsTotal.WithLabelValues("decryption_error").Inc()
+			http.Error(w, "Failed to decrypt sensitive data", http.StatusInternalServerError)
+			return
+		}
 	}
 
 	latency := time.Since(startTime).Milliseconds()
 	response := types.AuraGatewayResponse{
-		// A real implementation would generate and track a request.
-		OriginalRequestID: "placeholder-request-id",
+		OriginalRequestID: requestID,
 		Content:           finalContent,
 		Usage:             orResp.Usage,
 		Provenance: types.Provenance{
 			ModelUsed: orResp.ID, // The response ID often contains the model name.
 			Provider:  "OpenRouter",
 			LatencyMs: latency,
-			ZoneAHash: zoneAHashStr,
+			ZoneAHash: prepared.zoneAHash,
+			// Counts and the policy decision only; redacted values never leave Zone B.
+			Redactions:     prepared.split.RedactionCounts(),
+			RulesetVersion: processor.RulesetVersion,
+			PolicyDecision: prepared.split.Decision,
+			OutputScan:     outputScan,
+			Screening:      prepared.split.Screening,
 		},
 	}
 
@@ -213,3 +436,343 @@ func (s *Server) gatewayHandler(w http.ResponseWriter, r *http.Request) {
 		errorsTotal.WithLabelValues("response_error").Inc()
 	}
 }
+
+// previewHandler runs the same split, scrub and policy pipeline as
+// gatewayHandler but stops before the provider call. It returns the Zone A
+// request, its hash and the redactions made, for reviewers and consent screens.
+// Nothing is encrypted, so a preview never provisions a KEK. Surrogates drawn
+// per request and canaries make the request as sent differ; those parts are
+// listed, and the hash, which could not match, is left out.
+func (s *Server) previewHandler(w http.ResponseWriter, r *http.Request) {
+	request, ok := s.decodeRequest(w, r)
+	if !ok {
+		return
+	}
+
+	prepared, ok := s.prepare(r.Context(), w, request, true)
+	if !ok {
+		return
+	}
+
+	redactions := prepared.split.Redactions
+	if redactions == nil {
+		redactions = []types.Redaction{}
+	}
+	preview := types.GatewayPreview{
+		ZoneARequest: prepared.split.ZoneA,
+		ZoneAHash:    prepared.zoneAHash,
+		Redactions:   redactions,
+		Differs:      prepared.split.Randomized,
+		Screening:    prepared.split.Screening,
+	}
+	if s.canaries != nil {
+		preview.Differs = append(preview.Differs, "canaries")
+	}
+	if len(preview.Differs) > 0 {
+		preview.ZoneAHash = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(preview); err != nil {
+		s.logger.Error("Failed to encode preview response", zap.Error(err))
+		errorsTotal.WithLabelValues("response_error").Inc()
+	}
+}
+
+// scanOutput checks every choice in the provider response for the identifiers
+// the processor's pipeline detects for request, including its locale pack, and
+// applies the configured leak action, redacting choices in place if required.
+// It returns nil when nothing was found, and true when the response must be blocked.
+func (s *Server) scanOutput(request *types.AuraGatewayRequest, orResp *types.OpenRouterResponse, surrogates []string) (*types.OutputScan, bool) {
+	counts := make(map[string]int)
+	for i := range orResp.Choices {
+		content, findings := s.processor.ScanOutput(orResp.Choices[i].Message.Content, request, s.outputAction, surrogates...)
+		orResp.Choices[i].Message.Content = content
+		for _, f := range findings {
+			counts[string(f.Category)]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil, false
+	}
+
+	for category, n := range counts {
+		outputFindingsTotal.WithLabelValues(category, string(s.outputAction)).Add(float64(n))
+	}
+	s.logger.Warn("Identifiers found in model output",
+		zap.String("action", string(s.outputAction)),
+		zap.Any("findings", counts),
+	)
+	return &types.OutputScan{Action: string(s.outputAction), Findings: counts}, s.outputAction == processor.LeakActionBlock
+}
+
+// newKMS sets up the KMS selected by APG_KMS. The default, "local", unlocks
+// the keystore at APG_KMS_KEYSTORE with the root key in APG_KMS_ROOT_KEY or in
+// the file named by APG_KMS_ROOT_KEY_FILE ("-" for stdin). "vault" uses the
+// Transit engine of the Vault at VAULT_ADDR, and "aws" AWS KMS or a service
+// speaking its protocol at APG_AWS_KMS_ENDPOINT. "pkcs11" uses an HSM or
+// other PKCS#11 token, in builds with the pkcs11 tag. "mock" selects the
+// insecure test KMS. Every backend creates the KEK of a user on their first
+// request.
+func newKMS(logger *zap.Logger) (crypto.KMS, error) {
+	switch backend := os.Getenv("APG_KMS"); backend {
+	case "", "local":
+		path := os.Getenv("APG_KMS_KEYSTORE")
+		if path == "" {
+			return nil, errors.New("APG_KMS_KEYSTORE is not set")
+		}
+		rootKey, err := crypto.LoadRootKey(os.Getenv("APG_KMS_ROOT_KEY"), os.Getenv("APG_KMS_ROOT_KEY_FILE"), os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		// The key is not needed again; keep it out of the environment of
+		// anything this process starts.
+		os.Unsetenv("APG_KMS_ROOT_KEY")
+		// A missing keystore is not created here: if the path is wrong or
+		// its volume is not mounted, new KEKs would strand all stored data.
+		kms, err := crypto.OpenLocalKMS(path, rootKey)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w; create it with apg-kms init", err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Unlocked the local KMS keystore", zap.String("path", path), zap.Int("keks", len(kms.ListKEKs())))
+		return kms, nil
+	case "vault":
+		kms, err := crypto.NewVaultKMS(crypto.VaultConfig{
+			Address:      os.Getenv("VAULT_ADDR"),
+			Token:        os.Getenv("VAULT_TOKEN"),
+			RoleID:       os.Getenv("APG_VAULT_ROLE_ID"),
+			SecretID:     os.Getenv("APG_VAULT_SECRET_ID"),
+			AppRoleMount: os.Getenv("APG_VAULT_APPROLE_MOUNT"),
+			Namespace:    os.Getenv("VAULT_NAMESPACE"),
+			TransitMount: os.Getenv("APG_VAULT_TRANSIT_MOUNT"),
+			KeyPrefix:    os.Getenv("APG_VAULT_KEY_PREFIX"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Using Vault Transit as the KMS", zap.String("address", os.Getenv("VAULT_ADDR")))
+		return kms, nil
+	case "aws":
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = os.Getenv("AWS_DEFAULT_REGION")
+		}
+		kms, err := crypto.NewAWSKMS(crypto.AWSKMSConfig{
+			Region:   region,
+			Endpoint: os.Getenv("APG_AWS_KMS_ENDPOINT"),
+			Credentials: crypto.AWSCredentials{
+				AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+				SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+				SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+			},
+			AliasPrefix: os.Getenv("APG_AWS_KMS_ALIAS_PREFIX"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Using AWS KMS as the KMS", zap.String("region", region))
+		return kms, nil
+	case "pkcs11":
+		return newPKCS11KMS(logger)
+	case "mock":
+		logger.Warn("Using the mock KMS: Zone B keys are not protected. Do not use it in production.")
+		return crypto.NewMockKMS(), nil
+	default:
+		return nil, fmt.Errorf("unknown APG_KMS %q: want local, vault, aws, pkcs11 or mock", backend)
+	}
+}
+
+// preparedRequest holds the outcome of splitting, encrypting and hashing a request.
+type preparedRequest struct {
+	split *processor.Result
+	// record is the encrypted Zone B record; it is empty for a preview.
+	record    types.AuraGatewayTransformed
+	zoneAHash string
+	canaries  []canary.Canary
+}
+
+// decodeRequest checks the method and decodes the request body. On failure it
+// writes the error response and returns false.
+func (s *Server) decodeRequest(w http.ResponseWriter, r *http.Request) (*types.AuraGatewayRequest, bool) {
+	if r.Method != http.MethodPost {
+		errorsTotal.WithLabelValues("bad_request").Inc()
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	var request types.AuraGatewayRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		s.logger.Error("Failed to decode request body", zap.Error(err))
+		errorsTotal.WithLabelValues("bad_request").Inc()
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return nil, false
+	}
+	defer r.Body.Close()
+	return &request, true
+}
+
+// prepare runs everything that happens before the provider is called: the
+// Zone A/B split, Zone B encryption and the Zone A hash, with KMS calls bound
+// to ctx. A preview is split without provisioning a KEK and is not encrypted.
+// On failure it writes the error response and returns false.
+func (s *Server) prepare(ctx context.Context, w http.ResponseWriter, request *types.AuraGatewayRequest, preview bool) (*preparedRequest, bool) {
+	// Zone B is encrypted under the KEK of the user, which is created on
+	// their first request.
+	if request.UserID == "" {
+		errorsTotal.WithLabelValues("bad_request").Inc()
+		http.Error(w, "Request has no userId", http.StatusBadRequest)
+		return nil, false
+	}
+	var kekID string
+	var err error
+	if !preview {
+		kekID, err = s.keks.Resolve(ctx, request.UserID, request.CircleID)
+		if err != nil {
+			s.logger.Error("Failed to provision the user's KEK", zap.Error(err))
+			errorsTotal.WithLabelValues("encryption_error").Inc()
+			http.Error(w, "Failed to encrypt sensitive data", http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+
+	// Split the request into Zone A (public) and Zone B (private).
+	var split *processor.Result
+	if preview {
+		split, err = s.processor.Preview(request)
+	} else {
+		split, err = s.processor.SplitContext(ctx, request)
+	}
+	if errors.Is(err, processor.ErrInvalidRequest) {
+		errorsTotal.WithLabelValues("bad_request").Inc()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if errors.Is(err, processor.ErrPromptInjection) {
+		s.logger.Warn("Request blocked by prompt-injection screening", zap.Error(err))
+		injectionFlagsTotal.WithLabelValues(string(processor.InjectionActionBlock)).Inc()
+		http.Error(w, processor.ErrPromptInjection.Error(), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	if err != nil {
+		s.logger.Error("Failed to process request", zap.Error(err))
+		errorsTotal.WithLabelValues("processing_error").Inc()
+		http.Error(w, "Failed to process request", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if split.Screening != nil {
+		s.logger.Warn("Prompt-injection screening flagged request",
+			zap.String("action", split.Screening.Action),
+			zap.Float64("score", split.Screening.Score),
+			zap.Strings("rules", split.Screening.Rules),
+		)
+		injectionFlagsTotal.WithLabelValues(split.Screening.Action).Inc()
+	}
+
+	// Only the IDs of retrieved Context items are logged, never their content.
+	for _, r := range split.Retrievals {
+		s.logger.Info("Context items retrieved for promotion",
+			zap.String("path", r.Path),
+			zap.Strings("items", r.Items),
+		)
+	}
+
+	prepared := &preparedRequest{split: split, zoneAHash: hashZoneA(split.ZoneA)}
+	if preview {
+		return prepared, true
+	}
+
+	// Encrypt Zone B data under the user's KEK.
+	ad := zoneBAD(kekID)
+	ciphertext, wrappedDEK, nonce, err := crypto.Encrypt(split.ZoneB, ad, crypto.BindContext(s.kms, ctx), kekID)
+	if err != nil {
+		s.logger.Error("Failed to encrypt Zone B data", zap.Error(err))
+		errorsTotal.WithLabelValues("encryption_error").Inc()
+		http.Error(w, "Failed to encrypt sensitive data", http.StatusInternalServerError)
+		return nil, false
+	}
+	prepared.record = types.AuraGatewayTransformed{
+		ZoneAPrompt:           split.ZoneA,
+		ZoneBEncryptedPayload: ciphertext,
+		ZoneBWrappedDEK:       wrappedDEK,
+		ZoneBNonce:            nonce,
+		KEKID:                 kekID,
+		AssociatedData:        ad,
+	}
+	return prepared, true
+}
+
+// zoneBAD is the associated data of a Zone B record encrypted under kekID.
+// It binds the record to the KEK ID, so that a record relabelled with
+// another user's KEK ID is rejected.
+func zoneBAD(kekID string) []byte {
+	return []byte("apg-zone-b:v1:kek=" + kekID)
+}
+
+// decryptZoneB decrypts the Zone B payload of record. The associated data is
+// derived from the record's KEK ID, not taken from the record.
+func decryptZoneB(record *types.AuraGatewayTransformed, kms crypto.KMS) ([]byte, error) {
+	return crypto.Decrypt(record.ZoneBEncryptedPayload, record.ZoneBWrappedDEK, record.ZoneBNonce, zoneBAD(record.KEKID), kms, record.KEKID)
+}
+
+// hashZoneA hashes Zone A data for provenance.
+func hashZoneA(zoneA types.OpenRouterRequest) string {
+	zoneABytes, _ := json.Marshal(zoneA)
+	zoneAHash := sha256.Sum256(zoneABytes)
+	return hex.EncodeToString(zoneAHash[:])
+}
+
+// newRequestID returns a random ID of the form req_7a8b9c0d1e2f.
+func newRequestID() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "req_" + hex.EncodeToString(b), nil
+}
+
+// plantCanaries adds unique canary tokens to the Zone A request, if enabled,
+// and records them against the request ID and provider. Previews never plant
+// canaries, since nothing is sent. On failure it writes the error response and
+// returns false.
+func (s *Server) plantCanaries(w http.ResponseWriter, requestID string, prepared *preparedRequest) bool {
+	if s.canaries == nil {
+		return true
+	}
+	zoneA := &prepared.split.ZoneA
+	issued, err := s.canaries.Issue(requestID, "OpenRouter", zoneA.Model)
+	if err != nil {
+		s.logger.Error("Failed to issue canary tokens", zap.Error(err))
+		errorsTotal.WithLabelValues("canary_error").Inc()
+		http.Error(w, "Failed to process request", http.StatusInternalServerError)
+		return false
+	}
+	message := types.Message{Role: types.RoleSystem, Content: canary.Message(issued)}
+	zoneA.Messages = append([]types.Message{message}, zoneA.Messages...)
+	prepared.canaries = issued
+	prepared.record.ZoneAPrompt = *zoneA
+	prepared.zoneAHash = hashZoneA(*zoneA)
+	return true
+}
+
+// removeEchoedCanaries strips this request's canaries from the model output so
+// the user never sees them. An echo is not a leak, but it is logged.
+func (s *Server) removeEchoedCanaries(requestID string, issued []canary.Canary, orResp *types.OpenRouterResponse) {
+	for i := range orResp.Choices {
+		content := orResp.Choices[i].Message.Content
+		for _, c := range issued {
+			if strings.Contains(content, c.Token) {
+				s.logger.Warn("Model output echoed a canary token",
+					zap.String("requestId", requestID),
+					zap.String("kind", c.Kind),
+				)
+				content = strings.ReplaceAll(content, c.Token, "[REDACTED]")
+			}
+		}
+		orResp.Choices[i].Message.Content = content
+	}
+}
@@ -4,9 +4,12 @@ go 1.24.3
 
 require (
 	github.com/cloudflare/circl v1.6.1
+	github.com/miekg/pkcs11 v1.1.2
 	github.com/prometheus/client_golang v1.23.0
 	github.com/stretchr/testify v1.11.0
 	go.uber.org/zap v1.27.0
+	golang.org/x/text v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -21,5 +24,4 @@ require (
 	go.uber.org/multierr v1.10.0 // indirect
 	golang.org/x/sys v0.33.0 // indirect
 	google.golang.org/protobuf v1.36.6 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,246 @@
+package canary
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of canary token.
+const (
+	KindEmail = "email"
+	KindID    = "id"
+)
+
+// Canary is a synthetic, unique string inserted into one Zone A request.
+// If it ever turns up elsewhere, it identifies the request and provider it
+// was sent to.
+type Canary struct {
+	Token     string    `json:"token"`
+	Kind      string    `json:"kind"`
+	RequestID string    `json:"requestId"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model"`
+	IssuedAt  time.Time `json:"issuedAt"`
+}
+
+var (
+	// domainPattern matches a mail domain of at least two labels.
+	domainPattern = regexp.MustCompile(`^(?i)[a-z0-9](?:[a-z0-9-]*[a-z0-9])?(?:\.[a-z0-9](?:[a-z0-9-]*[a-z0-9])?)+$`)
+	// candidatePattern matches anything in a corpus that could be a canary:
+	// an email address or an account-style ID.
+	candidatePattern = regexp.MustCompile(`(?i)[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}|\bSS-[A-Z0-9]{4}-[A-Z0-9]{4}\b`)
+)
+
+// Issuer issues canaries and appends every one to the registry file as one
+// JSON line, so that they can be searched offline. It keeps nothing in
+// memory; Load reads the registry back.
+type Issuer struct {
+	mu     sync.Mutex
+	path   string
+	domain string
+}
+
+// NewIssuer creates an Issuer that records canaries at path, creating the
+// file if needed, and builds canary email addresses on domain. The domain
+// must be one the operator controls, so that mail sent to a leaked canary
+// reaches them and nobody else.
+func NewIssuer(path, domain string) (*Issuer, error) {
+	if !domainPattern.MatchString(domain) {
+		return nil, fmt.Errorf("invalid canary mail domain %q", domain)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open canary registry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("failed to open canary registry: %w", err)
+	}
+	return &Issuer{path: path, domain: strings.ToLower(domain)}, nil
+}
+
+// Issue creates a canary email address and a canary account ID for one
+// request and records them before returning.
+func (i *Issuer) Issue(requestID, provider, model string) ([]Canary, error) {
+	email, err := newEmail(i.domain)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	issued := []Canary{
+		{Token: email, Kind: KindEmail, RequestID: requestID, Provider: provider, Model: model, IssuedAt: now},
+		{Token: id, Kind: KindID, RequestID: requestID, Provider: provider, Model: model, IssuedAt: now},
+	}
+	if err := i.persist(issued); err != nil {
+		return nil, err
+	}
+	return issued, nil
+}
+
+func (i *Issuer) persist(issued []Canary) error {
+	var b strings.Builder
+	for _, c := range issued {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return fmt.Errorf("failed to marshal canary: %w", err)
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	f, err := os.OpenFile(i.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open canary registry: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("failed to record canary: %w", err)
+	}
+	return f.Sync()
+}
+
+// Registry is the full set of issued canaries, for searching a corpus.
+type Registry struct {
+	// canaries is keyed by lower-cased token. Tokens are random, so a token
+	// issued twice is unlikely, but both issues are kept if it happens.
+	canaries map[string][]Canary
+	n        int
+}
+
+// Load reads every canary recorded at path.
+func Load(path string) (*Registry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open canary registry: %w", err)
+	}
+	defer f.Close()
+
+	r := &Registry{canaries: make(map[string][]Canary)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var c Canary
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("invalid canary registry entry on line %d: %w", line, err)
+		}
+		token := strings.ToLower(c.Token)
+		r.canaries[token] = append(r.canaries[token], c)
+		r.n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read canary registry: %w", err)
+	}
+	return r, nil
+}
+
+// Scan returns every registered canary that occurs in text, ignoring case.
+// It makes one pass over text for anything shaped like a canary and looks
+// each candidate up, so its cost does not grow with the registry.
+func (r *Registry) Scan(text string) []Canary {
+	var hits []Canary
+	seen := make(map[string]bool)
+	for _, candidate := range candidatePattern.FindAllString(text, -1) {
+		token := strings.ToLower(candidate)
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		hits = append(hits, r.canaries[token]...)
+	}
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].IssuedAt.Before(hits[j].IssuedAt) })
+	return hits
+}
+
+// Len returns the number of registered canaries.
+func (r *Registry) Len() int {
+	return r.n
+}
+
+var (
+	firstNames = []string{"lena", "marco", "priya", "tomas", "aiko", "noah", "freya", "elias", "ines", "oscar", "maya", "jonah"}
+	lastNames  = []string{"hartley", "okafor", "lindqvist", "moreau", "castell", "brennan", "varga", "holloway", "sato", "dunmore"}
+)
+
+// newEmail builds a plausible address on domain with a random numeric suffix
+// long enough that an address is practically never issued twice.
+func newEmail(domain string) (string, error) {
+	first, err := pick(firstNames)
+	if err != nil {
+		return "", err
+	}
+	last, err := pick(lastNames)
+	if err != nil {
+		return "", err
+	}
+	suffix, err := randomString("0123456789", 8)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s.%s%s@%s", first, last, suffix, domain), nil
+}
+
+// newID builds an account-style ID such as SS-7F3K-92QD.
+func newID() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	a, err := randomString(alphabet, 4)
+	if err != nil {
+		return "", err
+	}
+	b, err := randomString(alphabet, 4)
+	if err != nil {
+		return "", err
+	}
+	return "SS-" + a + "-" + b, nil
+}
+
+func pick(words []string) (string, error) {
+	i, err := rand.Int(rand.Reader, big.NewInt(int64(len(words))))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate canary: %w", err)
+	}
+	return words[i.Int64()], nil
+}
+
+func randomString(alphabet string, n int) (string, error) {
+	b := make([]byte, n)
+	for i := range b {
+		j, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", fmt.Errorf("failed to generate canary: %w", err)
+		}
+		b[i] = alphabet[j.Int64()]
+	}
+	return string(b), nil
+}
+
+// Message renders canaries as a Zone A system message. The model is asked not
+// to repeat them, but a leak is only proven by their appearing outside APG.
+func Message(canaries []Canary) string {
+	var parts []string
+	for _, c := range canaries {
+		switch c.Kind {
+		case KindEmail:
+			parts = append(parts, "contact on file "+c.Token)
+		case KindID:
+			parts = append(parts, "account reference "+c.Token)
+		}
+	}
+	return "Internal reference details (do not repeat them): " + strings.Join(parts, ", ") + "."
+}
@@ -0,0 +1,88 @@
+package canary
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIssuer_IssueAndScan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "canaries.jsonl")
+	issuer, err := NewIssuer(path, "Canary.Example.org")
+	if err != nil {
+		t.Fatalf("NewIssuer failed: %v", err)
+	}
+
+	issued, err := issuer.Issue("req_1", "OpenRouter", "test-model")
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if len(issued) != 2 || issued[0].Kind != KindEmail || issued[1].Kind != KindID {
+		t.Fatalf("unexpected canaries %+v", issued)
+	}
+	if !strings.HasSuffix(issued[0].Token, "@canary.example.org") {
+		t.Errorf("unexpected canary email %q", issued[0].Token)
+	}
+
+	other, err := issuer.Issue("req_2", "OpenRouter", "test-model")
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if other[0].Token == issued[0].Token || other[1].Token == issued[1].Token {
+		t.Error("canaries must be unique per request")
+	}
+
+	registry, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if registry.Len() != 4 {
+		t.Fatalf("expected 4 canaries, got %d", registry.Len())
+	}
+	dump := "leaked rows: " + strings.ToUpper(issued[0].Token) + ", unrelated@example.com, " + issued[0].Token
+	hits := registry.Scan(dump)
+	if len(hits) != 1 || hits[0].RequestID != "req_1" {
+		t.Errorf("Scan() = %+v, want the req_1 email canary", hits)
+	}
+	hits = registry.Scan("model said: " + other[1].Token + ".")
+	if len(hits) != 1 || hits[0].RequestID != "req_2" || hits[0].Provider != "OpenRouter" {
+		t.Errorf("unexpected hits %+v", hits)
+	}
+	if hits := registry.Scan("nothing to see"); len(hits) != 0 {
+		t.Errorf("Scan() found %+v in a clean corpus", hits)
+	}
+}
+
+func TestNewIssuer_RequiresDomain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "canaries.jsonl")
+	for _, domain := range []string{"", "localhost", "user@example.org", "-bad.example"} {
+		if _, err := NewIssuer(path, domain); err == nil {
+			t.Errorf("NewIssuer(%q) succeeded, want an error", domain)
+		}
+	}
+}
+
+func TestLoad_RejectsBadEntries(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := Load(filepath.Join(dir, "missing.jsonl")); err == nil {
+		t.Error("expected an error for a missing registry")
+	}
+	path := filepath.Join(dir, "canaries.jsonl")
+	if err := os.WriteFile(path, []byte("{\"token\":\"SS-AAAA-BBBB\"}\nnot json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Load() error = %v, want one naming line 2", err)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	msg := Message([]Canary{
+		{Token: "lena.moreau12345678@canary.example.org", Kind: KindEmail},
+		{Token: "SS-ABCD-EFGH", Kind: KindID},
+	})
+	if !strings.Contains(msg, "lena.moreau12345678@canary.example.org") || !strings.Contains(msg, "SS-ABCD-EFGH") {
+		t.Errorf("Message() = %q is missing a token", msg)
+	}
+}
@@ -0,0 +1,355 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Defaults for AWSKMSConfig.
+const (
+	DefaultAWSKMSMaxRetries = 3
+	defaultAWSKMSRetryWait  = 200 * time.Millisecond
+	defaultAWSKMSTimeout    = 10 * time.Second
+)
+
+// awsKMSContextKey is the encryption context entry that binds a DEK to the
+// AD. It holds a hash, since AWS logs encryption contexts in plain text.
+const awsKMSContextKey = "apg:ad-sha256"
+
+// awsKeyIDPattern matches a bare key ID, which unlike an alias or ARN is
+// passed through unchanged.
+var awsKeyIDPattern = regexp.MustCompile(`^(?:mrk-)?[0-9a-f]{8}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{4}-?[0-9a-f]{12}$|^mrk-[0-9a-f]{32}$`)
+
+// AWSKMSConfig configures an AWSKMS.
+type AWSKMSConfig struct {
+	// Region is the AWS region, e.g. "ap-southeast-2".
+	Region string
+	// Endpoint overrides https://kms.<region>.amazonaws.com, e.g. for a local
+	// emulator.
+	Endpoint    string
+	Credentials AWSCredentials
+	// AliasPrefix is put in front of a KEK ID to form its alias, as in
+	// "alias/<prefix><kekID>". KEK IDs that are key IDs, ARNs or aliases
+	// are used as they are.
+	AliasPrefix string
+	// MaxRetries bounds the retries of a call that failed with a network
+	// error, a server error or throttling (default 3).
+	MaxRetries int
+	// RetryWait is the first backoff; it doubles with each retry.
+	RetryWait  time.Duration
+	HTTPClient *http.Client
+}
+
+// AWSKMS wraps DEKs with AWS KMS, or any service that speaks its JSON
+// protocol, signing each request with SigV4. KEKs are KMS keys and never
+// leave the service; CreateKEK creates them behind an alias. The AD that
+// Encrypt and Decrypt authenticate is bound to the wrapped DEK through the
+// encryption context.
+type AWSKMS struct {
+	cfg    AWSKMSConfig
+	client *http.Client
+	// ctx bounds every call, including its retries; see WithContext.
+	ctx context.Context
+	// now is the clock requests are signed with.
+	now func() time.Time
+}
+
+// NewAWSKMS creates an AWSKMS. No request is made until the first call.
+func NewAWSKMS(cfg AWSKMSConfig) (*AWSKMS, error) {
+	if cfg.Region == "" {
+		return nil, errors.New("AWS region is not set")
+	}
+	if cfg.Credentials.AccessKeyID == "" || cfg.Credentials.SecretAccessKey == "" {
+		return nil, errors.New("AWS credentials are not set")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://kms." + cfg.Region + ".amazonaws.com"
+	}
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultAWSKMSMaxRetries
+	}
+	if cfg.RetryWait == 0 {
+		cfg.RetryWait = defaultAWSKMSRetryWait
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultAWSKMSTimeout}
+	}
+	return &AWSKMS{cfg: cfg, client: client, ctx: context.Background(), now: time.Now}, nil
+}
+
+// WithContext returns an AWSKMS that makes its calls under ctx, so that they
+// and their retries stop when ctx is done. It shares the client with a.
+func (a *AWSKMS) WithContext(ctx context.Context) KMS {
+	bound := *a
+	bound.ctx = ctx
+	return &bound
+}
+
+// AWSKMSError is an error response from the service.
+type AWSKMSError struct {
+	StatusCode int
+	// Type is the exception name, e.g. "NotFoundException".
+	Type    string
+	Message string
+}
+
+func (e *AWSKMSError) Error() string {
+	return fmt.Sprintf("AWS KMS returned %s (status %d): %s", e.Type, e.StatusCode, e.Message)
+}
+
+func (e *AWSKMSError) retryable() bool {
+	return e.StatusCode >= 500 || e.Type == "ThrottlingException"
+}
+
+// Wrap encrypts dek under the KMS key of kekID.
+func (a *AWSKMS) Wrap(dek []byte, kekID string) ([]byte, error) {
+	return a.WrapWithAD(dek, kekID, nil)
+}
+
+// Unwrap decrypts a DEK wrapped by Wrap.
+func (a *AWSKMS) Unwrap(wrappedDEK []byte, kekID string) ([]byte, error) {
+	return a.UnwrapWithAD(wrappedDEK, kekID, nil)
+}
+
+// WrapWithAD encrypts dek under the KMS key of kekID with an encryption
+// context derived from ad.
+func (a *AWSKMS) WrapWithAD(dek []byte, kekID string, ad []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+	}
+	err := a.call("Encrypt", kekID, ad, map[string]interface{}{"Plaintext": dek}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.CiphertextBlob, nil
+}
+
+// UnwrapWithAD decrypts a DEK wrapped by WrapWithAD with the same ad.
+func (a *AWSKMS) UnwrapWithAD(wrappedDEK []byte, kekID string, ad []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte
+	}
+	err := a.call("Decrypt", kekID, ad, map[string]interface{}{"CiphertextBlob": wrappedDEK}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// GenerateDataKey has the service generate a DEK of size bytes and wrap it
+// under the KMS key of kekID with an encryption context derived from ad.
+func (a *AWSKMS) GenerateDataKey(kekID string, size int, ad []byte) (dek, wrappedDEK []byte, err error) {
+	var resp struct {
+		Plaintext      []byte
+		CiphertextBlob []byte
+	}
+	err = a.call("GenerateDataKey", kekID, ad, map[string]interface{}{"NumberOfBytes": size}, &resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(resp.Plaintext) != size {
+		return nil, nil, fmt.Errorf("AWS KMS returned a data key of %d bytes, want %d", len(resp.Plaintext), size)
+	}
+	return resp.Plaintext, resp.CiphertextBlob, nil
+}
+
+// awsEncryptionContext binds ad to a data key; none is sent without AD.
+func awsEncryptionContext(ad []byte) map[string]string {
+	if len(ad) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(ad)
+	return map[string]string{awsKMSContextKey: hex.EncodeToString(sum[:])}
+}
+
+// awsKeyID maps a KEK ID to the KeyId the service expects.
+func (a *AWSKMS) awsKeyID(kekID string) string {
+	if strings.HasPrefix(kekID, "arn:") || strings.HasPrefix(kekID, "alias/") || awsKeyIDPattern.MatchString(kekID) {
+		return kekID
+	}
+	return "alias/" + a.cfg.AliasPrefix + kekID
+}
+
+// CreateKEK creates a symmetric KMS key for id and points the alias of id
+// at it. An existing alias is reported with ErrKEKExists. KEK IDs that are
+// key IDs, ARNs or aliases name keys that must already exist.
+func (a *AWSKMS) CreateKEK(id string) error {
+	if err := ValidateKEKID(id); err != nil {
+		return err
+	}
+	alias := a.awsKeyID(id)
+	if alias != "alias/"+a.cfg.AliasPrefix+id {
+		return fmt.Errorf("cannot create KEK %s: only KEKs named by alias prefix are created", id)
+	}
+
+	// Look the alias up first, so that a restarted gateway does not create a
+	// key for every user only to find their alias taken.
+	if _, found, err := a.describeAlias(alias); err != nil {
+		return err
+	} else if found {
+		return fmt.Errorf("%w: %s", ErrKEKExists, id)
+	}
+
+	// CreateKey is not idempotent: a retry after a lost response would leave
+	// a key behind that nothing refers to, so it is sent only once.
+	var created struct {
+		KeyMetadata struct {
+			KeyId string
+		}
+	}
+	err := a.invokeOnce("CreateKey", map[string]interface{}{
+		"Description": "APG KEK " + id,
+		"KeySpec":     "SYMMETRIC_DEFAULT",
+		"KeyUsage":    "ENCRYPT_DECRYPT",
+	}, &created)
+	if err != nil {
+		return fmt.Errorf("AWS KMS CreateKey for %s failed: %w", alias, err)
+	}
+	keyID := created.KeyMetadata.KeyId
+	err = a.invoke("CreateAlias", map[string]interface{}{"AliasName": alias, "TargetKeyId": keyID}, nil)
+	var kmsErr *AWSKMSError
+	if err != nil && (!errors.As(err, &kmsErr) || kmsErr.Type != "AlreadyExistsException") {
+		return fmt.Errorf("AWS KMS CreateAlias %s failed: %w", alias, err)
+	}
+	if err == nil {
+		return nil
+	}
+
+	// The alias exists: either a retried CreateAlias had already succeeded,
+	// or another gateway created the KEK in the meantime.
+	target, found, err := a.describeAlias(alias)
+	if err != nil {
+		return err
+	}
+	if found && target == keyID {
+		return nil
+	}
+	// The key made here was never used, so it is deleted after the shortest
+	// waiting period.
+	_ = a.invoke("ScheduleKeyDeletion", map[string]interface{}{"KeyId": keyID, "PendingWindowInDays": 7}, nil)
+	if !found {
+		return fmt.Errorf("AWS KMS CreateAlias %s reported the alias as taken, but DescribeKey does not find it", alias)
+	}
+	return fmt.Errorf("%w: %s", ErrKEKExists, id)
+}
+
+// describeAlias returns the ID of the key alias points at, and whether the
+// alias exists.
+func (a *AWSKMS) describeAlias(alias string) (keyID string, found bool, err error) {
+	var described struct {
+		KeyMetadata struct {
+			KeyId string
+		}
+	}
+	err = a.invoke("DescribeKey", map[string]interface{}{"KeyId": alias}, &described)
+	var kmsErr *AWSKMSError
+	if errors.As(err, &kmsErr) && kmsErr.Type == "NotFoundException" {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("AWS KMS DescribeKey with key %s failed: %w", alias, err)
+	}
+	return described.KeyMetadata.KeyId, true, nil
+}
+
+// call invokes action for the key of kekID, with the encryption context of
+// ad.
+func (a *AWSKMS) call(action, kekID string, ad []byte, params map[string]interface{}, out interface{}) error {
+	if err := ValidateKEKID(kekID); err != nil {
+		return err
+	}
+	params["KeyId"] = a.awsKeyID(kekID)
+	if ctx := awsEncryptionContext(ad); ctx != nil {
+		params["EncryptionContext"] = ctx
+	}
+	if err := a.invoke(action, params, out); err != nil {
+		return fmt.Errorf("AWS KMS %s with key %s failed: %w", action, params["KeyId"], err)
+	}
+	return nil
+}
+
+// invokeOnce sends action with params without retrying, and decodes the
+// response into out unless it is nil.
+func (a *AWSKMS) invokeOnce(action string, params map[string]interface{}, out interface{}) error {
+	payload, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal AWS KMS request: %w", err)
+	}
+	return a.post(action, payload, out)
+}
+
+// invoke sends action with params, retrying transient failures with
+// exponential backoff until a.ctx is done, and decodes the response into out
+// unless it is nil.
+func (a *AWSKMS) invoke(action string, params map[string]interface{}, out interface{}) error {
+	payload, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to marshal AWS KMS request: %w", err)
+	}
+	wait := a.cfg.RetryWait
+	for attempt := 0; ; attempt++ {
+		err := a.post(action, payload, out)
+		var kmsErr *AWSKMSError
+		retryable := err != nil && (!errors.As(err, &kmsErr) || kmsErr.retryable())
+		if !retryable || attempt >= a.cfg.MaxRetries {
+			return err
+		}
+		if err := sleepContext(a.ctx, wait); err != nil {
+			return fmt.Errorf("gave up retrying AWS KMS call: %w", err)
+		}
+		wait *= 2
+	}
+}
+
+func (a *AWSKMS) post(action string, payload []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(a.ctx, http.MethodPost, a.cfg.Endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create AWS KMS request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(req, payload, a.cfg.Credentials, "kms", a.cfg.Region, a.now())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call AWS KMS: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read AWS KMS response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		// The message key is "message" or "Message", depending on the
+		// exception; decoding ignores case.
+		var body struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &body)
+		kmsErr := &AWSKMSError{StatusCode: resp.StatusCode, Type: body.Type, Message: body.Message}
+		if i := strings.LastIndex(kmsErr.Type, "#"); i >= 0 {
+			kmsErr.Type = kmsErr.Type[i+1:]
+		}
+		return kmsErr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to decode AWS KMS response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testAWSCredentials = AWSCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+
+// TestSignV4_Vanilla checks the get-vanilla case of the AWS SigV4 test suite.
+func TestSignV4_Vanilla(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signV4(req, nil, testAWSCredentials, "service", "us-east-1", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Authorization = %q\nwant %q", got, want)
+	}
+}
+
+// fakeAWSKMS is an httptest stand-in for the AWS KMS JSON protocol. It checks
+// every signature and seals data keys with AES-GCM, authenticating the key
+// and the encryption context as the real service does.
+type fakeAWSKMS struct {
+	mu       sync.Mutex
+	keys     map[string][]byte // KeyId -> key material
+	contexts []map[string]string
+	failures int
+	calls    int
+	// aliases maps the aliases CreateAlias made to their key.
+	aliases map[string]string
+	// lostReplies answers this many requests per action with a 500 after
+	// carrying them out, as when a response is lost.
+	lostReplies map[string]int
+	deleted     []string
+	// raceAlias is created for another key just before CreateAlias makes it.
+	raceAlias string
+}
+
+func (f *fakeAWSKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	fail := func(status int, typ, msg string) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]string{"__type": "com.amazonaws.kms#" + typ, "message": msg})
+	}
+	payload, _ := io.ReadAll(r.Body)
+	if !f.validSignature(r, payload) {
+		fail(http.StatusBadRequest, "InvalidSignatureException", "signature mismatch")
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		fail(http.StatusBadRequest, "ThrottlingException", "rate exceeded")
+		return
+	}
+
+	var params struct {
+		KeyId             string
+		AliasName         string
+		TargetKeyId       string
+		Plaintext         []byte
+		CiphertextBlob    []byte
+		NumberOfBytes     int
+		EncryptionContext map[string]string
+	}
+	_ = json.Unmarshal(payload, &params)
+	f.contexts = append(f.contexts, params.EncryptionContext)
+	action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "TrentService.")
+	if f.lostReplies[action] > 0 {
+		f.lostReplies[action]--
+		w = &lostReply{ResponseWriter: w}
+		defer w.(*lostReply).send()
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.CreateKey":
+		keyID := fmt.Sprintf("key-%d", len(f.keys))
+		key := make([]byte, 32)
+		_, _ = rand.Read(key)
+		f.keys[keyID] = key
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"KeyMetadata": map[string]string{"KeyId": keyID}})
+		return
+	case "TrentService.CreateAlias":
+		if params.AliasName == f.raceAlias {
+			f.raceAlias = ""
+			f.keys[params.AliasName] = f.keys[params.TargetKeyId]
+			f.aliases[params.AliasName] = "key-other"
+		}
+		if _, ok := f.keys[params.AliasName]; ok {
+			fail(http.StatusBadRequest, "AlreadyExistsException", "Alias "+params.AliasName+" already exists")
+			return
+		}
+		f.keys[params.AliasName] = f.keys[params.TargetKeyId]
+		if f.aliases == nil {
+			f.aliases = make(map[string]string)
+		}
+		f.aliases[params.AliasName] = params.TargetKeyId
+		return
+	case "TrentService.ScheduleKeyDeletion":
+		f.deleted = append(f.deleted, params.KeyId)
+		return
+	}
+	key, ok := f.keys[params.KeyId]
+	if !ok {
+		fail(http.StatusBadRequest, "NotFoundException", "Alias "+params.KeyId+" is not found.")
+		return
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	ad, _ := json.Marshal(params.EncryptionContext)
+
+	seal := func(plaintext []byte) []byte {
+		nonce := make([]byte, gcm.NonceSize())
+		_, _ = rand.Read(nonce)
+		return gcm.Seal(nonce, nonce, plaintext, ad)
+	}
+	reply := func(v map[string]interface{}) {
+		v["KeyId"] = "arn:aws:kms:ap-southeast-2:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab"
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.DescribeKey":
+		keyID := params.KeyId
+		if target, ok := f.aliases[keyID]; ok {
+			keyID = target
+		}
+		reply(map[string]interface{}{"KeyMetadata": map[string]string{"KeyId": keyID}})
+	case "TrentService.Encrypt":
+		reply(map[string]interface{}{"CiphertextBlob": seal(params.Plaintext)})
+	case "TrentService.GenerateDataKey":
+		dek := make([]byte, params.NumberOfBytes)
+		_, _ = rand.Read(dek)
+		reply(map[string]interface{}{"Plaintext": dek, "CiphertextBlob": seal(dek)})
+	case "TrentService.Decrypt":
+		blob := params.CiphertextBlob
+		if len(blob) < gcm.NonceSize() {
+			fail(http.StatusBadRequest, "InvalidCiphertextException", "")
+			return
+		}
+		plaintext, err := gcm.Open(nil, blob[:gcm.NonceSize()], blob[gcm.NonceSize():], ad)
+		if err != nil {
+			fail(http.StatusBadRequest, "InvalidCiphertextException", "")
+			return
+		}
+		reply(map[string]interface{}{"Plaintext": plaintext})
+	default:
+		fail(http.StatusBadRequest, "UnknownOperationException", "")
+	}
+}
+
+// validSignature re-signs the request from the headers it claims to sign.
+func (f *fakeAWSKMS) validSignature(r *http.Request, payload []byte) bool {
+	auth := r.Header.Get("Authorization")
+	_, signed, ok := strings.Cut(auth, "SignedHeaders=")
+	if !ok {
+		return false
+	}
+	signed, _, _ = strings.Cut(signed, ",")
+	date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	for _, name := range strings.Split(signed, ";") {
+		if name != "host" && name != "x-amz-date" {
+			check.Header.Set(name, r.Header.Get(name))
+		}
+	}
+	signV4(check, payload, testAWSCredentials, "kms", "ap-southeast-2", date)
+	return check.Header.Get("Authorization") == auth
+}
+
+// lostReply discards a response and sends a server error in its place.
+type lostReply struct {
+	http.ResponseWriter
+}
+
+func (l *lostReply) WriteHeader(int)             {}
+func (l *lostReply) Write(b []byte) (int, error) { return len(b), nil }
+
+func (l *lostReply) send() {
+	l.ResponseWriter.WriteHeader(http.StatusInternalServerError)
+	_ = json.NewEncoder(l.ResponseWriter).Encode(map[string]string{"__type": "KMSInternalException", "message": "lost"})
+}
+
+func newTestAWSKMS(t *testing.T) (*AWSKMS, *fakeAWSKMS) {
+	fake := &fakeAWSKMS{keys: map[string][]byte{"alias/apg-default-user-kek": bytes.Repeat([]byte{1}, 32)}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	kms, err := NewAWSKMS(AWSKMSConfig{
+		Region:      "ap-southeast-2",
+		Endpoint:    server.URL,
+		Credentials: testAWSCredentials,
+		AliasPrefix: "apg-",
+		RetryWait:   time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kms, fake
+}
+
+func TestAWSKMS_EncryptDecrypt(t *testing.T) {
+	kms, fake := newTestAWSKMS(t)
+	plaintext := []byte("zone B")
+	ad := []byte("request metadata")
+
+	// Encrypt has the service generate the DEK, bound to the AD.
+	ciphertext, wrappedDEK, nonce, err := Encrypt(plaintext, ad, kms, "default-user-kek")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if got, err := Decrypt(ciphertext, wrappedDEK, nonce, ad, kms, "default-user-kek"); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+	if ctx := fake.contexts[0]; len(ctx) != 1 || ctx[awsKMSContextKey] == "" || strings.Contains(ctx[awsKMSContextKey], "metadata") {
+		t.Errorf("unexpected encryption context %v", ctx)
+	}
+
+	// The service refuses the DEK under different AD.
+	var kmsErr *AWSKMSError
+	if _, err := Decrypt(ciphertext, wrappedDEK, nonce, []byte("other"), kms, "default-user-kek"); !errors.As(err, &kmsErr) || kmsErr.Type != "InvalidCiphertextException" {
+		t.Errorf("Decrypt with other AD: err = %v", err)
+	}
+
+	// Plain Wrap and Unwrap send no encryption context.
+	dek := bytes.Repeat([]byte{5}, 16)
+	wrapped, err := kms.Wrap(dek, "default-user-kek")
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+	if got, err := kms.Unwrap(wrapped, "default-user-kek"); err != nil || !bytes.Equal(got, dek) {
+		t.Fatalf("Unwrap = %x, %v", got, err)
+	}
+	if ctx := fake.contexts[len(fake.contexts)-1]; ctx != nil {
+		t.Errorf("unexpected encryption context %v", ctx)
+	}
+
+	if _, err := kms.Wrap(dek, "missing"); !errors.As(err, &kmsErr) || kmsErr.Type != "NotFoundException" {
+		t.Errorf("unknown key: err = %v", err)
+	}
+}
+
+func TestAWSKMS_RetriesAndSignature(t *testing.T) {
+	kms, fake := newTestAWSKMS(t)
+	fake.failures = 2
+	if _, err := kms.Wrap(make([]byte, 16), "default-user-kek"); err != nil {
+		t.Fatalf("Wrap should succeed after throttling: %v", err)
+	}
+	if fake.calls != 3 {
+		t.Errorf("calls = %d, want 3", fake.calls)
+	}
+
+	// A bad signature is a client error and not retried.
+	kms.cfg.Credentials.SecretAccessKey = "wrong"
+	fake.calls = 0
+	var kmsErr *AWSKMSError
+	if _, err := kms.Wrap(make([]byte, 16), "default-user-kek"); !errors.As(err, &kmsErr) || kmsErr.Type != "InvalidSignatureException" || fake.calls != 1 {
+		t.Errorf("err = %v after %d calls", err, fake.calls)
+	}
+}
+
+func TestAWSKMS_RetriesStopWithContext(t *testing.T) {
+	kms, fake := newTestAWSKMS(t)
+	kms.cfg.RetryWait = time.Hour
+	fake.failures = 10
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := BindContext(kms, ctx).Wrap(make([]byte, 16), "default-user-kek")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Wrap returned after %v, the backoff ignored the context", elapsed)
+	}
+	if fake.calls != 1 {
+		t.Errorf("calls = %d, want 1", fake.calls)
+	}
+}
+
+func TestAWSKMS_CreateKEK(t *testing.T) {
+	kms, fake := newTestAWSKMS(t)
+	if err := kms.CreateKEK("user-abc"); err != nil {
+		t.Fatalf("CreateKEK failed: %v", err)
+	}
+	if _, ok := fake.keys["alias/apg-user-abc"]; !ok {
+		t.Fatalf("no alias created: %v", fake.keys)
+	}
+	testEncryptDecrypt(t, kms, "user-abc")
+
+	// An existing alias is found without creating another key.
+	fake.calls = 0
+	if err := kms.CreateKEK("user-abc"); !errors.Is(err, ErrKEKExists) || fake.calls != 1 {
+		t.Errorf("err = %v after %d calls, want ErrKEKExists after 1", err, fake.calls)
+	}
+	if err := kms.CreateKEK("alias/shared"); err == nil {
+		t.Error("expected a KEK named by alias to be refused")
+	}
+}
+
+func TestAWSKMS_CreateKEKRetries(t *testing.T) {
+	kms, fake := newTestAWSKMS(t)
+
+	// A CreateKey whose reply is lost is not sent again.
+	fake.lostReplies = map[string]int{"CreateKey": 1}
+	keys := len(fake.keys)
+	if err := kms.CreateKEK("user-abc"); err == nil {
+		t.Fatal("expected CreateKEK to fail")
+	}
+	if created := len(fake.keys) - keys; created != 1 {
+		t.Errorf("%d keys created, want 1", created)
+	}
+
+	// A CreateAlias whose reply is lost is retried, finds its own alias and
+	// keeps the key.
+	fake.lostReplies = map[string]int{"CreateAlias": 1}
+	if err := kms.CreateKEK("user-abc"); err != nil {
+		t.Fatalf("CreateKEK failed: %v", err)
+	}
+	if len(fake.deleted) != 0 {
+		t.Errorf("deleted %v", fake.deleted)
+	}
+	testEncryptDecrypt(t, kms, "user-abc")
+
+	// An alias another gateway created in the meantime wins, and the key
+	// made here is deleted.
+	fake.raceAlias = "alias/apg-user-xyz"
+	if err := kms.CreateKEK("user-xyz"); !errors.Is(err, ErrKEKExists) {
+		t.Errorf("err = %v, want ErrKEKExists", err)
+	}
+	if len(fake.deleted) != 1 || fake.deleted[0] == fake.aliases["alias/apg-user-xyz"] {
+		t.Errorf("deleted %v, alias points at %s", fake.deleted, fake.aliases["alias/apg-user-xyz"])
+	}
+}
+
+func TestAWSKMS_KeyID(t *testing.T) {
+	kms, _ := newTestAWSKMS(t)
+	tests := map[string]string{
+		"default-user-kek":                     "alias/apg-default-user-kek",
+		"alias/shared":                         "alias/shared",
+		"1234abcd-12ab-34cd-56ef-1234567890ab": "1234abcd-12ab-34cd-56ef-1234567890ab",
+		"arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab": "arn:aws:kms:us-east-1:111122223333:key/1234abcd-12ab-34cd-56ef-1234567890ab",
+	}
+	for kekID, want := range tests {
+		if got := kms.awsKeyID(kekID); got != want {
+			t.Errorf("awsKeyID(%q) = %q, want %q", kekID, got, want)
+		}
+	}
+}
@@ -13,16 +13,26 @@ import (
 // It returns the ciphertext, the wrapped DEK, the nonce used, and any error.
 func Encrypt(plaintext []byte, ad []byte, kms KMS, kekID string) (ciphertext, wrappedDEK, nonce []byte, err error) {
 	// 1. Generate a new, random Data Encryption Key (DEK).
-	// Ascon-128 uses a 16-byte (128-bit) key.
-	dek := make([]byte, ascon.KeySize)
-	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to generate DEK: %w", err)
-	}
+	// Ascon-128 uses a 16-byte (128-bit) key. A KMS that generates data keys
+	// itself returns the DEK already wrapped.
+	var dek []byte
+	if g, ok := kms.(DataKeyKMS); ok {
+		dek, wrappedDEK, err = g.GenerateDataKey(kekID, ascon.KeySize, ad)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to generate DEK with KMS: %w", err)
+		}
+	} else {
+		dek = make([]byte, ascon.KeySize)
+		if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to generate DEK: %w", err)
+		}
 
-	// 2. Use the KMS to wrap the DEK with the user's KEK.
-	wrappedDEK, err = kms.Wrap(dek, kekID)
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to wrap DEK with KMS: %w", err)
+		// 2. Use the KMS to wrap the DEK with the user's KEK, bound to the
+		// associated data when the KMS supports it.
+		wrappedDEK, err = wrapDEK(kms, dek, kekID, ad)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to wrap DEK with KMS: %w", err)
+		}
 	}
 
 	// 3. Create a new Ascon-128 AEAD cipher instance with the plaintext DEK.
@@ -51,7 +61,7 @@ func Encrypt(plaintext []byte, ad []byte, kms KMS, kekID string) (ciphertext, wr
 // It returns the original plaintext and any error.
 func Decrypt(ciphertext, wrappedDEK, nonce, ad []byte, kms KMS, kekID string) ([]byte, error) {
 	// 1. Use the KMS to unwrap the DEK.
-	dek, err := kms.Unwrap(wrappedDEK, kekID)
+	dek, err := unwrapDEK(kms, wrappedDEK, kekID, ad)
 	if err != nil {
 		return nil, fmt.Errorf("failed to unwrap DEK with KMS: %w", err)
 	}
@@ -6,9 +6,23 @@ import (
 )
 
 func TestEncryptDecrypt(t *testing.T) {
+	testEncryptDecrypt(t, NewMockKMS(), "default-user-kek")
+}
+
+func TestDecrypt_TamperedCiphertext(t *testing.T) {
+	testDecryptTamperedCiphertext(t, NewMockKMS(), "default-user-kek")
+}
+
+func TestDecrypt_TamperedAssociatedData(t *testing.T) {
+	testDecryptTamperedAssociatedData(t, NewMockKMS(), "default-user-kek")
+}
+
+// The tests below take the KMS under test, so that every backend passes the
+// same checks as MockKMS.
+
+func testEncryptDecrypt(t *testing.T, kms KMS, kekID string) {
+	t.Helper()
 	// 1. Setup
-	kms := NewMockKMS()
-	kekID := "default-user-kek"
 	plaintext := []byte("This is a highly secret message.")
 	ad := []byte("This is the associated data.")
 
@@ -40,10 +54,9 @@ func TestEncryptDecrypt(t *testing.T) {
 	}
 }
 
-func TestDecrypt_TamperedCiphertext(t *testing.T) {
+func testDecryptTamperedCiphertext(t *testing.T, kms KMS, kekID string) {
+	t.Helper()
 	// 1. Setup
-	kms := NewMockKMS()
-	kekID := "default-user-kek"
 	plaintext := []byte("Another secret message.")
 	ad := []byte("Some associated data.")
 
@@ -66,10 +79,9 @@ func TestDecrypt_TamperedCiphertext(t *testing.T) {
 	t.Logf("Successfully caught error from tampered ciphertext: %v", err)
 }
 
-func TestDecrypt_TamperedAssociatedData(t *testing.T) {
+func testDecryptTamperedAssociatedData(t *testing.T, kms KMS, kekID string) {
+	t.Helper()
 	// 1. Setup
-	kms := NewMockKMS()
-	kekID := "default-user-kek"
 	plaintext := []byte("A third secret message.")
 	ad := []byte("Original AD")
 	tamperedAd := []byte("Tampered AD")
@@ -0,0 +1,330 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Format-preserving encryption modes, as specified in NIST SP 800-38G Rev. 1.
+const (
+	ModeFF1  = "ff1"
+	ModeFF31 = "ff3-1"
+)
+
+// fpeAlphabet gives the numerals of radixes up to 36, in order.
+const fpeAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+// FF31TweakSize is the tweak length FF3-1 requires, in bytes.
+const FF31TweakSize = 7
+
+// minFPEDomain is the smallest domain, radix^length, SP 800-38G allows.
+const minFPEDomain = 1_000_000
+
+// FPE encrypts numeral strings into numeral strings of the same length and
+// radix. Numerals are the first radix characters of 0-9a-z.
+type FPE interface {
+	Encrypt(x string, tweak []byte) (string, error)
+	Decrypt(x string, tweak []byte) (string, error)
+}
+
+// NewFPE returns the FF1 or FF3-1 cipher for key, an AES key of 16, 24 or
+// 32 bytes, over numerals of the given radix.
+func NewFPE(mode string, key []byte, radix int) (FPE, error) {
+	switch mode {
+	case ModeFF1:
+		return NewFF1(key, radix)
+	case ModeFF31:
+		return NewFF31(key, radix)
+	default:
+		return nil, fmt.Errorf("unknown FPE mode %q: want %s or %s", mode, ModeFF1, ModeFF31)
+	}
+}
+
+// FF1 implements the FF1 mode of SP 800-38G.
+type FF1 struct {
+	block cipher.Block
+	radix int
+}
+
+// NewFF1 creates an FF1 cipher.
+func NewFF1(key []byte, radix int) (*FF1, error) {
+	if radix < 2 || radix > len(fpeAlphabet) {
+		return nil, fmt.Errorf("unsupported radix %d", radix)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return &FF1{block: block, radix: radix}, nil
+}
+
+// Encrypt enciphers x under tweak, which may have any length.
+func (f *FF1) Encrypt(x string, tweak []byte) (string, error) {
+	return f.cipher(x, tweak, true)
+}
+
+// Decrypt reverses Encrypt.
+func (f *FF1) Decrypt(x string, tweak []byte) (string, error) {
+	return f.cipher(x, tweak, false)
+}
+
+func (f *FF1) cipher(x string, tweak []byte, encrypt bool) (string, error) {
+	numerals, err := parseNumerals(x, f.radix)
+	if err != nil {
+		return "", err
+	}
+	n := len(numerals)
+	if err := checkDomain(f.radix, n); err != nil {
+		return "", err
+	}
+	u, v := n/2, n-n/2
+	a, b := numerals[:u], numerals[u:]
+
+	radix := big.NewInt(int64(f.radix))
+	byteLen := int(math.Ceil(math.Ceil(float64(v)*math.Log2(float64(f.radix))) / 8))
+	d := 4*((byteLen+3)/4) + 4
+	t := len(tweak)
+
+	p := []byte{1, 2, 1, byte(f.radix >> 16), byte(f.radix >> 8), byte(f.radix), 10, byte(u),
+		byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n),
+		byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t)}
+	pad := (16 - (t+byteLen+1)%16) % 16
+	q := make([]byte, t+pad+1+byteLen)
+	copy(q, tweak)
+
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	for step := 0; step < 10; step++ {
+		i := step
+		if !encrypt {
+			i = 9 - step
+		}
+		// In decryption the roles of A and B are swapped.
+		src := b
+		if !encrypt {
+			src = a
+		}
+		q[t+pad] = byte(i)
+		numBytes := numeralsValue(src, radix).Bytes()
+		clear(q[t+pad+1:])
+		copy(q[len(q)-len(numBytes):], numBytes)
+
+		r := f.prf(append(append([]byte{}, p...), q...))
+		s := f.expand(r, d)
+		y := new(big.Int).SetBytes(s)
+
+		m, mod := u, modU
+		if i%2 == 1 {
+			m, mod = v, modV
+		}
+		if encrypt {
+			c := new(big.Int).Add(numeralsValue(a, radix), y)
+			c.Mod(c, mod)
+			a, b = b, valueNumerals(c, radix, m)
+		} else {
+			c := new(big.Int).Sub(numeralsValue(b, radix), y)
+			c.Mod(c, mod)
+			a, b = valueNumerals(c, radix, m), a
+		}
+	}
+	return formatNumerals(append(append([]int{}, a...), b...)), nil
+}
+
+// prf is the CBC-MAC of data, whose length is a multiple of the block size.
+func (f *FF1) prf(data []byte) []byte {
+	y := make([]byte, aes.BlockSize)
+	for i := 0; i < len(data); i += aes.BlockSize {
+		for j := 0; j < aes.BlockSize; j++ {
+			y[j] ^= data[i+j]
+		}
+		f.block.Encrypt(y, y)
+	}
+	return y
+}
+
+// expand stretches r to d bytes: R || CIPH(R xor [1]) || CIPH(R xor [2]) ...
+func (f *FF1) expand(r []byte, d int) []byte {
+	s := append([]byte{}, r...)
+	for j := 1; len(s) < d; j++ {
+		block := append([]byte{}, r...)
+		for k := 0; k < 8; k++ {
+			block[aes.BlockSize-1-k] ^= byte(uint64(j) >> (8 * k))
+		}
+		f.block.Encrypt(block, block)
+		s = append(s, block...)
+	}
+	return s[:d]
+}
+
+// FF31 implements the FF3-1 mode of SP 800-38G Rev. 1.
+type FF31 struct {
+	block cipher.Block
+	radix int
+}
+
+// NewFF31 creates an FF3-1 cipher.
+func NewFF31(key []byte, radix int) (*FF31, error) {
+	if radix < 2 || radix > len(fpeAlphabet) {
+		return nil, fmt.Errorf("unsupported radix %d", radix)
+	}
+	// FF3-1 runs AES under the byte-reversed key.
+	block, err := aes.NewCipher(reverseBytes(key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return &FF31{block: block, radix: radix}, nil
+}
+
+// Encrypt enciphers x under tweak, which must be FF31TweakSize bytes.
+func (f *FF31) Encrypt(x string, tweak []byte) (string, error) {
+	tl, tr, err := ff31Tweak(tweak)
+	if err != nil {
+		return "", err
+	}
+	return f.cipher(x, tl, tr, true)
+}
+
+// Decrypt reverses Encrypt.
+func (f *FF31) Decrypt(x string, tweak []byte) (string, error) {
+	tl, tr, err := ff31Tweak(tweak)
+	if err != nil {
+		return "", err
+	}
+	return f.cipher(x, tl, tr, false)
+}
+
+// ff31Tweak splits a 56-bit tweak into the two 32-bit halves FF3 uses.
+func ff31Tweak(tweak []byte) (tl, tr [4]byte, err error) {
+	if len(tweak) != FF31TweakSize {
+		return tl, tr, fmt.Errorf("FF3-1 tweak must be %d bytes, got %d", FF31TweakSize, len(tweak))
+	}
+	tl = [4]byte{tweak[0], tweak[1], tweak[2], tweak[3] & 0xf0}
+	tr = [4]byte{tweak[4], tweak[5], tweak[6], tweak[3] << 4}
+	return tl, tr, nil
+}
+
+// cipher is FF3 with the tweak halves given; FF3-1 only changes how they are
+// derived.
+func (f *FF31) cipher(x string, tl, tr [4]byte, encrypt bool) (string, error) {
+	numerals, err := parseNumerals(x, f.radix)
+	if err != nil {
+		return "", err
+	}
+	n := len(numerals)
+	if err := checkDomain(f.radix, n); err != nil {
+		return "", err
+	}
+	if maxLen := 2 * int(math.Floor(96/math.Log2(float64(f.radix)))); n > maxLen {
+		return "", fmt.Errorf("FF3-1 input of %d numerals exceeds the maximum of %d", n, maxLen)
+	}
+	u, v := (n+1)/2, n-(n+1)/2
+	a, b := numerals[:u], numerals[u:]
+
+	radix := big.NewInt(int64(f.radix))
+	modU := new(big.Int).Exp(radix, big.NewInt(int64(u)), nil)
+	modV := new(big.Int).Exp(radix, big.NewInt(int64(v)), nil)
+	for step := 0; step < 8; step++ {
+		i := step
+		if !encrypt {
+			i = 7 - step
+		}
+		m, mod, w := u, modU, tr
+		if i%2 == 1 {
+			m, mod, w = v, modV, tl
+		}
+		src := b
+		if !encrypt {
+			src = a
+		}
+
+		p := make([]byte, aes.BlockSize)
+		copy(p, w[:])
+		p[3] ^= byte(i)
+		numBytes := numeralsValue(reverseNumerals(src), radix).Bytes()
+		copy(p[aes.BlockSize-len(numBytes):], numBytes)
+		s := reverseBytes(p)
+		f.block.Encrypt(s, s)
+		y := new(big.Int).SetBytes(reverseBytes(s))
+
+		if encrypt {
+			c := new(big.Int).Add(numeralsValue(reverseNumerals(a), radix), y)
+			c.Mod(c, mod)
+			a, b = b, reverseNumerals(valueNumerals(c, radix, m))
+		} else {
+			c := new(big.Int).Sub(numeralsValue(reverseNumerals(b), radix), y)
+			c.Mod(c, mod)
+			a, b = reverseNumerals(valueNumerals(c, radix, m)), a
+		}
+	}
+	return formatNumerals(append(append([]int{}, a...), b...)), nil
+}
+
+func checkDomain(radix, n int) error {
+	if n < 2 || math.Pow(float64(radix), float64(n)) < minFPEDomain {
+		return fmt.Errorf("input of %d numerals in radix %d is below the minimum domain size", n, radix)
+	}
+	return nil
+}
+
+func parseNumerals(x string, radix int) ([]int, error) {
+	numerals := make([]int, len(x))
+	for i, c := range strings.ToLower(x) {
+		n := strings.IndexRune(fpeAlphabet[:radix], c)
+		if n < 0 {
+			return nil, fmt.Errorf("%q is not a numeral in radix %d", c, radix)
+		}
+		numerals[i] = n
+	}
+	return numerals, nil
+}
+
+func formatNumerals(numerals []int) string {
+	b := make([]byte, len(numerals))
+	for i, n := range numerals {
+		b[i] = fpeAlphabet[n]
+	}
+	return string(b)
+}
+
+// numeralsValue is NUM_radix: the numerals read as a number, most
+// significant first.
+func numeralsValue(numerals []int, radix *big.Int) *big.Int {
+	x := new(big.Int)
+	for _, n := range numerals {
+		x.Mul(x, radix)
+		x.Add(x, big.NewInt(int64(n)))
+	}
+	return x
+}
+
+// valueNumerals is STR_radix^m: x as exactly m numerals.
+func valueNumerals(x *big.Int, radix *big.Int, m int) []int {
+	numerals := make([]int, m)
+	x = new(big.Int).Set(x)
+	digit := new(big.Int)
+	for i := m - 1; i >= 0; i-- {
+		x.DivMod(x, radix, digit)
+		numerals[i] = int(digit.Int64())
+	}
+	return numerals
+}
+
+func reverseNumerals(numerals []int) []int {
+	r := make([]int, len(numerals))
+	for i, n := range numerals {
+		r[len(numerals)-1-i] = n
+	}
+	return r
+}
+
+func reverseBytes(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
@@ -0,0 +1,113 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestFF1_NISTSamples checks the AES-128 FF1 samples published with SP 800-38G.
+func TestFF1_NISTSamples(t *testing.T) {
+	key := "2b7e151628aed2a6abf7158809cf4f3c"
+	tests := []struct {
+		name      string
+		radix     int
+		tweak     string
+		plaintext string
+		want      string
+	}{
+		{"sample 1", 10, "", "0123456789", "2433477484"},
+		{"sample 2", 10, "39383736353433323130", "0123456789", "6124200773"},
+		{"sample 3", 36, "3737373770717273373737", "0123456789abcdefghi", "a9tv40mll9kdu509eum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFF1(mustHex(t, key), tt.radix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tweak := mustHex(t, tt.tweak)
+			got, err := f.Encrypt(tt.plaintext, tweak)
+			if err != nil || got != tt.want {
+				t.Fatalf("Encrypt = %q, %v; want %q", got, err, tt.want)
+			}
+			back, err := f.Decrypt(got, tweak)
+			if err != nil || back != tt.plaintext {
+				t.Errorf("Decrypt = %q, %v; want %q", back, err, tt.plaintext)
+			}
+		})
+	}
+}
+
+// TestFF3_Sample checks the FF3 core, which FF3-1 shares, against the first
+// AES-128 FF3 sample. FF3 takes a 64-bit tweak split into two halves.
+func TestFF3_Sample(t *testing.T) {
+	f, err := NewFF31(mustHex(t, "ef4359d8d580aa4f7f036d6f04fc6a94"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tweak := mustHex(t, "d8e7920afa330a73")
+	var tl, tr [4]byte
+	copy(tl[:], tweak[:4])
+	copy(tr[:], tweak[4:])
+
+	got, err := f.cipher("890121234567890000", tl, tr, true)
+	if err != nil || got != "750918814058654607" {
+		t.Fatalf("got %q, %v; want 750918814058654607", got, err)
+	}
+	back, err := f.cipher(got, tl, tr, false)
+	if err != nil || back != "890121234567890000" {
+		t.Errorf("decrypted to %q, %v", back, err)
+	}
+}
+
+func TestFPE_RoundTrip(t *testing.T) {
+	key := mustHex(t, "00112233445566778899aabbccddeeff")
+	tweak := []byte("PHONE\x00\x01")
+	for _, mode := range []string{ModeFF1, ModeFF31} {
+		t.Run(mode, func(t *testing.T) {
+			f, err := NewFPE(mode, key, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, x := range []string{"412345678", "000000", "99999999999999999999"} {
+				c, err := f.Encrypt(x, tweak)
+				if err != nil {
+					t.Fatalf("Encrypt(%q): %v", x, err)
+				}
+				if len(c) != len(x) || c == x {
+					t.Errorf("Encrypt(%q) = %q", x, c)
+				}
+				if p, err := f.Decrypt(c, tweak); err != nil || p != x {
+					t.Errorf("Decrypt(%q) = %q, %v; want %q", c, p, err, x)
+				}
+			}
+		})
+	}
+}
+
+func TestFPE_Rejects(t *testing.T) {
+	key := make([]byte, 16)
+	ff1, _ := NewFF1(key, 10)
+	if _, err := ff1.Encrypt("12345", nil); err == nil {
+		t.Error("FF1 accepted a domain below one million")
+	}
+	if _, err := ff1.Encrypt("12a456", nil); err == nil {
+		t.Error("FF1 accepted a non-numeral")
+	}
+	ff31, _ := NewFF31(key, 10)
+	if _, err := ff31.Encrypt("123456", []byte("12345678")); err == nil {
+		t.Error("FF3-1 accepted a 64-bit tweak")
+	}
+	if _, err := NewFPE("ff3", key, 10); err == nil {
+		t.Error("NewFPE accepted an unknown mode")
+	}
+}
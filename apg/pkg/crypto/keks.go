@@ -0,0 +1,194 @@
+package crypto
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// KEKCreator is a KMS that can create KEKs on demand. A KEK that already
+// exists is reported with ErrKEKExists, or not at all.
+type KEKCreator interface {
+	CreateKEK(id string) error
+}
+
+// KEKScope decides how finely a KEKRegistry divides KEKs.
+type KEKScope string
+
+const (
+	// KEKScopeUser gives every user one KEK.
+	KEKScopeUser KEKScope = "user"
+	// KEKScopeCircle also gives every circle a user writes in its own KEK,
+	// so that data shared with a circle can be erased separately.
+	KEKScopeCircle KEKScope = "circle"
+)
+
+// ParseKEKScope parses "user" or "circle"; "" is KEKScopeUser.
+func ParseKEKScope(s string) (KEKScope, error) {
+	switch KEKScope(s) {
+	case "", KEKScopeUser:
+		return KEKScopeUser, nil
+	case KEKScopeCircle:
+		return KEKScopeCircle, nil
+	}
+	return "", fmt.Errorf("unknown KEK scope %q: want user or circle", s)
+}
+
+// ParseKEKIDKey checks the secret KEK IDs are derived with, as set in
+// APG_KEK_ID_KEY, and returns it as a key for NewKEKRegistry.
+func ParseKEKIDKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("KEK ID key is not set")
+	}
+	if len(s) < minKEKIDKeySize {
+		return nil, fmt.Errorf("KEK ID key is %d bytes, want at least %d", len(s), minKEKIDKeySize)
+	}
+	return []byte(s), nil
+}
+
+// kekIDHashLen is the number of hex digits of an ID hash in a KEK ID.
+const kekIDHashLen = 32
+
+// minKEKIDKeySize is the shortest ID key ParseKEKIDKey accepts.
+const minKEKIDKeySize = 16
+
+// maxReadyKEKs bounds the KEK IDs a KEKRegistry remembers as created. When it
+// is reached they are forgotten, and each is looked up in the KMS again.
+const maxReadyKEKs = 100000
+
+// KEKRegistry maps users, and optionally their circles, to KEKs of their
+// own, so that destroying a KEK erases everything of that user. KEKs are
+// created lazily through the KMS on first use, so the KMS must be a
+// KEKCreator.
+type KEKRegistry struct {
+	kms   KMS
+	scope KEKScope
+	idKey []byte
+
+	mu sync.Mutex
+	// ready holds the KEK IDs known to exist.
+	ready map[string]bool
+	// creating holds the KEK creations in flight, by KEK ID.
+	creating map[string]*kekCreation
+}
+
+// kekCreation is one call to CreateKEK that requests for the same KEK wait
+// on. err is set before done is closed.
+type kekCreation struct {
+	done chan struct{}
+	err  error
+}
+
+// NewKEKRegistry creates a KEKRegistry for kms. KEK IDs are derived from
+// user and circle IDs with HMAC-SHA256 under idKey, which must stay the same
+// for the lifetime of the data, since a changed key maps every user to a new
+// KEK. A nil idKey derives them with plain SHA-256, which anyone who can
+// guess a user ID can recompute; it is meant for tests.
+func NewKEKRegistry(kms KMS, scope KEKScope, idKey []byte) *KEKRegistry {
+	if scope == "" {
+		scope = KEKScopeUser
+	}
+	return &KEKRegistry{
+		kms:      kms,
+		scope:    scope,
+		idKey:    idKey,
+		ready:    make(map[string]bool),
+		creating: make(map[string]*kekCreation),
+	}
+}
+
+// KEKID returns the KEK ID of userID, and of circleID when the scope is
+// KEKScopeCircle, without creating the KEK. User and circle IDs never appear
+// in KMS key names or logs, and with an ID key they cannot be confirmed from
+// them either. A user's KEK IDs all start with the ID of their user KEK.
+func (r *KEKRegistry) KEKID(userID string, circleID *string) (string, error) {
+	if userID == "" {
+		return "", errors.New("cannot resolve a KEK without a user ID")
+	}
+	id := "user-" + r.hash(userID)
+	if r.scope == KEKScopeCircle && circleID != nil && *circleID != "" {
+		id += "-circle-" + r.hash(*circleID)
+	}
+	return id, nil
+}
+
+// Resolve returns the KEK ID of userID and circleID, creating the KEK under
+// ctx when it is the first request for it since the registry was made. Only
+// requests for the same KEK wait for its creation, and each of them only as
+// long as its own ctx allows.
+func (r *KEKRegistry) Resolve(ctx context.Context, userID string, circleID *string) (string, error) {
+	id, err := r.KEKID(userID, circleID)
+	if err != nil {
+		return "", err
+	}
+	for {
+		r.mu.Lock()
+		if r.ready[id] {
+			r.mu.Unlock()
+			return id, nil
+		}
+		c, inFlight := r.creating[id]
+		if !inFlight {
+			c = &kekCreation{done: make(chan struct{})}
+			r.creating[id] = c
+			r.mu.Unlock()
+			if err := r.create(ctx, id, c); err != nil {
+				return "", err
+			}
+			return id, nil
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-c.done:
+			if c.err == nil {
+				return id, nil
+			}
+			// The creation failed, perhaps only because its request was
+			// cancelled, so this request tries again itself.
+		case <-ctx.Done():
+			return "", fmt.Errorf("failed to provision KEK %s: %w", id, ctx.Err())
+		}
+	}
+}
+
+// create runs the creation c of the KEK id and records its outcome.
+func (r *KEKRegistry) create(ctx context.Context, id string, c *kekCreation) error {
+	creator, ok := BindContext(r.kms, ctx).(KEKCreator)
+	if !ok {
+		c.err = fmt.Errorf("failed to provision KEK %s: %T cannot create KEKs", id, r.kms)
+	} else if err := creator.CreateKEK(id); err != nil && !errors.Is(err, ErrKEKExists) {
+		c.err = fmt.Errorf("failed to provision KEK %s: %w", id, err)
+	}
+
+	r.mu.Lock()
+	delete(r.creating, id)
+	if c.err == nil {
+		if len(r.ready) >= maxReadyKEKs {
+			r.ready = make(map[string]bool)
+		}
+		r.ready[id] = true
+	}
+	r.mu.Unlock()
+	close(c.done)
+	return c.err
+}
+
+// hash returns the ID hash of s, keyed with the registry's ID key if it has
+// one.
+func (r *KEKRegistry) hash(s string) string {
+	var sum []byte
+	if r.idKey != nil {
+		mac := hmac.New(sha256.New, r.idKey)
+		mac.Write([]byte(s))
+		sum = mac.Sum(nil)
+	} else {
+		h := sha256.Sum256([]byte(s))
+		sum = h[:]
+	}
+	return hex.EncodeToString(sum)[:kekIDHashLen]
+}
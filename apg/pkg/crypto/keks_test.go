@@ -0,0 +1,223 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestKEKRegistry_KEKID(t *testing.T) {
+	circle, other := "circle-7", "circle-8"
+	users := NewKEKRegistry(NewMockKMS(), KEKScopeUser, nil)
+	circles := NewKEKRegistry(NewMockKMS(), KEKScopeCircle, nil)
+
+	alice, _ := users.KEKID("alice@example.com", nil)
+	bob, _ := users.KEKID("bob", nil)
+	if alice == bob || strings.Contains(alice, "alice") {
+		t.Errorf("KEK IDs %q and %q should be distinct hashes", alice, bob)
+	}
+	if got, _ := users.KEKID("alice@example.com", &circle); got != alice {
+		t.Errorf("user scope: circle KEK ID = %q, want %q", got, alice)
+	}
+
+	inCircle, _ := circles.KEKID("alice@example.com", &circle)
+	inOther, _ := circles.KEKID("alice@example.com", &other)
+	if inCircle == inOther || !strings.HasPrefix(inCircle, alice+"-circle-") {
+		t.Errorf("circle scope: KEK IDs %q and %q", inCircle, inOther)
+	}
+	if got, _ := circles.KEKID("alice@example.com", nil); got != alice {
+		t.Errorf("circle scope without a circle: KEK ID = %q, want %q", got, alice)
+	}
+	for _, id := range []string{alice, inCircle} {
+		if err := ValidateKEKID(id); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := users.KEKID("", nil); err == nil {
+		t.Error("expected an error without a user ID")
+	}
+}
+
+func TestKEKRegistry_IDKey(t *testing.T) {
+	circle := "circle-7"
+	unkeyed, _ := NewKEKRegistry(nil, KEKScopeCircle, nil).KEKID("alice@example.com", &circle)
+	keyed, _ := NewKEKRegistry(nil, KEKScopeCircle, []byte("deployment-secret-1")).KEKID("alice@example.com", &circle)
+	other, _ := NewKEKRegistry(nil, KEKScopeCircle, []byte("deployment-secret-2")).KEKID("alice@example.com", &circle)
+	if keyed == unkeyed || keyed == other {
+		t.Errorf("KEK IDs %q, %q and %q should differ by ID key", unkeyed, keyed, other)
+	}
+	if err := ValidateKEKID(keyed); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ParseKEKIDKey(""); err == nil {
+		t.Error("expected an empty ID key to be refused")
+	}
+	if _, err := ParseKEKIDKey("short"); err == nil {
+		t.Error("expected a short ID key to be refused")
+	}
+}
+
+func TestKEKRegistry_ResolveCreatesKEKs(t *testing.T) {
+	rootKey := bytes.Repeat([]byte{0x42}, RootKeySize)
+	local, err := InitLocalKMS(filepath.Join(t.TempDir(), "keystore.json"), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := newFakeVault("s.root")
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	vault, err := NewVaultKMS(VaultConfig{Address: server.URL, Token: "s.root", KeyPrefix: "apg-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aws, _ := newTestAWSKMS(t)
+
+	for name, kms := range map[string]KMS{"mock": NewMockKMS(), "local": local, "vault": vault, "aws": aws} {
+		t.Run(name, func(t *testing.T) {
+			registry := NewKEKRegistry(kms, KEKScopeUser, nil)
+			kekID, err := registry.Resolve(context.Background(), "user_abc", nil)
+			if err != nil {
+				t.Fatalf("Resolve failed: %v", err)
+			}
+			testEncryptDecrypt(t, kms, kekID)
+
+			// A second registry, as after a restart, finds the KEK in place.
+			again, err := NewKEKRegistry(kms, KEKScopeUser, nil).Resolve(context.Background(), "user_abc", nil)
+			if err != nil || again != kekID {
+				t.Fatalf("Resolve after restart = %q, %v", again, err)
+			}
+			other, err := registry.Resolve(context.Background(), "user_xyz", nil)
+			if err != nil {
+				t.Fatalf("Resolve failed: %v", err)
+			}
+			ciphertext, wrappedDEK, nonce, err := Encrypt([]byte("zone B"), nil, kms, kekID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := Decrypt(ciphertext, wrappedDEK, nonce, nil, kms, other); err == nil && string(got) == "zone B" {
+				t.Error("another user's KEK decrypted the data")
+			}
+		})
+	}
+	if fake.versions["apg-"+mustKEKID(t, "user_abc")] != 1 {
+		t.Errorf("vault keys = %v", fake.versions)
+	}
+}
+
+func TestKEKRegistry_RequiresKEKCreator(t *testing.T) {
+	registry := NewKEKRegistry(NewMockKEKProtector("secret"), KEKScopeUser, nil)
+	if _, err := registry.Resolve(context.Background(), "user_abc", nil); err == nil {
+		t.Error("expected a KMS that cannot create KEKs to be refused")
+	}
+}
+
+// slowKMS blocks the creation of one KEK until release is closed, or the
+// context it is bound to is done.
+type slowKMS struct {
+	*MockKMS
+	slow    string
+	started chan struct{}
+	release chan struct{}
+	ctx     context.Context
+	creates *int32
+}
+
+func (s *slowKMS) WithContext(ctx context.Context) KMS {
+	bound := *s
+	bound.ctx = ctx
+	return &bound
+}
+
+func (s *slowKMS) CreateKEK(id string) error {
+	atomic.AddInt32(s.creates, 1)
+	if id == s.slow {
+		s.started <- struct{}{}
+		select {
+		case <-s.release:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+	}
+	return s.MockKMS.CreateKEK(id)
+}
+
+func TestKEKRegistry_SlowCreation(t *testing.T) {
+	var creates int32
+	kms := &slowKMS{MockKMS: NewMockKMS(), started: make(chan struct{}, 1), release: make(chan struct{}), ctx: context.Background(), creates: &creates}
+	registry := NewKEKRegistry(kms, KEKScopeUser, nil)
+	kms.slow = mustKEKID(t, "user_slow")
+
+	// The first request for a KEK is cancelled while the KMS is slow.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := registry.Resolve(ctx, "user_slow", nil)
+		first <- err
+	}()
+	<-kms.started
+
+	// Other users are not held up.
+	if _, err := registry.Resolve(context.Background(), "user_fast", nil); err != nil {
+		t.Fatalf("Resolve of another user failed: %v", err)
+	}
+
+	// A second request for the same KEK waits on the first creation, and
+	// takes over when it is cancelled.
+	second := make(chan error, 1)
+	go func() {
+		_, err := registry.Resolve(context.Background(), "user_slow", nil)
+		second <- err
+	}()
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled Resolve: err = %v", err)
+	}
+	<-kms.started
+	close(kms.release)
+	if err := <-second; err != nil {
+		t.Errorf("second Resolve failed: %v", err)
+	}
+	if _, err := registry.Resolve(context.Background(), "user_slow", nil); err != nil || atomic.LoadInt32(&creates) != 3 {
+		t.Errorf("err = %v after %d creations, want 3", err, creates)
+	}
+}
+
+func TestKEKRegistry_ErasedUser(t *testing.T) {
+	rootKey := bytes.Repeat([]byte{0x42}, RootKeySize)
+	kms, err := InitLocalKMS(filepath.Join(t.TempDir(), "keystore.json"), rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kekID, err := NewKEKRegistry(kms, KEKScopeUser, nil).Resolve(context.Background(), "user_abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kms.DisableKEK(kekID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Erasure is not undone by the user's next request.
+	again, err := NewKEKRegistry(kms, KEKScopeUser, nil).Resolve(context.Background(), "user_abc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := Encrypt([]byte("zone B"), nil, kms, again); !errors.Is(err, ErrKEKDisabled) {
+		t.Errorf("err = %v, want ErrKEKDisabled", err)
+	}
+}
+
+func mustKEKID(t *testing.T, userID string) string {
+	t.Helper()
+	id, err := NewKEKRegistry(nil, KEKScopeUser, nil).KEKID(userID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
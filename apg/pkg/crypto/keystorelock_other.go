@@ -0,0 +1,12 @@
+//go:build !unix
+
+package crypto
+
+import "errors"
+
+// lockKeystore would lock the keystore at path. Without a lock, a process
+// could save a stale KEK table over another's changes, so the local KMS is
+// not available on this platform.
+func lockKeystore(path string) (func(), error) {
+	return nil, errors.New("the local KMS keystore cannot be locked on this platform")
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package crypto
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockKeystore takes an exclusive lock on the keystore at path, blocking
+// until other processes release it, and returns the function that releases
+// it. The lock is held on a file beside the keystore, since saving replaces
+// the keystore file itself.
+func lockKeystore(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock keystore: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock keystore: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
@@ -0,0 +1,103 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// kwpICV is the alternative initial value of RFC 5649, which it prefixes to
+// the 32-bit length of the wrapped key.
+var kwpICV = [4]byte{0xa6, 0x59, 0x59, 0xa6}
+
+// ErrKeyUnwrap is returned when a wrapped key fails its integrity check: it
+// was altered, or wrapped under another KEK.
+var ErrKeyUnwrap = errors.New("key unwrap failed integrity check")
+
+// WrapKeyWithPadding wraps key under kek, an AES key of 16, 24 or 32 bytes,
+// with AES Key Wrap with Padding (RFC 5649, NIST SP 800-38F KWP). The result
+// is between 8 and 15 bytes longer than key and authenticates it.
+func WrapKeyWithPadding(kek, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	if len(key) == 0 || uint64(len(key)) > math.MaxUint32 {
+		return nil, fmt.Errorf("cannot wrap a key of %d bytes", len(key))
+	}
+	n := (len(key) + 7) / 8
+	out := make([]byte, 8+8*n)
+	copy(out, kwpICV[:])
+	binary.BigEndian.PutUint32(out[4:8], uint32(len(key)))
+	copy(out[8:], key)
+
+	if n == 1 {
+		// A single padded block is encrypted directly.
+		block.Encrypt(out, out)
+		return out, nil
+	}
+	b := make([]byte, aes.BlockSize)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(b, out[:8])
+			copy(b[8:], out[8*i:8*i+8])
+			block.Encrypt(b, b)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(b[:8])^t)
+			copy(out[8*i:8*i+8], b[8:])
+		}
+	}
+	return out, nil
+}
+
+// UnwrapKeyWithPadding reverses WrapKeyWithPadding. It returns ErrKeyUnwrap
+// when the integrity check fails.
+func UnwrapKeyWithPadding(kek, wrapped []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, fmt.Errorf("invalid wrapped key: %d bytes", len(wrapped))
+	}
+	n := len(wrapped)/8 - 1
+	out := make([]byte, len(wrapped))
+	copy(out, wrapped)
+
+	if n == 1 {
+		block.Decrypt(out, out)
+	} else {
+		b := make([]byte, aes.BlockSize)
+		for j := 5; j >= 0; j-- {
+			for i := n; i >= 1; i-- {
+				t := uint64(n*j + i)
+				binary.BigEndian.PutUint64(b[:8], binary.BigEndian.Uint64(out[:8])^t)
+				copy(b[8:], out[8*i:8*i+8])
+				block.Decrypt(b, b)
+				copy(out[:8], b[:8])
+				copy(out[8*i:8*i+8], b[8:])
+			}
+		}
+	}
+
+	// Check the initial value, the length and the zero padding together, so
+	// that a failure does not reveal which of them was wrong.
+	m := int(binary.BigEndian.Uint32(out[4:8]))
+	ok := subtle.ConstantTimeCompare(out[:4], kwpICV[:])
+	if m <= 8*(n-1) || m > 8*n {
+		ok = 0
+		m = 8 * n
+	}
+	var padding byte
+	for _, c := range out[8+m:] {
+		padding |= c
+	}
+	ok &= subtle.ConstantTimeByteEq(padding, 0)
+	if ok != 1 {
+		return nil, ErrKeyUnwrap
+	}
+	return out[8 : 8+m], nil
+}
@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// TestWrapKeyWithPadding_RFC5649 checks the examples of RFC 5649, section 6.
+func TestWrapKeyWithPadding_RFC5649(t *testing.T) {
+	kek := "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8"
+	tests := []struct {
+		name    string
+		key     string
+		wrapped string
+	}{
+		{"20 octets", "c37b7e6492584340bed12207808941155068f738", "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a"},
+		{"7 octets", "466f7250617369", "afbeb0f07dfbf5419200f2ccb50bb24f"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := WrapKeyWithPadding(mustHex(t, kek), mustHex(t, tt.key))
+			if err != nil || !bytes.Equal(got, mustHex(t, tt.wrapped)) {
+				t.Fatalf("WrapKeyWithPadding = %x, %v; want %s", got, err, tt.wrapped)
+			}
+			back, err := UnwrapKeyWithPadding(mustHex(t, kek), got)
+			if err != nil || !bytes.Equal(back, mustHex(t, tt.key)) {
+				t.Fatalf("UnwrapKeyWithPadding = %x, %v; want %s", back, err, tt.key)
+			}
+		})
+	}
+}
+
+func TestUnwrapKeyWithPadding_Rejects(t *testing.T) {
+	kek := bytes.Repeat([]byte{7}, 32)
+	wrapped, err := WrapKeyWithPadding(kek, bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := UnwrapKeyWithPadding(kek, tampered); !errors.Is(err, ErrKeyUnwrap) {
+		t.Errorf("tampered key: err = %v, want ErrKeyUnwrap", err)
+	}
+	if _, err := UnwrapKeyWithPadding(bytes.Repeat([]byte{8}, 32), wrapped); !errors.Is(err, ErrKeyUnwrap) {
+		t.Errorf("wrong KEK: err = %v, want ErrKeyUnwrap", err)
+	}
+	if _, err := UnwrapKeyWithPadding(kek, wrapped[:12]); err == nil {
+		t.Error("expected an error for a truncated key")
+	}
+}
@@ -1,8 +1,13 @@
 package crypto
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/subtle"
 	"fmt"
+	"io"
+	"sync"
+	"time"
 )
 
 // KMS is an interface for a Key Management Service.
@@ -15,6 +20,70 @@ type KMS interface {
 	Unwrap(wrappedDEK []byte, kekID string) ([]byte, error)
 }
 
+// ContextKMS is a KMS that can bind a wrapped DEK to associated data, so that
+// the DEK only unwraps together with the same data. Encrypt and Decrypt use
+// it, with their AD, when the KMS provides it.
+type ContextKMS interface {
+	KMS
+	WrapWithAD(dek []byte, kekID string, ad []byte) ([]byte, error)
+	UnwrapWithAD(wrappedDEK []byte, kekID string, ad []byte) ([]byte, error)
+}
+
+// DataKeyKMS is a KMS that generates DEKs itself, returning each in plaintext
+// and wrapped under the KEK identified by kekID. Encrypt uses it when the KMS
+// provides it.
+type DataKeyKMS interface {
+	KMS
+	GenerateDataKey(kekID string, size int, ad []byte) (dek, wrappedDEK []byte, err error)
+}
+
+// ContextBinder is a KMS whose calls can be bound to a context. Remote KMSes
+// implement it, so that the calls made for a cancelled request, and their
+// retries, stop early.
+type ContextBinder interface {
+	KMS
+	// WithContext returns a KMS that makes its calls under ctx and shares
+	// everything else with the original.
+	WithContext(ctx context.Context) KMS
+}
+
+// BindContext binds kms to ctx when it is a ContextBinder, and otherwise
+// returns it unchanged.
+func BindContext(kms KMS, ctx context.Context) KMS {
+	if b, ok := kms.(ContextBinder); ok {
+		return b.WithContext(ctx)
+	}
+	return kms
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// wrapDEK wraps dek, bound to ad when the KMS supports it.
+func wrapDEK(kms KMS, dek []byte, kekID string, ad []byte) ([]byte, error) {
+	if c, ok := kms.(ContextKMS); ok {
+		return c.WrapWithAD(dek, kekID, ad)
+	}
+	return kms.Wrap(dek, kekID)
+}
+
+// unwrapDEK reverses wrapDEK.
+func unwrapDEK(kms KMS, wrappedDEK []byte, kekID string, ad []byte) ([]byte, error) {
+	if c, ok := kms.(ContextKMS); ok {
+		return c.UnwrapWithAD(wrappedDEK, kekID, ad)
+	}
+	return kms.Unwrap(wrappedDEK, kekID)
+}
+
 // MockKMS is a dummy implementation of the KMS interface for local testing.
 // In a real environment, this would be replaced with a client for AWS KMS,
 // Google Cloud KMS, etc.
@@ -22,6 +91,7 @@ type KMS interface {
 // WARNING: This implementation is NOT secure and is for testing purposes only.
 // It "encrypts" by XORing the key with a fixed byte slice.
 type MockKMS struct {
+	mu sync.RWMutex
 	// A map to simulate different KEKs. The key is the kekID.
 	masterKeys map[string][]byte
 }
@@ -37,6 +107,8 @@ func NewMockKMS() *MockKMS {
 
 // Wrap "encrypts" the DEK by XORing it with the master key.
 func (m *MockKMS) Wrap(dek []byte, kekID string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	masterKey, ok := m.masterKeys[kekID]
 	if !ok {
 		return nil, fmt.Errorf("master key not found for kekID: %s", kekID)
@@ -46,6 +118,8 @@ func (m *MockKMS) Wrap(dek []byte, kekID string) ([]byte, error) {
 
 // Unwrap "decrypts" the wrapped DEK by XORing it again with the master key.
 func (m *MockKMS) Unwrap(wrappedDEK []byte, kekID string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	masterKey, ok := m.masterKeys[kekID]
 	if !ok {
 		return nil, fmt.Errorf("master key not found for kekID: %s", kekID)
@@ -53,6 +127,21 @@ func (m *MockKMS) Unwrap(wrappedDEK []byte, kekID string) ([]byte, error) {
 	return m.xor(wrappedDEK, masterKey), nil
 }
 
+// CreateKEK adds a random master key for kekID.
+func (m *MockKMS) CreateKEK(kekID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.masterKeys[kekID]; ok {
+		return fmt.Errorf("%w: %s", ErrKEKExists, kekID)
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	m.masterKeys[kekID] = key
+	return nil
+}
+
 // xor performs a simple XOR operation. It is NOT a secure encryption method.
 // It repeats the key if it's shorter than the data.
 func (m *MockKMS) xor(data, key []byte) []byte {
@@ -0,0 +1,489 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RootKeySize is the length of a keystore root key, in bytes.
+const RootKeySize = 32
+
+// localKEKSize is the length of the AES-256 KEKs a LocalKMS creates.
+const localKEKSize = 32
+
+// keystoreVersion is the format of the keystore file.
+const keystoreVersion = 1
+
+var (
+	// ErrKEKNotFound is returned for a KEK ID the KMS does not hold.
+	ErrKEKNotFound = errors.New("KEK not found")
+	// ErrKEKDisabled is returned when a disabled KEK is asked to wrap or unwrap.
+	ErrKEKDisabled = errors.New("KEK is disabled")
+	// ErrKEKExists is returned when creating a KEK under an ID already in use.
+	ErrKEKExists = errors.New("KEK already exists")
+)
+
+// kekIDPattern restricts KEK IDs to characters that are safe in logs, file
+// names and the key paths of remote KMSes.
+var kekIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/-]{0,127}$`)
+
+// ValidateKEKID checks that id is usable as a KEK ID.
+func ValidateKEKID(id string) error {
+	if !kekIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid KEK ID %q: want up to 128 letters, digits or . _ : / -, starting with a letter or digit", id)
+	}
+	return nil
+}
+
+// KEKInfo describes a KEK without its key material.
+type KEKInfo struct {
+	ID       string     `json:"id"`
+	Created  time.Time  `json:"created"`
+	Disabled *time.Time `json:"disabled,omitempty"`
+}
+
+// localKEK is a KEK as stored in the keystore.
+type localKEK struct {
+	KEKInfo
+	Key []byte `json:"key"`
+}
+
+// keystoreFile is the on-disk form of the keystore. Keys holds the KEK table,
+// sealed with AES-256-GCM under a key derived from the root key and Salt; the
+// header fields are authenticated as associated data.
+type keystoreFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Keys    []byte `json:"keys"`
+}
+
+// LocalKMS is a KMS backed by an encrypted keystore file, for self-hosted
+// deployments without a cloud KMS. DEKs are wrapped under AES-256 KEKs with
+// AES Key Wrap with Padding (RFC 5649). The KEKs themselves never leave the
+// keystore unencrypted: the whole table is sealed under a key derived from a
+// root key, which the operator supplies when the store is opened.
+//
+// Several processes may share a keystore, such as the gateway and apg-kms.
+// Every change is made under an exclusive lock to the table as it is on
+// disk, and a table that another process has changed is reloaded before it
+// is used, so a KEK disabled by one process is never re-enabled by another.
+type LocalKMS struct {
+	mu   sync.RWMutex
+	path string
+	salt []byte
+	aead cipher.AEAD
+	keks map[string]*localKEK
+	// loaded describes the keystore file keks was read from or saved to.
+	loaded os.FileInfo
+}
+
+// InitLocalKMS creates an empty keystore at path, sealed with rootKey. It
+// fails if the file already exists.
+func InitLocalKMS(path string, rootKey []byte) (*LocalKMS, error) {
+	if len(rootKey) != RootKeySize {
+		return nil, fmt.Errorf("keystore root key must be %d bytes, got %d", RootKeySize, len(rootKey))
+	}
+	unlock, err := lockKeystore(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("keystore %s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	salt := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("failed to generate keystore salt: %w", err)
+	}
+	k := &LocalKMS{path: path, salt: salt, keks: make(map[string]*localKEK)}
+	if k.aead, err = keystoreAEAD(rootKey, salt); err != nil {
+		return nil, err
+	}
+	if k.loaded, err = k.save(k.keks); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// OpenLocalKMS unlocks the existing keystore at path with rootKey. A missing
+// file is an error wrapping os.ErrNotExist, so that a mistyped path or an
+// unmounted volume is not taken for an empty keystore; InitLocalKMS creates
+// one. A wrong root key or an altered file is an error.
+func OpenLocalKMS(path string, rootKey []byte) (*LocalKMS, error) {
+	if len(rootKey) != RootKeySize {
+		return nil, fmt.Errorf("keystore root key must be %d bytes, got %d", RootKeySize, len(rootKey))
+	}
+	// Checked before locking, so that no lock file is left next to a
+	// mistyped path.
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("keystore %s does not exist: %w", path, err)
+	}
+	unlock, err := lockKeystore(path)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	defer f.Close()
+	info, file, err := readKeystoreFile(f)
+	if err != nil {
+		return nil, err
+	}
+	k := &LocalKMS{path: path, salt: file.Salt, loaded: info}
+	if k.aead, err = keystoreAEAD(rootKey, file.Salt); err != nil {
+		return nil, err
+	}
+	if k.keks, err = k.openTable(file); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// readKeystoreFile reads and parses the keystore file f.
+func readKeystoreFile(f *os.File) (os.FileInfo, *keystoreFile, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	var file keystoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, fmt.Errorf("invalid keystore %s: %w", f.Name(), err)
+	}
+	if file.Version != keystoreVersion {
+		return nil, nil, fmt.Errorf("unsupported keystore version %d", file.Version)
+	}
+	return info, &file, nil
+}
+
+// openTable unseals the KEK table of file.
+func (k *LocalKMS) openTable(file *keystoreFile) (map[string]*localKEK, error) {
+	if !bytes.Equal(file.Salt, k.salt) {
+		return nil, fmt.Errorf("keystore %s was replaced by another keystore", k.path)
+	}
+	if len(file.Nonce) != k.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid keystore %s: bad nonce", k.path)
+	}
+	table, err := k.aead.Open(nil, file.Nonce, file.Keys, keystoreAD(file.Version, file.Salt))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unlock keystore: wrong root key or altered file")
+	}
+	var list []*localKEK
+	if err := json.Unmarshal(table, &list); err != nil {
+		return nil, fmt.Errorf("invalid keystore contents: %w", err)
+	}
+	keks := make(map[string]*localKEK, len(list))
+	for _, kek := range list {
+		keks[kek.ID] = kek
+	}
+	return keks, nil
+}
+
+// keystoreAEAD derives the key that seals the KEK table.
+func keystoreAEAD(rootKey, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, rootKey, salt, "apg-keystore", 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keystore key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func keystoreAD(version int, salt []byte) []byte {
+	return append([]byte(fmt.Sprintf("apg-keystore:v%d:", version)), salt...)
+}
+
+// read loads the KEK table from disk. The caller holds the keystore lock.
+func (k *LocalKMS) read() (map[string]*localKEK, os.FileInfo, error) {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read keystore: %w", err)
+	}
+	defer f.Close()
+	info, file, err := readKeystoreFile(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	keks, err := k.openTable(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keks, info, nil
+}
+
+// errUnchanged tells update that a change left the KEK table as it was.
+var errUnchanged = errors.New("keystore unchanged")
+
+// update applies change to the KEK table as it is on disk, saves the result
+// and makes it the table in use. Nothing is saved when change fails or
+// returns errUnchanged.
+func (k *LocalKMS) update(change func(keks map[string]*localKEK) error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	unlock, err := lockKeystore(k.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	keks, loaded, err := k.read()
+	if err != nil {
+		return err
+	}
+	if err := change(keks); errors.Is(err, errUnchanged) {
+		k.keks, k.loaded = keks, loaded
+		return nil
+	} else if err != nil {
+		return err
+	}
+	info, err := k.save(keks)
+	if err != nil {
+		return err
+	}
+	k.keks, k.loaded = keks, info
+	return nil
+}
+
+// refresh reloads the KEK table if another process has saved the keystore
+// since it was last read.
+func (k *LocalKMS) refresh() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("failed to read keystore: %w", err)
+	}
+	k.mu.RLock()
+	current := sameKeystoreFile(k.loaded, info)
+	k.mu.RUnlock()
+	if current {
+		return nil
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	unlock, err := lockKeystore(k.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	keks, info, err := k.read()
+	if err != nil {
+		return err
+	}
+	k.keks, k.loaded = keks, info
+	return nil
+}
+
+// sameKeystoreFile reports whether a and b describe the same save of the
+// keystore. Every save replaces the file, so a changed file is a new one.
+func sameKeystoreFile(a, b os.FileInfo) bool {
+	return a != nil && os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// save seals keks and replaces the keystore file atomically, returning the
+// new file's description. The caller holds the keystore lock.
+func (k *LocalKMS) save(keks map[string]*localKEK) (os.FileInfo, error) {
+	list := make([]*localKEK, 0, len(keks))
+	for _, kek := range keks {
+		list = append(list, kek)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	table, err := json.Marshal(list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal keystore: %w", err)
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate keystore nonce: %w", err)
+	}
+	data, err := json.MarshalIndent(keystoreFile{
+		Version: keystoreVersion,
+		Salt:    k.salt,
+		Nonce:   nonce,
+		Keys:    k.aead.Seal(nil, nonce, table, keystoreAD(keystoreVersion, k.salt)),
+	}, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal keystore: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), filepath.Base(k.path)+".tmp*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write keystore: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write keystore: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write keystore: %w", err)
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("failed to write keystore: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write keystore: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), k.path); err != nil {
+		return nil, fmt.Errorf("failed to write keystore: %w", err)
+	}
+	return info, nil
+}
+
+// CreateKEK generates a new AES-256 KEK under id and saves the keystore.
+func (k *LocalKMS) CreateKEK(id string) error {
+	if err := ValidateKEKID(id); err != nil {
+		return err
+	}
+	key := make([]byte, localKEKSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return fmt.Errorf("failed to generate KEK: %w", err)
+	}
+	return k.update(func(keks map[string]*localKEK) error {
+		if _, ok := keks[id]; ok {
+			return fmt.Errorf("%w: %s", ErrKEKExists, id)
+		}
+		keks[id] = &localKEK{KEKInfo: KEKInfo{ID: id, Created: time.Now().UTC()}, Key: key}
+		return nil
+	})
+}
+
+// ListKEKs describes every KEK in the keystore, ordered by ID.
+func (k *LocalKMS) ListKEKs() []KEKInfo {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	infos := make([]KEKInfo, 0, len(k.keks))
+	for _, kek := range k.keks {
+		infos = append(infos, kek.KEKInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// DisableKEK stops the KEK under id from wrapping or unwrapping, and saves the
+// keystore. Its key material is kept, so that data wrapped under it is not
+// lost for good. Disabling a disabled KEK does nothing.
+func (k *LocalKMS) DisableKEK(id string) error {
+	return k.update(func(keks map[string]*localKEK) error {
+		kek, ok := keks[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrKEKNotFound, id)
+		}
+		if kek.Disabled != nil {
+			return errUnchanged
+		}
+		now := time.Now().UTC()
+		kek.Disabled = &now
+		return nil
+	})
+}
+
+// key returns the material of an enabled KEK.
+func (k *LocalKMS) key(id string) ([]byte, error) {
+	if err := k.refresh(); err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	kek, ok := k.keks[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrKEKNotFound, id)
+	}
+	if kek.Disabled != nil {
+		return nil, fmt.Errorf("%w: %s", ErrKEKDisabled, id)
+	}
+	return kek.Key, nil
+}
+
+// Wrap wraps dek under the KEK identified by kekID.
+func (k *LocalKMS) Wrap(dek []byte, kekID string) ([]byte, error) {
+	key, err := k.key(kekID)
+	if err != nil {
+		return nil, err
+	}
+	return WrapKeyWithPadding(key, dek)
+}
+
+// Unwrap unwraps a DEK wrapped under the KEK identified by kekID.
+func (k *LocalKMS) Unwrap(wrappedDEK []byte, kekID string) ([]byte, error) {
+	key, err := k.key(kekID)
+	if err != nil {
+		return nil, err
+	}
+	return UnwrapKeyWithPadding(key, wrappedDEK)
+}
+
+// GenerateRootKey returns a new random root key, base64-encoded.
+func GenerateRootKey() (string, error) {
+	key := make([]byte, RootKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", fmt.Errorf("failed to generate root key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ParseRootKey decodes a base64 root key, ignoring surrounding whitespace.
+func ParseRootKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid root key: not base64")
+	}
+	if len(key) != RootKeySize {
+		return nil, fmt.Errorf("invalid root key: want %d bytes, got %d", RootKeySize, len(key))
+	}
+	return key, nil
+}
+
+// LoadRootKey reads the root key from value when it is set, and otherwise
+// from the file named by file, where "-" means stdin.
+func LoadRootKey(value, file string, stdin io.Reader) ([]byte, error) {
+	switch {
+	case value != "":
+		return ParseRootKey(value)
+	case file == "-":
+		data, err := io.ReadAll(io.LimitReader(stdin, 1024))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root key from stdin: %w", err)
+		}
+		return ParseRootKey(string(data))
+	case file != "":
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read root key: %w", err)
+		}
+		return ParseRootKey(string(data))
+	default:
+		return nil, fmt.Errorf("no root key given")
+	}
+}
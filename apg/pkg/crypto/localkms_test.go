@@ -0,0 +1,203 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalKMS(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	rootKey := bytes.Repeat([]byte{0x42}, RootKeySize)
+
+	kms, err := InitLocalKMS(path, rootKey)
+	if err != nil {
+		t.Fatalf("InitLocalKMS failed: %v", err)
+	}
+	if err := kms.CreateKEK("default-user-kek"); err != nil {
+		t.Fatalf("CreateKEK failed: %v", err)
+	}
+	if err := kms.CreateKEK("default-user-kek"); !errors.Is(err, ErrKEKExists) {
+		t.Errorf("duplicate CreateKEK: err = %v, want ErrKEKExists", err)
+	}
+	if err := kms.CreateKEK("bad id"); err == nil {
+		t.Error("expected an invalid KEK ID to be rejected")
+	}
+
+	plaintext := []byte("zone B")
+	ciphertext, wrappedDEK, nonce, err := Encrypt(plaintext, nil, kms, "default-user-kek")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if _, err := kms.Wrap(make([]byte, 16), "missing"); !errors.Is(err, ErrKEKNotFound) {
+		t.Errorf("unknown KEK: err = %v, want ErrKEKNotFound", err)
+	}
+
+	// The key material is sealed on disk.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "default-user-kek") {
+		t.Error("the keystore file exposes its KEK table")
+	}
+
+	// A reopened keystore unwraps what the first one wrapped.
+	reopened, err := OpenLocalKMS(path, rootKey)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if got, err := Decrypt(ciphertext, wrappedDEK, nonce, nil, reopened, "default-user-kek"); err != nil || !bytes.Equal(got, plaintext) {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+
+	if err := reopened.DisableKEK("default-user-kek"); err != nil {
+		t.Fatalf("DisableKEK failed: %v", err)
+	}
+	infos := reopened.ListKEKs()
+	if len(infos) != 1 || infos[0].ID != "default-user-kek" || infos[0].Disabled == nil {
+		t.Fatalf("ListKEKs = %+v", infos)
+	}
+	if _, err := reopened.Unwrap(wrappedDEK, "default-user-kek"); !errors.Is(err, ErrKEKDisabled) {
+		t.Errorf("disabled KEK: err = %v, want ErrKEKDisabled", err)
+	}
+	if err := reopened.DisableKEK("missing"); !errors.Is(err, ErrKEKNotFound) {
+		t.Errorf("DisableKEK(missing): err = %v, want ErrKEKNotFound", err)
+	}
+}
+
+// TestLocalKMS_SharedKeystore checks that two processes sharing a keystore,
+// such as the gateway and apg-kms, never undo each other's changes.
+func TestLocalKMS_SharedKeystore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	rootKey := bytes.Repeat([]byte{0x42}, RootKeySize)
+	server, err := InitLocalKMS(path, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CreateKEK("user-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	operator, err := OpenLocalKMS(path, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := operator.DisableKEK("user-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server's next save keeps the operator's change, and the server
+	// stops using the disabled KEK.
+	if err := server.CreateKEK("user-b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Wrap(make([]byte, 16), "user-a"); !errors.Is(err, ErrKEKDisabled) {
+		t.Errorf("Wrap with a KEK disabled elsewhere: err = %v, want ErrKEKDisabled", err)
+	}
+	reopened, err := OpenLocalKMS(path, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := reopened.ListKEKs()
+	if len(infos) != 2 || infos[0].Disabled == nil || infos[1].ID != "user-b" {
+		t.Fatalf("ListKEKs = %+v", infos)
+	}
+	if err := operator.CreateKEK("user-b"); !errors.Is(err, ErrKEKExists) {
+		t.Errorf("CreateKEK of a KEK made elsewhere: err = %v, want ErrKEKExists", err)
+	}
+}
+
+func TestOpenLocalKMS_RejectsWrongKeyAndTampering(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	rootKey := bytes.Repeat([]byte{0x42}, RootKeySize)
+	kms, err := InitLocalKMS(path, rootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kms.CreateKEK("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenLocalKMS(path, bytes.Repeat([]byte{0x43}, RootKeySize)); err == nil {
+		t.Error("expected a wrong root key to be rejected")
+	}
+	if _, err := OpenLocalKMS(path, rootKey[:16]); err == nil {
+		t.Error("expected a short root key to be rejected")
+	}
+
+	// Swapping the salt breaks the authentication of the header.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file keystoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatal(err)
+	}
+	file.Salt[0] ^= 1
+	data, _ = json.Marshal(file)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenLocalKMS(path, rootKey); err == nil {
+		t.Error("expected an altered keystore to be rejected")
+	}
+}
+
+func TestOpenLocalKMS_Missing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	rootKey := bytes.Repeat([]byte{0x42}, RootKeySize)
+	if _, err := OpenLocalKMS(path, rootKey); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("err = %v, want os.ErrNotExist", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenLocalKMS created the keystore: %v", err)
+	}
+	if _, err := InitLocalKMS(path, rootKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := InitLocalKMS(path, rootKey); err == nil {
+		t.Error("expected InitLocalKMS to refuse an existing keystore")
+	}
+	if _, err := OpenLocalKMS(path, rootKey); err != nil {
+		t.Errorf("OpenLocalKMS after InitLocalKMS failed: %v", err)
+	}
+}
+
+func TestLoadRootKey(t *testing.T) {
+	encoded, err := GenerateRootKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "root.key")
+	if err := os.WriteFile(file, []byte(encoded+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fromValue, err := LoadRootKey(encoded, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFile, err := LoadRootKey("", file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromStdin, err := LoadRootKey("", "-", strings.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fromValue, fromFile) || !bytes.Equal(fromValue, fromStdin) {
+		t.Error("the root key sources disagree")
+	}
+	if _, err := LoadRootKey("", "", nil); err == nil {
+		t.Error("expected an error without a root key")
+	}
+	if _, err := LoadRootKey("c2hvcnQ=", "", nil); err == nil {
+		t.Error("expected an error for a short root key")
+	}
+}
@@ -0,0 +1,251 @@
+//go:build pkcs11
+
+package crypto
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Config configures a PKCS11KMS.
+type PKCS11Config struct {
+	// ModulePath is the token's PKCS#11 library, e.g.
+	// "/usr/lib/softhsm/libsofthsm2.so".
+	ModulePath string
+	// TokenLabel selects the slot holding the token with that label. When it
+	// is empty, Slot is used.
+	TokenLabel string
+	Slot       uint
+	// PIN logs in as the normal user.
+	PIN string
+	// KeyLabelPrefix is put in front of a KEK ID to form the label of its key.
+	KeyLabelPrefix string
+	// Mechanism wraps DEKs: CKM_AES_KEY_WRAP_PAD (RFC 5649), the default, or
+	// CKM_AES_KEY_WRAP (RFC 3394) for tokens without it, which only wraps keys
+	// whose length is a multiple of 8 bytes.
+	Mechanism uint
+}
+
+// PKCS11KMS wraps DEKs inside a PKCS#11 token, such as an HSM or SoftHSM.
+// KEKs are AES-256 keys generated on the token as sensitive and
+// non-extractable, so they never leave it. A DEK is imported as a session
+// object only for as long as wrapping or unwrapping it takes.
+type PKCS11KMS struct {
+	cfg PKCS11Config
+	ctx *pkcs11.Ctx
+
+	// mu serialises use of the session, which PKCS#11 does not allow from
+	// several threads at once.
+	mu      sync.Mutex
+	session pkcs11.SessionHandle
+	keys    map[string]pkcs11.ObjectHandle
+}
+
+// NewPKCS11KMS loads the module, opens a session on the configured token and
+// logs in. Close releases them.
+func NewPKCS11KMS(cfg PKCS11Config) (*PKCS11KMS, error) {
+	if cfg.ModulePath == "" {
+		return nil, errors.New("PKCS#11 module path is not set")
+	}
+	if cfg.Mechanism == 0 {
+		cfg.Mechanism = pkcs11.CKM_AES_KEY_WRAP_PAD
+	}
+	if cfg.Mechanism != pkcs11.CKM_AES_KEY_WRAP_PAD && cfg.Mechanism != pkcs11.CKM_AES_KEY_WRAP {
+		return nil, fmt.Errorf("unsupported PKCS#11 wrapping mechanism %#x", cfg.Mechanism)
+	}
+	ctx := pkcs11.New(cfg.ModulePath)
+	if ctx == nil {
+		return nil, fmt.Errorf("failed to load PKCS#11 module %s", cfg.ModulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("failed to initialize PKCS#11 module: %w", err)
+	}
+	k := &PKCS11KMS{cfg: cfg, ctx: ctx, keys: make(map[string]pkcs11.ObjectHandle)}
+
+	slot, err := k.findSlot()
+	if err == nil {
+		k.session, err = ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			err = fmt.Errorf("failed to open PKCS#11 session: %w", err)
+		}
+	}
+	if err == nil {
+		if err = ctx.Login(k.session, pkcs11.CKU_USER, cfg.PIN); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			err = fmt.Errorf("failed to log in to PKCS#11 token: %w", err)
+		} else {
+			err = nil
+		}
+	}
+	if err != nil {
+		ctx.Finalize()
+		ctx.Destroy()
+		return nil, err
+	}
+	return k, nil
+}
+
+// findSlot returns the slot of the token labelled cfg.TokenLabel, or
+// cfg.Slot when no label is configured.
+func (k *PKCS11KMS) findSlot() (uint, error) {
+	if k.cfg.TokenLabel == "" {
+		return k.cfg.Slot, nil
+	}
+	slots, err := k.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list PKCS#11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := k.ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		// Token labels are padded with spaces to 32 bytes.
+		if strings.TrimRight(info.Label, " \x00") == k.cfg.TokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("no PKCS#11 token labelled %q", k.cfg.TokenLabel)
+}
+
+// Close logs out and releases the session and the module.
+func (k *PKCS11KMS) Close() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.ctx.Logout(k.session)
+	err := k.ctx.CloseSession(k.session)
+	k.ctx.Finalize()
+	k.ctx.Destroy()
+	return err
+}
+
+// CreateKEK generates a KEK for id on the token.
+func (k *PKCS11KMS) CreateKEK(id string) error {
+	if err := ValidateKEKID(id); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, err := k.findKey(id); err == nil {
+		return fmt.Errorf("%w: %s", ErrKEKExists, id)
+	} else if !errors.Is(err, ErrKEKNotFound) {
+		return err
+	}
+	handle, err := k.ctx.GenerateKey(k.session,
+		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+		[]*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.cfg.KeyLabelPrefix+id),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+			pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+			pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		})
+	if err != nil {
+		return fmt.Errorf("failed to generate KEK on PKCS#11 token: %w", err)
+	}
+	k.keys[id] = handle
+	return nil
+}
+
+// findKey returns the handle of the KEK of id. The caller holds mu.
+func (k *PKCS11KMS) findKey(id string) (pkcs11.ObjectHandle, error) {
+	if handle, ok := k.keys[id]; ok {
+		return handle, nil
+	}
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, k.cfg.KeyLabelPrefix+id),
+	}
+	if err := k.ctx.FindObjectsInit(k.session, template); err != nil {
+		return 0, fmt.Errorf("failed to search PKCS#11 token: %w", err)
+	}
+	handles, _, err := k.ctx.FindObjects(k.session, 2)
+	if finalErr := k.ctx.FindObjectsFinal(k.session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to search PKCS#11 token: %w", err)
+	}
+	switch len(handles) {
+	case 0:
+		return 0, fmt.Errorf("%w: %s", ErrKEKNotFound, id)
+	case 1:
+		k.keys[id] = handles[0]
+		return handles[0], nil
+	default:
+		return 0, fmt.Errorf("several keys on the PKCS#11 token are labelled %q", k.cfg.KeyLabelPrefix+id)
+	}
+}
+
+// Wrap wraps dek under the KEK of kekID inside the token.
+func (k *PKCS11KMS) Wrap(dek []byte, kekID string) ([]byte, error) {
+	if len(dek) == 0 {
+		return nil, errors.New("cannot wrap an empty DEK")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kek, err := k.findKey(kekID)
+	if err != nil {
+		return nil, err
+	}
+	// The DEK enters the token as a session object that can be extracted only
+	// by wrapping, and is destroyed right after.
+	object, err := k.ctx.CreateObject(k.session, dekTemplate(dek))
+	if err != nil {
+		return nil, fmt.Errorf("failed to import DEK into PKCS#11 token: %w", err)
+	}
+	defer k.ctx.DestroyObject(k.session, object)
+	wrapped, err := k.ctx.WrapKey(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(k.cfg.Mechanism, nil)}, kek, object)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap DEK on PKCS#11 token: %w", err)
+	}
+	return wrapped, nil
+}
+
+// Unwrap unwraps a DEK wrapped under the KEK of kekID inside the token.
+func (k *PKCS11KMS) Unwrap(wrappedDEK []byte, kekID string) ([]byte, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kek, err := k.findKey(kekID)
+	if err != nil {
+		return nil, err
+	}
+	object, err := k.ctx.UnwrapKey(k.session, []*pkcs11.Mechanism{pkcs11.NewMechanism(k.cfg.Mechanism, nil)}, kek, wrappedDEK, dekTemplate(nil))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap DEK on PKCS#11 token: %w", err)
+	}
+	defer k.ctx.DestroyObject(k.session, object)
+	attrs, err := k.ctx.GetAttributeValue(k.session, object, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read unwrapped DEK from PKCS#11 token: %w", err)
+	}
+	if len(attrs) != 1 {
+		return nil, errors.New("pkcs11: unwrapped key value missing")
+	}
+	return attrs[0].Value, nil
+}
+
+// dekTemplate describes a DEK as a session object: a generic secret that is
+// not sensitive, since the gateway needs its value back after unwrapping.
+func dekTemplate(value []byte) []*pkcs11.Attribute {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+	}
+	if value != nil {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_VALUE, value))
+	}
+	return template
+}
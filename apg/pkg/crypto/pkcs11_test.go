@@ -0,0 +1,85 @@
+//go:build pkcs11
+
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestPKCS11KMS opens the token named by APG_PKCS11_MODULE,
+// APG_PKCS11_TOKEN_LABEL and APG_PKCS11_PIN, e.g. a SoftHSM2 token set up
+// with
+//
+//	softhsm2-util --init-token --free --label apg-test --so-pin 0000 --pin 1234
+//
+// and creates a KEK that is destroyed when the test ends. Without the module
+// the test is skipped.
+func newTestPKCS11KMS(t *testing.T) (*PKCS11KMS, string) {
+	module := os.Getenv("APG_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("APG_PKCS11_MODULE is not set")
+	}
+	kms, err := NewPKCS11KMS(PKCS11Config{
+		ModulePath:     module,
+		TokenLabel:     os.Getenv("APG_PKCS11_TOKEN_LABEL"),
+		PIN:            os.Getenv("APG_PKCS11_PIN"),
+		KeyLabelPrefix: "apg-test-",
+	})
+	if err != nil {
+		t.Fatalf("NewPKCS11KMS failed: %v", err)
+	}
+	kekID := fmt.Sprintf("kek-%d", time.Now().UnixNano())
+	if err := kms.CreateKEK(kekID); err != nil {
+		t.Fatalf("CreateKEK failed: %v", err)
+	}
+	t.Cleanup(func() {
+		kms.mu.Lock()
+		if handle, err := kms.findKey(kekID); err == nil {
+			kms.ctx.DestroyObject(kms.session, handle)
+		}
+		kms.mu.Unlock()
+		kms.Close()
+	})
+	return kms, kekID
+}
+
+func TestPKCS11KMS(t *testing.T) {
+	kms, kekID := newTestPKCS11KMS(t)
+
+	t.Run("encrypt decrypt", func(t *testing.T) { testEncryptDecrypt(t, kms, kekID) })
+	t.Run("tampered ciphertext", func(t *testing.T) { testDecryptTamperedCiphertext(t, kms, kekID) })
+	t.Run("tampered associated data", func(t *testing.T) { testDecryptTamperedAssociatedData(t, kms, kekID) })
+
+	t.Run("wrap unwrap", func(t *testing.T) {
+		dek := bytes.Repeat([]byte{3}, 16)
+		wrapped, err := kms.Wrap(dek, kekID)
+		if err != nil {
+			t.Fatalf("Wrap failed: %v", err)
+		}
+		if bytes.Contains(wrapped, dek) {
+			t.Fatal("the wrapped DEK contains the DEK")
+		}
+		got, err := kms.Unwrap(wrapped, kekID)
+		if err != nil || !bytes.Equal(got, dek) {
+			t.Fatalf("Unwrap = %x, %v", got, err)
+		}
+		wrapped[len(wrapped)-1] ^= 1
+		if _, err := kms.Unwrap(wrapped, kekID); err == nil {
+			t.Error("expected a tampered DEK to be rejected")
+		}
+	})
+
+	t.Run("unknown and duplicate KEKs", func(t *testing.T) {
+		if _, err := kms.Wrap(make([]byte, 16), "missing"); !errors.Is(err, ErrKEKNotFound) {
+			t.Errorf("err = %v, want ErrKEKNotFound", err)
+		}
+		if err := kms.CreateKEK(kekID); !errors.Is(err, ErrKEKExists) {
+			t.Errorf("err = %v, want ErrKEKExists", err)
+		}
+	})
+}
@@ -0,0 +1,323 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for VaultConfig.
+const (
+	DefaultVaultTransitMount = "transit"
+	DefaultVaultAppRoleMount = "approle"
+	DefaultVaultMaxRetries   = 3
+	defaultVaultRetryWait    = 200 * time.Millisecond
+	defaultVaultTimeout      = 10 * time.Second
+)
+
+// vaultTokenSlack renews an AppRole token this long before its lease ends.
+const vaultTokenSlack = 30 * time.Second
+
+// VaultConfig configures a VaultKMS. Either Token or RoleID and SecretID must
+// be set.
+type VaultConfig struct {
+	// Address is the Vault server, e.g. "https://vault.internal:8200".
+	Address string
+	// Token authenticates directly.
+	Token string
+	// RoleID and SecretID log in through the AppRole method mounted at
+	// AppRoleMount (default "approle").
+	RoleID, SecretID string
+	AppRoleMount     string
+	// Namespace is sent as X-Vault-Namespace (Vault Enterprise).
+	Namespace string
+	// TransitMount is where the Transit engine is mounted (default "transit").
+	TransitMount string
+	// KeyPrefix is put in front of a KEK ID to name its transit key.
+	KeyPrefix string
+	// MaxRetries bounds the retries of a call that failed with a network error
+	// or a status Vault uses for transient conditions (default 3).
+	MaxRetries int
+	// RetryWait is the first backoff; it doubles with each retry.
+	RetryWait  time.Duration
+	HTTPClient *http.Client
+}
+
+// VaultKMS wraps DEKs with the Transit secrets engine of HashiCorp Vault. Each
+// KEK ID names a transit key, which never leaves Vault. The wrapped DEK is
+// the transit ciphertext, "vault:v<version>:<base64>", so it records the key
+// version that encrypted it and unwraps after the key is rotated.
+type VaultKMS struct {
+	cfg    VaultConfig
+	client *http.Client
+	// ctx bounds every call, including its retries; see WithContext.
+	ctx context.Context
+	// auth is shared with the copies WithContext makes.
+	auth *vaultAuth
+}
+
+// vaultAuth caches the token an AppRole login returned.
+type vaultAuth struct {
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time // zero for a static or non-expiring token
+}
+
+// NewVaultKMS creates a VaultKMS. No request is made until the first Wrap or
+// Unwrap.
+func NewVaultKMS(cfg VaultConfig) (*VaultKMS, error) {
+	if cfg.Address == "" {
+		return nil, errors.New("vault address is not set")
+	}
+	if _, err := url.Parse(cfg.Address); err != nil {
+		return nil, fmt.Errorf("invalid vault address: %w", err)
+	}
+	if cfg.Token == "" && (cfg.RoleID == "" || cfg.SecretID == "") {
+		return nil, errors.New("vault needs a token or an AppRole role ID and secret ID")
+	}
+	if cfg.TransitMount == "" {
+		cfg.TransitMount = DefaultVaultTransitMount
+	}
+	if cfg.AppRoleMount == "" {
+		cfg.AppRoleMount = DefaultVaultAppRoleMount
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = DefaultVaultMaxRetries
+	}
+	if cfg.RetryWait == 0 {
+		cfg.RetryWait = defaultVaultRetryWait
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultVaultTimeout}
+	}
+	cfg.Address = strings.TrimRight(cfg.Address, "/")
+	return &VaultKMS{cfg: cfg, client: client, ctx: context.Background(), auth: &vaultAuth{token: cfg.Token}}, nil
+}
+
+// WithContext returns a VaultKMS that makes its calls under ctx, so that they
+// and their retries stop when ctx is done. It shares the client and the
+// AppRole token with v.
+func (v *VaultKMS) WithContext(ctx context.Context) KMS {
+	bound := *v
+	bound.ctx = ctx
+	return &bound
+}
+
+// vaultError is the error body Vault returns.
+type vaultError struct {
+	Errors []string `json:"errors"`
+}
+
+// VaultStatusError is a response from Vault with a status other than 2xx.
+type VaultStatusError struct {
+	StatusCode int
+	Errors     []string
+}
+
+func (e *VaultStatusError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault returned status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("vault returned status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// retryableVaultStatus lists the statuses of transient conditions: rate
+// limits, a standby node, replication lag and server errors.
+func retryableVaultStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusPreconditionFailed, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Wrap encrypts dek with the transit key of kekID.
+func (v *VaultKMS) Wrap(dek []byte, kekID string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString(dek)}
+	if err := v.transit("encrypt", kekID, body, &resp); err != nil {
+		return nil, err
+	}
+	if _, err := VaultKeyVersion([]byte(resp.Data.Ciphertext)); err != nil {
+		return nil, fmt.Errorf("vault returned an unexpected ciphertext: %w", err)
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+// Unwrap decrypts a DEK wrapped by Wrap with the transit key of kekID.
+func (v *VaultKMS) Unwrap(wrappedDEK []byte, kekID string) ([]byte, error) {
+	if _, err := VaultKeyVersion(wrappedDEK); err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.transit("decrypt", kekID, map[string]string{"ciphertext": string(wrappedDEK)}, &resp); err != nil {
+		return nil, err
+	}
+	dek, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("vault returned an invalid plaintext: %w", err)
+	}
+	return dek, nil
+}
+
+// CreateKEK creates the transit key of id as an AES-256-GCM key. Vault
+// leaves a key that already exists as it is.
+func (v *VaultKMS) CreateKEK(id string) error {
+	return v.transit("keys", id, map[string]string{"type": "aes256-gcm96"}, nil)
+}
+
+// VaultKeyVersion returns the transit key version recorded in a wrapped DEK.
+func VaultKeyVersion(wrappedDEK []byte) (int, error) {
+	parts := strings.SplitN(string(wrappedDEK), ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" || !strings.HasPrefix(parts[1], "v") || parts[2] == "" {
+		return 0, errors.New("invalid vault ciphertext: want vault:v<version>:<data>")
+	}
+	version, err := strconv.Atoi(parts[1][1:])
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid vault ciphertext: bad key version %q", parts[1])
+	}
+	return version, nil
+}
+
+// transit calls the encrypt, decrypt or keys endpoint for the transit key of
+// kekID.
+// An AppRole token that Vault rejects is renewed once by logging in again.
+func (v *VaultKMS) transit(op, kekID string, body, out interface{}) error {
+	if err := ValidateKEKID(kekID); err != nil {
+		return err
+	}
+	path := "/v1/" + v.cfg.TransitMount + "/" + op + "/" + url.PathEscape(v.cfg.KeyPrefix+kekID)
+	for relogin := v.cfg.Token == ""; ; relogin = false {
+		token, err := v.authToken(false)
+		if err != nil {
+			return err
+		}
+		err = v.do(path, token, body, out)
+		var status *VaultStatusError
+		if relogin && errors.As(err, &status) && status.StatusCode == http.StatusForbidden {
+			if _, err := v.authToken(true); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("vault transit %s with key %s failed: %w", op, v.cfg.KeyPrefix+kekID, err)
+		}
+		return nil
+	}
+}
+
+// authToken returns the token to send, logging in through AppRole when there
+// is no static token and the current one is missing, expiring, or force is set.
+func (v *VaultKMS) authToken(force bool) (string, error) {
+	if v.cfg.Token != "" {
+		return v.cfg.Token, nil
+	}
+	auth := v.auth
+	auth.mu.Lock()
+	defer auth.mu.Unlock()
+	if !force && auth.token != "" && (auth.tokenExpiry.IsZero() || time.Now().Before(auth.tokenExpiry)) {
+		return auth.token, nil
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{"role_id": v.cfg.RoleID, "secret_id": v.cfg.SecretID}
+	if err := v.do("/v1/auth/"+v.cfg.AppRoleMount+"/login", "", body, &resp); err != nil {
+		return "", fmt.Errorf("vault AppRole login failed: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", errors.New("vault AppRole login returned no token")
+	}
+	auth.token = resp.Auth.ClientToken
+	auth.tokenExpiry = time.Time{}
+	if resp.Auth.LeaseDuration > 0 {
+		auth.tokenExpiry = time.Now().Add(time.Duration(resp.Auth.LeaseDuration)*time.Second - vaultTokenSlack)
+	}
+	return auth.token, nil
+}
+
+// do posts body to path and decodes the response into out, retrying network
+// errors and transient statuses with exponential backoff until v.ctx is done.
+// Other failures, such as a response that does not decode, are not retried.
+func (v *VaultKMS) do(path, token string, body, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal vault request: %w", err)
+	}
+	wait := v.cfg.RetryWait
+	for attempt := 0; ; attempt++ {
+		data, transient, err := v.post(path, token, payload)
+		if err == nil {
+			// Creating a key may answer 204 with no body.
+			if out == nil || len(data) == 0 {
+				return nil
+			}
+			if err := json.Unmarshal(data, out); err != nil {
+				return fmt.Errorf("failed to decode vault response: %w", err)
+			}
+			return nil
+		}
+		if !transient || attempt >= v.cfg.MaxRetries {
+			return err
+		}
+		if err := sleepContext(v.ctx, wait); err != nil {
+			return fmt.Errorf("gave up retrying vault call: %w", err)
+		}
+		wait *= 2
+	}
+}
+
+// post sends payload to path and returns the body of a successful response.
+// transient reports whether a failure is worth retrying.
+func (v *VaultKMS) post(path, token string, payload []byte) (data []byte, transient bool, err error) {
+	req, err := http.NewRequestWithContext(v.ctx, http.MethodPost, v.cfg.Address+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create vault request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to call vault: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read vault response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var verr vaultError
+		_ = json.Unmarshal(data, &verr)
+		return nil, retryableVaultStatus(resp.StatusCode), &VaultStatusError{StatusCode: resp.StatusCode, Errors: verr.Errors}
+	}
+	return data, false, nil
+}
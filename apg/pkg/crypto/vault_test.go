@@ -0,0 +1,254 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault is an httptest stand-in for the Transit engine and AppRole login.
+// Its "encryption" is XOR with the key name and version, which is enough to
+// check that every call reaches the right key.
+type fakeVault struct {
+	mu        sync.Mutex
+	tokens    map[string]bool
+	versions  map[string]int
+	namespace string
+	failures  int // answer this many requests with 503 first
+	calls     int
+	logins    int
+}
+
+func newFakeVault(token string) *fakeVault {
+	return &fakeVault{tokens: map[string]bool{token: true}, versions: map[string]int{}}
+}
+
+func (f *fakeVault) xor(data []byte, key string, version int) []byte {
+	pad := fmt.Sprintf("%s#%d", key, version)
+	out := make([]byte, len(data))
+	for i := range data {
+		out[i] = data[i] ^ pad[i%len(pad)]
+	}
+	return out
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	if f.failures > 0 {
+		f.failures--
+		reply(http.StatusServiceUnavailable, vaultError{Errors: []string{"Vault is sealed"}})
+		return
+	}
+	if r.Header.Get("X-Vault-Namespace") != f.namespace {
+		reply(http.StatusNotFound, vaultError{Errors: []string{"no handler for route"}})
+		return
+	}
+	var body map[string]string
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	if r.URL.Path == "/v1/auth/approle/login" {
+		if body["role_id"] != "role" || body["secret_id"] != "secret" {
+			reply(http.StatusBadRequest, vaultError{Errors: []string{"invalid role or secret ID"}})
+			return
+		}
+		f.logins++
+		token := fmt.Sprintf("s.approle%d", f.logins)
+		f.tokens[token] = true
+		reply(http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"client_token": token, "lease_duration": 3600}})
+		return
+	}
+	if !f.tokens[r.Header.Get("X-Vault-Token")] {
+		reply(http.StatusForbidden, vaultError{Errors: []string{"permission denied"}})
+		return
+	}
+	op, key, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	if ok && op == "keys" {
+		if f.versions[key] == 0 {
+			f.versions[key] = 1
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	version, exists := f.versions[key]
+	if !ok || !exists {
+		reply(http.StatusBadRequest, vaultError{Errors: []string{"encryption key not found"}})
+		return
+	}
+	switch op {
+	case "encrypt":
+		dek, _ := base64.StdEncoding.DecodeString(body["plaintext"])
+		ct := fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(f.xor(dek, key, version)))
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ciphertext": ct, "key_version": version}})
+	case "decrypt":
+		v, err := VaultKeyVersion([]byte(body["ciphertext"]))
+		data, err2 := base64.StdEncoding.DecodeString(strings.SplitN(body["ciphertext"], ":", 3)[2])
+		if err != nil || err2 != nil || v > version {
+			reply(http.StatusBadRequest, vaultError{Errors: []string{"invalid ciphertext"}})
+			return
+		}
+		reply(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(f.xor(data, key, v))}})
+	default:
+		reply(http.StatusNotFound, vaultError{Errors: []string{"unsupported path"}})
+	}
+}
+
+func TestVaultKMS_TokenAndKeyVersions(t *testing.T) {
+	fake := newFakeVault("s.root")
+	fake.namespace = "sacred/apg"
+	fake.versions["apg-default-user-kek"] = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kms, err := NewVaultKMS(VaultConfig{Address: server.URL, Token: "s.root", Namespace: "sacred/apg", KeyPrefix: "apg-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, wrappedDEK, nonce, err := Encrypt([]byte("zone B"), nil, kms, "default-user-kek")
+	if err != nil {
+		t.Fatalf("Encrypt failed: %v", err)
+	}
+	if v, err := VaultKeyVersion(wrappedDEK); err != nil || v != 1 {
+		t.Fatalf("VaultKeyVersion = %d, %v", v, err)
+	}
+
+	// After the key is rotated, new DEKs use version 2 and old ones still unwrap.
+	fake.versions["apg-default-user-kek"] = 2
+	rotated, err := kms.Wrap(make([]byte, 16), "default-user-kek")
+	if err != nil || !strings.HasPrefix(string(rotated), "vault:v2:") {
+		t.Fatalf("Wrap after rotation = %q, %v", rotated, err)
+	}
+	if got, err := Decrypt(ciphertext, wrappedDEK, nonce, nil, kms, "default-user-kek"); err != nil || string(got) != "zone B" {
+		t.Fatalf("Decrypt = %q, %v", got, err)
+	}
+
+	var status *VaultStatusError
+	if _, err := kms.Wrap(make([]byte, 16), "missing"); !errors.As(err, &status) || status.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown key: err = %v", err)
+	}
+	calls := fake.calls
+	if _, err := kms.Unwrap([]byte("not-a-vault-ciphertext"), "default-user-kek"); err == nil || fake.calls != calls {
+		t.Errorf("a malformed ciphertext should be rejected locally, err = %v", err)
+	}
+}
+
+func TestVaultKMS_Retries(t *testing.T) {
+	fake := newFakeVault("s.root")
+	fake.versions["k"] = 1
+	fake.failures = 2
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kms, err := NewVaultKMS(VaultConfig{Address: server.URL, Token: "s.root", RetryWait: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.Wrap(make([]byte, 16), "k"); err != nil {
+		t.Fatalf("Wrap should succeed after two transient failures: %v", err)
+	}
+	if fake.calls != 3 {
+		t.Errorf("calls = %d, want 3", fake.calls)
+	}
+
+	// A client error is not retried.
+	fake.calls = 0
+	if _, err := kms.Wrap(make([]byte, 16), "missing"); err == nil || fake.calls != 1 {
+		t.Errorf("err = %v after %d calls, want an error after 1", err, fake.calls)
+	}
+
+	// Neither is a failure that outlasts the retries.
+	fake.failures, fake.calls = 10, 0
+	if _, err := kms.Wrap(make([]byte, 16), "k"); err == nil || fake.calls != DefaultVaultMaxRetries+1 {
+		t.Errorf("err = %v after %d calls", err, fake.calls)
+	}
+
+	// Nor a successful response that does not decode.
+	calls := 0
+	garbled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte("<html>proxy</html>"))
+	}))
+	defer garbled.Close()
+	kms, err = NewVaultKMS(VaultConfig{Address: garbled.URL, Token: "s.root", RetryWait: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kms.Wrap(make([]byte, 16), "k"); err == nil || calls != 1 {
+		t.Errorf("err = %v after %d calls, want an error after 1", err, calls)
+	}
+}
+
+func TestVaultKMS_RetriesStopWithContext(t *testing.T) {
+	fake := newFakeVault("s.root")
+	fake.versions["k"] = 1
+	fake.failures = 10
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kms, err := NewVaultKMS(VaultConfig{Address: server.URL, Token: "s.root", RetryWait: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = BindContext(kms, ctx).Wrap(make([]byte, 16), "k")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want the context's error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Wrap returned after %v, the backoff ignored the context", elapsed)
+	}
+	if fake.calls != 1 {
+		t.Errorf("calls = %d, want 1", fake.calls)
+	}
+}
+
+func TestVaultKMS_AppRole(t *testing.T) {
+	fake := newFakeVault("s.root")
+	fake.versions["k"] = 1
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	kms, err := NewVaultKMS(VaultConfig{Address: server.URL, RoleID: "role", SecretID: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dek := bytes.Repeat([]byte{9}, 16)
+	wrapped, err := kms.Wrap(dek, "k")
+	if err != nil {
+		t.Fatalf("Wrap failed: %v", err)
+	}
+
+	// A revoked token is replaced by logging in again.
+	fake.tokens = map[string]bool{}
+	got, err := kms.Unwrap(wrapped, "k")
+	if err != nil || !bytes.Equal(got, dek) {
+		t.Fatalf("Unwrap = %x, %v", got, err)
+	}
+	if fake.logins != 2 {
+		t.Errorf("logins = %d, want 2", fake.logins)
+	}
+
+	if _, err := NewVaultKMS(VaultConfig{Address: server.URL, RoleID: "role"}); err == nil {
+		t.Error("expected an error without credentials")
+	}
+	bad, _ := NewVaultKMS(VaultConfig{Address: server.URL, RoleID: "role", SecretID: "wrong"})
+	if _, err := bad.Wrap(dek, "k"); err == nil || !strings.Contains(err.Error(), "AppRole login") {
+		t.Errorf("err = %v, want a login failure", err)
+	}
+}
@@ -67,7 +67,6 @@ func (c *Client) Call(ctx context.Context, req types.OpenRouterRequest) (*types.
 	// OpenRouter also recommends setting this header.
 	httpReq.Header.Set("HTTP-Referer", "https://sacredshifter.com")
 
-
 	// 4. Execute the request.
 	resp, err := c.httpClient.Do(httpReq)
 	if err != nil {
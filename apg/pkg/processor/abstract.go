@@ -0,0 +1,218 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// maxAbstractTopics is the number of topics an abstraction names.
+const maxAbstractTopics = 3
+
+// abstractWindow is the recent period an abstraction counts entries for.
+const abstractWindow = 7 * 24 * time.Hour
+
+// topicLexicon maps each topic an abstraction may name to the words that
+// signal it. Words are matched after plural endings are removed.
+var topicLexicon = map[string][]string{
+	"work":          {"work", "job", "boss", "office", "meeting", "deadline", "colleague", "career", "project", "shift", "manager"},
+	"sleep":         {"sleep", "slept", "insomnia", "tired", "nap", "bed", "bedtime", "dream", "nightmare", "rest", "exhausted"},
+	"relationships": {"partner", "friend", "husband", "wife", "boyfriend", "girlfriend", "date", "breakup", "relationship", "love", "lonely"},
+	"family":        {"family", "mother", "father", "mum", "mom", "dad", "parent", "sister", "brother", "child", "kid", "son", "daughter"},
+	"health":        {"health", "sick", "pain", "doctor", "headache", "illness", "medication", "symptom", "body", "energy"},
+	"emotions":      {"anxiety", "anxious", "stress", "stressed", "panic", "worry", "worried", "sad", "anger", "angry", "fear", "grief", "overwhelmed"},
+	"practice":      {"meditation", "meditate", "breathwork", "breathing", "prayer", "ritual", "yoga", "mindfulness", "journaling", "gratitude", "intention"},
+	"movement":      {"exercise", "walk", "run", "running", "gym", "swim", "hike", "dance", "stretch", "workout"},
+	"nature":        {"nature", "forest", "ocean", "sea", "beach", "river", "garden", "mountain", "tree", "sun", "moon"},
+	"money":         {"money", "rent", "bill", "debt", "salary", "budget", "finance", "savings", "pay", "afford"},
+	"creativity":    {"art", "music", "write", "writing", "paint", "painting", "creative", "song", "poem", "craft"},
+}
+
+// sentimentLexicon scores words as positive (1) or negative (-1).
+var sentimentLexicon = map[string]int{
+	"happy": 1, "joy": 1, "grateful": 1, "calm": 1, "peaceful": 1, "peace": 1, "good": 1, "great": 1,
+	"love": 1, "loved": 1, "hopeful": 1, "hope": 1, "grounded": 1, "relieved": 1, "proud": 1, "better": 1,
+	"content": 1, "rested": 1, "energized": 1, "inspired": 1, "excited": 1, "safe": 1, "helped": 1, "eased": 1,
+	"sad": -1, "angry": -1, "anxious": -1, "anxiety": -1, "stress": -1, "stressed": -1, "panic": -1, "worried": -1,
+	"worry": -1, "tired": -1, "exhausted": -1, "lonely": -1, "afraid": -1, "fear": -1, "hurt": -1, "bad": -1,
+	"awful": -1, "terrible": -1, "overwhelmed": -1, "frustrated": -1, "upset": -1, "cry": -1, "cried": -1,
+	"grief": -1, "insomnia": -1, "nightmare": -1, "pain": -1, "worse": -1, "spiked": -1,
+}
+
+// topicForWord inverts topicLexicon.
+var topicForWord = func() map[string]string {
+	m := make(map[string]string)
+	for topic, words := range topicLexicon {
+		for _, w := range words {
+			m[w] = topic
+		}
+	}
+	return m
+}()
+
+// Abstraction is the derived summary of a Context collection that an abstract
+// rule sends to Zone A in place of any of its text.
+type Abstraction struct {
+	Path    string
+	Entries int
+	// First and Last bound the entries' dates, to the day; both are empty
+	// when no entry carries a date.
+	First, Last string
+	// Recent counts the entries dated within a week before the request's
+	// timestamp, or -1 when the request has none.
+	Recent int
+	// Topics names the most frequent topics, most frequent first, with the
+	// number of entries that touch on each.
+	Topics []TopicCount
+	// Positive, Negative and Neutral count the entries by lexicon sentiment.
+	Positive, Negative, Neutral int
+
+	// rule is the abstract rule that produced the abstraction.
+	rule PolicyRule
+}
+
+// TopicCount is a topic and the number of entries that touch on it.
+type TopicCount struct {
+	Topic   string
+	Entries int
+}
+
+// String renders the abstraction as one line of the promoted context message.
+func (a Abstraction) String() string {
+	var b strings.Builder
+	noun := "entries"
+	if a.Entries == 1 {
+		noun = "entry"
+	}
+	fmt.Fprintf(&b, "%d %s", a.Entries, noun)
+	switch {
+	case a.First != "" && a.First != a.Last:
+		fmt.Fprintf(&b, " from %s to %s", a.First, a.Last)
+	case a.First != "":
+		fmt.Fprintf(&b, " on %s", a.First)
+	}
+	if a.Recent >= 0 {
+		fmt.Fprintf(&b, " (%d in the last 7 days)", a.Recent)
+	}
+	if len(a.Topics) > 0 {
+		topics := make([]string, len(a.Topics))
+		for i, t := range a.Topics {
+			topics[i] = fmt.Sprintf("%s %d", t.Topic, t.Entries)
+		}
+		fmt.Fprintf(&b, "; topics: %s", strings.Join(topics, ", "))
+	}
+	fmt.Fprintf(&b, "; sentiment: %d positive, %d negative, %d neutral", a.Positive, a.Negative, a.Neutral)
+	return b.String()
+}
+
+// abstractions runs every abstract rule of the policy against the request's
+// Context. A path whose value is a single string abstracts it as one entry.
+func (p *Processor) abstractions(req *types.AuraGatewayRequest, context interface{}) []Abstraction {
+	var abstractions []Abstraction
+	for _, rule := range p.policy.Rules {
+		if rule.Zone != ZoneA || !isContextPath(rule.Field) || rule.Transform != TransformAbstract {
+			continue
+		}
+		pattern := strings.TrimPrefix(rule.Field, contextFieldPrefix)
+		for _, node := range contextNodes(context, strings.Split(pattern, "."), nil) {
+			if governing, _ := p.policy.contextRule(node.path); governing.Field != rule.Field {
+				continue // an earlier rule decides this path
+			}
+			if len(req.PromoteContext) > 0 && !matchAnyContextPath(req.PromoteContext, node.path) {
+				continue
+			}
+			entries := contextChildren(node)
+			if _, ok := node.value.(string); ok {
+				entries = []contextNode{node}
+			}
+			if len(entries) == 0 {
+				continue
+			}
+			a := abstract(node.path.label(pattern), entries, req.Timestamp)
+			a.rule = rule
+			abstractions = append(abstractions, a)
+		}
+	}
+	return abstractions
+}
+
+// abstract derives an Abstraction from the entries of a collection.
+func abstract(path string, entries []contextNode, now *time.Time) Abstraction {
+	a := Abstraction{Path: path, Entries: len(entries), Recent: -1}
+	if now != nil {
+		a.Recent = 0
+	}
+	var first, last time.Time
+	topicEntries := make(map[string]int)
+	for _, entry := range entries {
+		score := 0
+		topics := make(map[string]bool)
+		var dated time.Time
+		for _, leaf := range contextLeaves(entry.value, nil, nil) {
+			if t, ok := parseEntryDate(leaf.value); ok {
+				if dated.IsZero() {
+					dated = t
+				}
+				continue
+			}
+			for _, term := range retrievalTerms(leaf.value) {
+				score += sentimentLexicon[term]
+				if topic, ok := topicForWord[term]; ok {
+					topics[topic] = true
+				}
+			}
+		}
+		for topic := range topics {
+			topicEntries[topic]++
+		}
+		switch {
+		case score > 0:
+			a.Positive++
+		case score < 0:
+			a.Negative++
+		default:
+			a.Neutral++
+		}
+		if dated.IsZero() {
+			continue
+		}
+		if first.IsZero() || dated.Before(first) {
+			first = dated
+		}
+		if last.IsZero() || dated.After(last) {
+			last = dated
+		}
+		if now != nil && !dated.After(*now) && now.Sub(dated) <= abstractWindow {
+			a.Recent++
+		}
+	}
+	if !first.IsZero() {
+		a.First, a.Last = first.UTC().Format("2006-01-02"), last.UTC().Format("2006-01-02")
+	}
+
+	for topic, n := range topicEntries {
+		a.Topics = append(a.Topics, TopicCount{Topic: topic, Entries: n})
+	}
+	sort.Slice(a.Topics, func(i, j int) bool {
+		if a.Topics[i].Entries != a.Topics[j].Entries {
+			return a.Topics[i].Entries > a.Topics[j].Entries
+		}
+		return a.Topics[i].Topic < a.Topics[j].Topic
+	})
+	if len(a.Topics) > maxAbstractTopics {
+		a.Topics = a.Topics[:maxAbstractTopics]
+	}
+	return a
+}
+
+// parseEntryDate recognises a leaf that is a whole timestamp or date.
+func parseEntryDate(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, true
+	}
+	return parseTimestamp(s)
+}
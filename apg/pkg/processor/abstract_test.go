@@ -0,0 +1,54 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestSplit_AbstractsContext(t *testing.T) {
+	now := time.Date(2026, 10, 12, 9, 0, 0, 0, time.UTC)
+	req := &types.AuraGatewayRequest{
+		Prompt:         "How was my week?",
+		RequestedModel: "m",
+		Timestamp:      &now,
+		Context: map[string]interface{}{
+			"journal": []interface{}{
+				map[string]interface{}{"date": "2026-09-20", "text": "Deadline at work, stressed and tired."},
+				map[string]interface{}{"date": "2026-10-06", "text": "Slept badly again, nightmares about my boss."},
+				map[string]interface{}{"date": "2026-10-08", "text": "Work meeting went well, felt proud and calm."},
+				map[string]interface{}{"date": "2026-10-11T21:30:00Z", "text": "Call with Jane Doe at jane@example.com, then early bed."},
+			},
+		},
+	}
+
+	result, err := New(contextPolicy(TransformAbstract, "", "journal")).Split(req)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	want := contextHeader + "\n- journal: 4 entries from 2026-09-20 to 2026-10-11 (3 in the last 7 days); " +
+		"topics: sleep 3, work 3, emotions 1; sentiment: 1 positive, 2 negative, 1 neutral"
+	if got := result.ZoneA.Messages[1].Content; got != want {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+	for _, m := range result.ZoneA.Messages {
+		if strings.Contains(m.Content, "Jane") || strings.Contains(m.Content, "Deadline") {
+			t.Errorf("raw context reached Zone A: %q", m.Content)
+		}
+	}
+	if len(result.Redactions) != 0 || len(result.Decision.PromotedContext) != 1 {
+		t.Errorf("unexpected redactions %+v or promoted paths %v", result.Redactions, result.Decision.PromotedContext)
+	}
+	if got := result.Decision.Transforms["context.journal"]; got != string(TransformAbstract) {
+		t.Errorf("Decision.Transforms = %v", result.Decision.Transforms)
+	}
+}
+
+func TestAbstraction_String(t *testing.T) {
+	a := Abstraction{Entries: 1, First: "2026-10-01", Last: "2026-10-01", Recent: -1, Neutral: 1}
+	if got, want := a.String(), "1 entry on 2026-10-01; sentiment: 0 positive, 0 negative, 1 neutral"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,277 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// contextFieldPrefix introduces a Context path in a policy rule's field, as in
+// "context.journal.mood". Such a rule in Zone A promotes the values at that
+// path into Zone A after scrubbing.
+const contextFieldPrefix = FieldContext + "."
+
+// contextHeader opens the system message that carries promoted context.
+const contextHeader = "Context shared by the user:"
+
+// isContextPath reports whether a rule field names a path inside Context.
+func isContextPath(field string) bool {
+	return strings.HasPrefix(field, contextFieldPrefix)
+}
+
+// validateContextPath checks a dot-separated Context path. Segments may be
+// object keys, array indexes or * for any key or index.
+func validateContextPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("context path is empty")
+	}
+	for _, segment := range strings.Split(path, ".") {
+		if segment == "" {
+			return fmt.Errorf("context path %q has an empty segment", path)
+		}
+	}
+	return nil
+}
+
+// ContextAllowlist returns the Context paths the policy admits into Zone A.
+func (p *ClassificationPolicy) ContextAllowlist() []string {
+	var paths []string
+	for _, rule := range p.Rules {
+		if rule.Zone == ZoneA && isContextPath(rule.Field) {
+			paths = append(paths, strings.TrimPrefix(rule.Field, contextFieldPrefix))
+		}
+	}
+	return paths
+}
+
+// contextRule returns the first Zone A rule whose Context path selects path.
+func (p *ClassificationPolicy) contextRule(path contextPath) (PolicyRule, bool) {
+	for _, rule := range p.Rules {
+		if rule.Zone == ZoneA && isContextPath(rule.Field) && matchContextPath(strings.TrimPrefix(rule.Field, contextFieldPrefix), path) {
+			return rule, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+// matchContextPath reports whether pattern selects path: every segment of
+// pattern must equal the key of the matching segment of path or be *, and
+// path may go on below pattern, so "journal" selects "journal.mood". Keys are
+// compared whole, so a key containing "." is only matched by *.
+func matchContextPath(pattern string, path contextPath) bool {
+	want := strings.Split(pattern, ".")
+	if len(want) > len(path) {
+		return false
+	}
+	for i, segment := range want {
+		if segment != "*" && segment != path[i].key {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAnyContextPath(patterns []string, path contextPath) bool {
+	for _, pattern := range patterns {
+		if matchContextPath(pattern, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// contextSegment is one step of a path into Context: an object key or array
+// index, and its position among its siblings, ordered by key or index.
+type contextSegment struct {
+	key   string
+	index int
+}
+
+// contextPath locates a value in Context. It keeps the keys apart instead of
+// joining them with ".", which a key may contain.
+type contextPath []contextSegment
+
+func (p contextPath) child(key string, index int) contextPath {
+	return append(p[:len(p):len(p)], contextSegment{key: key, index: index})
+}
+
+// id identifies the path within one request. It is never sent.
+func (p contextPath) id() string {
+	keys := make([]string, len(p))
+	for i, s := range p {
+		keys[i] = s.key
+	}
+	return strings.Join(keys, "\x00")
+}
+
+// label names the path outside Zone B, given the rule pattern that selects
+// it. Keys are user data and may themselves be identifiers, so only the
+// segments the pattern spells out are shown; every other segment, under a *
+// or below the pattern, is shown as its position.
+func (p contextPath) label(pattern string) string {
+	want := strings.Split(pattern, ".")
+	segments := make([]string, len(p))
+	for i, s := range p {
+		if i < len(want) && want[i] != "*" {
+			segments[i] = want[i]
+		} else {
+			segments[i] = strconv.Itoa(s.index)
+		}
+	}
+	return strings.Join(segments, ".")
+}
+
+// contextLeaf is one scalar value of the Context object and its path. rule
+// is the policy rule that promotes it, and label the name of its path in
+// Zone A, once promotedLeaves has found one.
+type contextLeaf struct {
+	path  contextPath
+	value string
+	rule  PolicyRule
+	label string
+}
+
+// contextLeaves flattens a decoded JSON value into its string, number and
+// boolean leaves, ordered by path.
+func contextLeaves(v interface{}, path contextPath, leaves []contextLeaf) []contextLeaf {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			leaves = contextLeaves(val[k], path.child(k, i), leaves)
+		}
+	case []interface{}:
+		for i, child := range val {
+			leaves = contextLeaves(child, path.child(strconv.Itoa(i), i), leaves)
+		}
+	case string:
+		leaves = append(leaves, contextLeaf{path: path, value: val})
+	case float64:
+		leaves = append(leaves, contextLeaf{path: path, value: strconv.FormatFloat(val, 'f', -1, 64)})
+	case bool:
+		leaves = append(leaves, contextLeaf{path: path, value: strconv.FormatBool(val)})
+	}
+	return leaves
+}
+
+// promotedLeaves returns the Context values that may enter Zone A: those the
+// policy allows and, when the request names paths of its own, that the
+// request asks for too. A request can narrow the policy but never widen it.
+// Under a retrieve rule, only the leaves of the selected items qualify; the
+// selections are returned for the record.
+func (p *Processor) promotedLeaves(req *types.AuraGatewayRequest) ([]contextLeaf, []Retrieval) {
+	if len(p.policy.ContextAllowlist()) == 0 {
+		return nil, nil
+	}
+	context := normalizeJSON(req.Context)
+	selected, retrievals := p.retrieve(req, context)
+	var promoted []contextLeaf
+	for _, leaf := range contextLeaves(context, nil, nil) {
+		rule, ok := p.policy.contextRule(leaf.path)
+		if !ok || rule.Transform == TransformAbstract {
+			continue
+		}
+		pattern := strings.TrimPrefix(rule.Field, contextFieldPrefix)
+		if rule.Transform == TransformRetrieve {
+			depth := strings.Count(pattern, ".") + 2 // the collection's segments and the item's
+			if len(leaf.path) < depth || !selected[leaf.path[:depth].id()] {
+				continue
+			}
+		}
+		if len(req.PromoteContext) > 0 && !matchAnyContextPath(req.PromoteContext, leaf.path) {
+			continue
+		}
+		leaf.rule = rule
+		leaf.label = leaf.path.label(pattern)
+		promoted = append(promoted, leaf)
+	}
+	return promoted, retrievals
+}
+
+// promoteLeaf scrubs a promoted Context value and returns the text for Zone A
+// with its redactions, whose offsets refer to the whole value. Under a
+// summarize rule only the highest-ranked sentences that fit the budget once
+// scrubbed are kept, in their original order; the rest is never sent, and
+// the placeholders and surrogates its scrubbing assigned are rolled back, so
+// it leaves nothing in the mapping. sanitize holds injection matches to
+// filter out, if any.
+func (p *Processor) promoteLeaf(leaf contextLeaf, sanitize []Finding, sc *ScrubContext) (string, []types.Redaction) {
+	sc.Turn = -1
+	scrub := func(s sentence) (string, []types.Redaction) {
+		text := leaf.value[s.start:s.end]
+		stages := p.pipeline.scrubbers
+		if matches := clipFindings(sanitize, s.start, s.end); len(matches) > 0 {
+			stages = append([]Scrubber{sanitizer{matches: matches}}, stages...)
+		}
+		msg, findings := NewPipeline(stages...).Scrub(types.Message{Role: types.RoleSystem, Content: text}, sc)
+		redactions := describeRedactions(-1, text, findings)
+		offset := utf8.RuneCountInString(leaf.value[:s.start])
+		for i := range redactions {
+			redactions[i].Path = leaf.label
+			redactions[i].Start += offset
+			redactions[i].End += offset
+		}
+		return msg.Content, redactions
+	}
+
+	if leaf.rule.Transform != TransformSummarize {
+		return scrub(sentence{start: 0, end: len(leaf.value)})
+	}
+
+	limit, _ := ParseSummaryParam(leaf.rule.TransformParam) // checked by Validate
+	sentences := splitSentences(leaf.value)
+	type kept struct {
+		index int
+		text  string
+	}
+	var summary []kept
+	var redactions []types.Redaction
+	chars := 0
+	for _, i := range rankSentences(leaf.value, sentences) {
+		if len(summary) == limit.Sentences {
+			break
+		}
+		mark := sc.mark()
+		text, sentenceRedactions := scrub(sentences[i])
+		n := utf8.RuneCountInString(text)
+		if len(summary) > 0 {
+			n++ // the joining space
+		}
+		if chars+n > limit.Chars {
+			sc.rollback(mark)
+			continue
+		}
+		chars += n
+		summary = append(summary, kept{index: i, text: text})
+		redactions = append(redactions, sentenceRedactions...)
+	}
+	sort.Slice(summary, func(a, b int) bool { return summary[a].index < summary[b].index })
+	sort.Slice(redactions, func(a, b int) bool { return redactions[a].Start < redactions[b].Start })
+	texts := make([]string, len(summary))
+	for i, s := range summary {
+		texts[i] = s.text
+	}
+	return strings.Join(texts, " "), redactions
+}
+
+// clipFindings returns the findings that overlap [start, end), clipped to it
+// and with offsets relative to start.
+func clipFindings(findings []Finding, start, end int) []Finding {
+	var clipped []Finding
+	for _, f := range findings {
+		if f.End <= start || f.Start >= end {
+			continue
+		}
+		f.Start, f.End = max(f.Start, start)-start, min(f.End, end)-start
+		clipped = append(clipped, f)
+	}
+	return clipped
+}
@@ -0,0 +1,197 @@
+package processor
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Category identifies the kind of identifier a detector recognises.
+// It is also used as the prefix of the placeholder that replaces a match.
+type Category string
+
+const (
+	CategoryEmail      Category = "EMAIL"
+	CategoryPhone      Category = "PHONE"
+	CategoryCreditCard Category = "CREDIT_CARD"
+	CategoryIBAN       Category = "IBAN"
+	CategoryIPAddress  Category = "IP_ADDRESS"
+	CategoryURL        Category = "URL"
+	CategoryAddress    Category = "ADDRESS"
+)
+
+// Finding is a single identifier located in a piece of text.
+// Start and End are byte offsets into the text that was scanned.
+type Finding struct {
+	Category Category
+	Start    int
+	End      int
+	Value    string
+	// Replacement, when set, is a coarse Zone A form of Value (such as a
+	// rounded timestamp) used instead of a reversible placeholder. Once a
+	// finding has been scrubbed it holds whatever replaced the value.
+	Replacement string
+}
+
+// Detector recognises one category of identifier.
+// Pattern proposes candidate matches and the optional Validate function
+// rejects candidates that merely look right (e.g. a card number failing Luhn).
+type Detector struct {
+	Category Category
+	Pattern  *regexp.Regexp
+	Validate func(match string) bool
+}
+
+var (
+	// URLs are only treated as identifying when they carry a query string,
+	// since that is where session tokens, emails and IDs usually end up.
+	urlPattern   = regexp.MustCompile(`\bhttps?://[^\s<>"'?#]+\?[^\s<>"']+`)
+	emailPattern = regexp.MustCompile(`(?i)\b[a-z0-9._%+\-]+@[a-z0-9\-]+(?:\.[a-z0-9\-]+)*\.[a-z]{2,}\b`)
+	ibanPattern  = regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`)
+	cardPattern  = regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`)
+	ipv4Pattern  = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern  = regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{1,4}\b`)
+	phonePattern = regexp.MustCompile(`(?:\+\d{1,3}[ .\-]?)?(?:\(\d{1,4}\)[ .\-]?)?\d{1,4}(?:[ .\-]?\d{2,4}){2,4}\b`)
+	// Street addresses: a house number, one to three capitalised words and a street suffix.
+	addressPattern = regexp.MustCompile(`\b(?:(?i:unit|apt|apartment|suite)\s+\d+[A-Za-z]?,?\s+|\d+[A-Za-z]?/)?\d{1,5}[A-Za-z]?\s+(?:[A-Z][a-z]+\s+){1,3}(?i:street|st|road|rd|avenue|ave|boulevard|blvd|lane|ln|drive|dr|court|ct|place|pl|terrace|tce|way|parade|pde|crescent|cres|highway|hwy|close|cl)\b\.?`)
+
+	isoDatePattern = regexp.MustCompile(`^\d{4}[\-./]\d{2}[\-./]\d{2}$`)
+)
+
+// DefaultDetectors returns the built-in detectors in priority order.
+// When two matches overlap, the one from the earlier detector wins.
+func DefaultDetectors() []Detector {
+	return []Detector{
+		{Category: CategoryURL, Pattern: urlPattern, Validate: validURLWithQuery},
+		{Category: CategoryEmail, Pattern: emailPattern},
+		{Category: CategoryIBAN, Pattern: ibanPattern, Validate: validIBAN},
+		{Category: CategoryCreditCard, Pattern: cardPattern, Validate: validCardNumber},
+		{Category: CategoryIPAddress, Pattern: ipv4Pattern, Validate: validIP},
+		{Category: CategoryIPAddress, Pattern: ipv6Pattern, Validate: validIP},
+		{Category: CategoryAddress, Pattern: addressPattern},
+		{Category: CategoryPhone, Pattern: phonePattern, Validate: validPhone},
+	}
+}
+
+// Detect runs the detectors over text and returns the non-overlapping findings,
+// ordered by their position in the text.
+func Detect(text string, detectors []Detector) []Finding {
+	var findings []Finding
+	for _, d := range detectors {
+		for _, loc := range d.Pattern.FindAllStringIndex(text, -1) {
+			match := text[loc[0]:loc[1]]
+			if d.Validate != nil && !d.Validate(match) {
+				continue
+			}
+			if overlapsAny(findings, loc[0], loc[1]) {
+				continue
+			}
+			findings = append(findings, Finding{
+				Category: d.Category,
+				Start:    loc[0],
+				End:      loc[1],
+				Value:    match,
+			})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+	return findings
+}
+
+func overlapsAny(findings []Finding, start, end int) bool {
+	for _, f := range findings {
+		if start < f.End && f.Start < end {
+			return true
+		}
+	}
+	return false
+}
+
+func validURLWithQuery(match string) bool {
+	u, err := url.Parse(match)
+	return err == nil && u.Host != "" && u.RawQuery != ""
+}
+
+func validIP(match string) bool {
+	return net.ParseIP(match) != nil
+}
+
+// validCardNumber accepts 13 to 19 digit numbers that pass the Luhn checksum.
+func validCardNumber(match string) bool {
+	digits := onlyDigits(match)
+	if len(digits) < 13 || len(digits) > 19 {
+		return false
+	}
+	return luhnValid(digits)
+}
+
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// validIBAN checks the ISO 13616 mod-97 checksum.
+func validIBAN(match string) bool {
+	iban := strings.ReplaceAll(match, " ", "")
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	return mod97(iban[4:]+iban[:4]) == 1
+}
+
+// mod97 returns s mod 97 with letters expanded to 10-35, as for IBANs, or -1
+// when s holds anything but digits and capital letters.
+func mod97(s string) int64 {
+	var numeric strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= '0' && r <= '9':
+			numeric.WriteRune(r)
+		case r >= 'A' && r <= 'Z':
+			fmt.Fprintf(&numeric, "%d", r-'A'+10)
+		default:
+			return -1
+		}
+	}
+	n, ok := new(big.Int).SetString(numeric.String(), 10)
+	if !ok {
+		return -1
+	}
+	return new(big.Int).Mod(n, big.NewInt(97)).Int64()
+}
+
+// validPhone accepts 8 to 15 digits (the E.164 maximum) and rejects
+// candidates that are really calendar dates.
+func validPhone(match string) bool {
+	if isoDatePattern.MatchString(match) {
+		return false
+	}
+	n := len(onlyDigits(match))
+	return n >= 8 && n <= 15
+}
+
+func onlyDigits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
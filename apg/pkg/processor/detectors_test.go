@@ -0,0 +1,85 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDetect_Categories(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		want  Category
+		value string
+	}{
+		{"email", "reach me at jane.doe+aura@example.com today", CategoryEmail, "jane.doe+aura@example.com"},
+		{"phone international", "call +61 2 9876 5432 after six", CategoryPhone, "+61 2 9876 5432"},
+		{"phone local", "my mobile is 0412 345 678", CategoryPhone, "0412 345 678"},
+		{"credit card", "card 4111 1111 1111 1111 expires soon", CategoryCreditCard, "4111 1111 1111 1111"},
+		{"iban", "send it to DE89 3704 0044 0532 0130 00 please", CategoryIBAN, "DE89 3704 0044 0532 0130 00"},
+		{"ipv4", "my router is 203.0.113.195", CategoryIPAddress, "203.0.113.195"},
+		{"ipv6", "server at 2001:db8::8a2e:370:7334 is down", CategoryIPAddress, "2001:db8::8a2e:370:7334"},
+		{"url with token", "open https://example.com/reset?token=abc123&u=9 now", CategoryURL, "https://example.com/reset?token=abc123&u=9"},
+		{"street address", "I live at 42 Wallaby Way, Sydney", CategoryAddress, "42 Wallaby Way"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := Detect(tt.text, DefaultDetectors())
+			if len(findings) != 1 {
+				t.Fatalf("expected 1 finding, got %d: %+v", len(findings), findings)
+			}
+			f := findings[0]
+			if f.Category != tt.want {
+				t.Errorf("category: got %s, want %s", f.Category, tt.want)
+			}
+			if f.Value != tt.value {
+				t.Errorf("value: got %q, want %q", f.Value, tt.value)
+			}
+			if tt.text[f.Start:f.End] != f.Value {
+				t.Errorf("offsets %d:%d do not match value %q", f.Start, f.End, f.Value)
+			}
+		})
+	}
+}
+
+func TestDetect_RejectsLookalikes(t *testing.T) {
+	texts := []string{
+		"card 4111 1111 1111 1112 fails luhn",
+		"IBAN DE00 3704 0044 0532 0130 00 has a bad checksum",
+		"version 999.1.2.3 is not an address",
+		"the meeting is on 2023-10-27",
+		"see https://example.com/about for details",
+		"I wrote 3 pages today",
+	}
+	for _, text := range texts {
+		if findings := Detect(text, DefaultDetectors()); len(findings) != 0 {
+			t.Errorf("Detect(%q) = %+v, want no findings", text, findings)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	text := "Email jane@example.com or call +61 2 9876 5432. Again: jane@example.com, bob@example.org"
+	got, findings := Redact(text)
+
+	want := "Email [EMAIL_1] or call [PHONE_1]. Again: [EMAIL_1], [EMAIL_2]"
+	if got != want {
+		t.Errorf("Redact() = %q, want %q", got, want)
+	}
+	if len(findings) != 4 {
+		t.Errorf("expected 4 findings, got %d", len(findings))
+	}
+	if strings.Contains(got, "@") {
+		t.Errorf("redacted text still contains an email: %q", got)
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	if !luhnValid("79927398713") {
+		t.Error("expected 79927398713 to pass Luhn")
+	}
+	if luhnValid("79927398710") {
+		t.Error("expected 79927398710 to fail Luhn")
+	}
+}
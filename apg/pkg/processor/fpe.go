@@ -0,0 +1,264 @@
+package processor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// CategoryOrderNumber marks order, invoice and booking numbers. Only the FPE
+// scrubber looks for them.
+const CategoryOrderNumber Category = "ORDER_NUMBER"
+
+// ScrubberFPE names the format-preserving encryption scrubber.
+const ScrubberFPE = "fpe"
+
+// fpeKeySize is the length of the per-request AES key, in bytes.
+const fpeKeySize = 16
+
+// minFPEDigits is the fewest digits a value needs for its surrogate to be
+// encrypted; SP 800-38G requires a domain of at least a million.
+const minFPEDigits = 6
+
+var (
+	// orderNumberPattern captures the number after a word that introduces it,
+	// as in "order #4410-2231".
+	orderNumberPattern = regexp.MustCompile(`(?i)\b(?:order|invoice|booking|ticket|reference|ref)(?:\s+(?:no\.?|number|id))?\s*[:#]?\s*#?\s*([A-Z]{0,4}-?\d[\d\-]{4,}\d)\b`)
+	// surrogatePattern matches digit runs in model output, allowing the
+	// separators a model may add when it reformats a number.
+	surrogatePattern = regexp.MustCompile(`\d(?:[ \-.()]{0,2}\d)*`)
+)
+
+// FPERecord is what recombination needs to turn surrogates back into the
+// original values. It is Zone B data.
+type FPERecord struct {
+	Mode  string `json:"mode"`
+	KEKID string `json:"kekId"`
+	// WrappedKey is the request's FPE key, wrapped by the KMS.
+	WrappedKey []byte `json:"wrappedKey"`
+	// Surrogates maps the digits of each surrogate sent to Zone A to the
+	// category whose tweak encrypted them.
+	Surrogates map[string]Category `json:"surrogates"`
+}
+
+// fpeConfig is set by WithFPE.
+type fpeConfig struct {
+	kms   crypto.KMS
+	kekID string
+	mode  string
+}
+
+// WithFPE lets the FPE scrubber replace phone and order numbers with
+// format-preserving surrogates, encrypted under a fresh key per request that
+// kms wraps under kekID, or under the user's KEK with WithKEKRegistry. Without
+// it the scrubber falls back to placeholders.
+func WithFPE(kms crypto.KMS, kekID, mode string) Option {
+	return func(p *Processor) {
+		p.fpe = &fpeConfig{kms: kms, kekID: kekID, mode: mode}
+	}
+}
+
+// WithKEKRegistry wraps the FPE key of each request under the KEK of its
+// user from keks, in place of the kekID given to WithFPE.
+func WithKEKRegistry(keks *crypto.KEKRegistry) Option {
+	return func(p *Processor) {
+		p.keks = keks
+	}
+}
+
+// fpeKEKID returns the ID of the KEK that wraps the FPE key of req.
+func (p *Processor) fpeKEKID(ctx context.Context, req *types.AuraGatewayRequest) (string, error) {
+	if p.keks == nil {
+		return p.fpe.kekID, nil
+	}
+	return p.keks.Resolve(ctx, req.UserID, req.CircleID)
+}
+
+// fpeSession encrypts the surrogates of one request.
+type fpeSession struct {
+	cipher crypto.FPE
+	record *FPERecord
+	// added lists the keys of record.Surrogates in the order they were
+	// added, so that rollback can undo them.
+	added []string
+}
+
+// newSession generates the key for one request and wraps it under kekID,
+// with the KMS call bound to ctx.
+func (c *fpeConfig) newSession(ctx context.Context, kekID string) (*fpeSession, error) {
+	key := make([]byte, fpeKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate FPE key: %w", err)
+	}
+	wrapped, err := crypto.BindContext(c.kms, ctx).Wrap(key, kekID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap FPE key with KMS: %w", err)
+	}
+	return c.session(key, kekID, wrapped)
+}
+
+// newPreviewSession generates a key for one preview, which is never wrapped.
+func (c *fpeConfig) newPreviewSession() (*fpeSession, error) {
+	key := make([]byte, fpeKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("failed to generate FPE key: %w", err)
+	}
+	return c.session(key, "", nil)
+}
+
+func (c *fpeConfig) session(key []byte, kekID string, wrapped []byte) (*fpeSession, error) {
+	cipher, err := crypto.NewFPE(c.mode, key, 10)
+	if err != nil {
+		return nil, err
+	}
+	return &fpeSession{
+		cipher: cipher,
+		record: &FPERecord{Mode: c.mode, KEKID: kekID, WrappedKey: wrapped, Surrogates: make(map[string]Category)},
+	}, nil
+}
+
+// fpeTweak separates the surrogates of different categories, so that equal
+// digits in a phone and an order number encrypt differently.
+func fpeTweak(category Category) []byte {
+	sum := sha256.Sum256([]byte("apg-fpe:" + string(category)))
+	return sum[:crypto.FF31TweakSize]
+}
+
+// surrogate encrypts the digits of value and puts them back in place, so the
+// surrogate keeps every separator, prefix and letter of the original.
+func (s *fpeSession) surrogate(category Category, value string) (string, bool) {
+	digits := onlyDigits(value)
+	if len(digits) < minFPEDigits {
+		return "", false
+	}
+	encrypted, err := s.cipher.Encrypt(digits, fpeTweak(category))
+	if err != nil {
+		return "", false
+	}
+	if _, ok := s.record.Surrogates[encrypted]; !ok {
+		s.record.Surrogates[encrypted] = category
+		s.added = append(s.added, encrypted)
+	}
+	return replaceDigits(value, encrypted), true
+}
+
+// rollback forgets the surrogates recorded since mark, a length of added.
+func (s *fpeSession) rollback(mark int) {
+	for _, encrypted := range s.added[mark:] {
+		delete(s.record.Surrogates, encrypted)
+	}
+	s.added = s.added[:mark]
+}
+
+// replaceDigits writes digits, in order, over the digits of s.
+func replaceDigits(s, digits string) string {
+	b := []byte(s)
+	j := 0
+	for i, c := range b {
+		if c >= '0' && c <= '9' && j < len(digits) {
+			b[i] = digits[j]
+			j++
+		}
+	}
+	return string(b)
+}
+
+// FPEScrubber replaces phone and order numbers with format-preserving
+// surrogates when the processor has WithFPE, and with placeholders otherwise.
+func FPEScrubber() Scrubber {
+	return funcScrubber{name: ScrubberFPE, find: func(text string, sc *ScrubContext) []Finding {
+		// An introduced order number wins over a phone number on the same digits.
+		var findings []Finding
+		for _, m := range orderNumberPattern.FindAllStringSubmatchIndex(text, -1) {
+			findings = append(findings, Finding{Category: CategoryOrderNumber, Start: m[2], End: m[3], Value: text[m[2]:m[3]]})
+		}
+		for _, f := range Detect(text, []Detector{{Category: CategoryPhone, Pattern: phonePattern, Validate: validPhone}}) {
+			if !overlapsAny(findings, f.Start, f.End) {
+				findings = append(findings, f)
+			}
+		}
+		sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+		if sc.fpe == nil {
+			return findings
+		}
+		for i, f := range findings {
+			if surrogate, ok := sc.fpe.surrogate(f.Category, f.Value); ok {
+				findings[i].Replacement = surrogate
+			}
+		}
+		return findings
+	}}
+}
+
+// RestoreSurrogates decrypts every surrogate in record found in text, in
+// whatever format the model wrote it, using the key the KMS unwraps.
+func RestoreSurrogates(text string, record *FPERecord, kms crypto.KMS) (string, error) {
+	if record == nil || len(record.Surrogates) == 0 {
+		return text, nil
+	}
+	key, err := kms.Unwrap(record.WrappedKey, record.KEKID)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap FPE key with KMS: %w", err)
+	}
+	cipher, err := crypto.NewFPE(record.Mode, key, 10)
+	if err != nil {
+		return "", err
+	}
+	var restoreErr error
+	restored := surrogatePattern.ReplaceAllStringFunc(text, func(match string) string {
+		category, ok := record.Surrogates[onlyDigits(match)]
+		if !ok {
+			return match
+		}
+		digits, err := cipher.Decrypt(onlyDigits(match), fpeTweak(category))
+		if err != nil {
+			restoreErr = err
+			return match
+		}
+		return replaceDigits(match, digits)
+	})
+	if restoreErr != nil {
+		return "", fmt.Errorf("failed to decrypt surrogate: %w", restoreErr)
+	}
+	return restored, nil
+}
+
+// surrogateDigits lists the digits of the record's surrogates.
+func (r *FPERecord) surrogateDigits() []string {
+	if r == nil {
+		return nil
+	}
+	digits := make([]string, 0, len(r.Surrogates))
+	for d := range r.Surrogates {
+		digits = append(digits, d)
+	}
+	sort.Strings(digits)
+	return digits
+}
+
+// stripSurrogates drops findings that are a surrogate the gateway issued:
+// either its digits or, regardless of case, the whole value.
+func stripSurrogates(findings []Finding, surrogates []string) []Finding {
+	if len(surrogates) == 0 {
+		return findings
+	}
+	issued := make(map[string]bool, len(surrogates))
+	for _, s := range surrogates {
+		issued[strings.ToLower(s)] = true
+	}
+	kept := findings[:0]
+	for _, f := range findings {
+		if !issued[onlyDigits(f.Value)] && !issued[strings.ToLower(f.Value)] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestSplit_FPESurrogates(t *testing.T) {
+	for _, mode := range []string{crypto.ModeFF1, crypto.ModeFF31} {
+		t.Run(mode, func(t *testing.T) {
+			kms := crypto.NewMockKMS()
+			p := New(nil,
+				WithPipeline(NewPipeline(FPEScrubber(), DetectorScrubber(ScrubberPII, DefaultDetectors()))),
+				WithFPE(kms, "default-user-kek", mode),
+			)
+			prompt := "Format +61 412 345 678 nicely and check order #4410-2231-77 for jane@example.com."
+			result, err := p.Split(&types.AuraGatewayRequest{Prompt: prompt, RequestedModel: "m"})
+			if err != nil {
+				t.Fatalf("Split failed: %v", err)
+			}
+
+			shape := regexp.MustCompile(`^Format \+\d{2} \d{3} \d{3} \d{3} nicely and check order #\d{4}-\d{4}-\d{2} for \[EMAIL_1\]\.$`)
+			sent := result.ZoneA.Messages[0].Content
+			if !shape.MatchString(sent) || strings.Contains(sent, "412 345 678") || strings.Contains(sent, "4410-2231-77") {
+				t.Fatalf("surrogates do not keep the format or leak the value: %q", sent)
+			}
+			if len(result.Surrogates) != 2 {
+				t.Errorf("Surrogates = %v", result.Surrogates)
+			}
+
+			var zoneB ZoneBContext
+			if err := json.Unmarshal(result.ZoneB, &zoneB); err != nil {
+				t.Fatal(err)
+			}
+			if zoneB.FPE == nil || zoneB.FPE.Mode != mode || len(zoneB.FPE.Surrogates) != 2 {
+				t.Fatalf("unexpected FPE record %+v", zoneB.FPE)
+			}
+
+			// The model reformats the phone number; its digits still decrypt.
+			phone := regexp.MustCompile(`\+\d{2} \d{3} \d{3} \d{3}`).FindString(sent)
+			digits := onlyDigits(phone)
+			reply := "Sure: (" + digits[:2] + ") " + digits[2:5] + "-" + digits[5:8] + "-" + digits[8:] + "."
+			restored, err := RestoreSurrogates(reply, zoneB.FPE, kms)
+			if err != nil {
+				t.Fatalf("RestoreSurrogates failed: %v", err)
+			}
+			if restored != "Sure: (61) 412-345-678." {
+				t.Errorf("got %q", restored)
+			}
+
+			if _, findings := ScanOutput(reply, LeakActionFlag, result.Surrogates...); len(findings) != 0 {
+				t.Errorf("the output scan flagged a surrogate: %+v", findings)
+			}
+		})
+	}
+}
+
+func TestFPEScrubber_WithoutKeyUsesPlaceholders(t *testing.T) {
+	sc := &ScrubContext{Pseudonymizer: NewPseudonymizer()}
+	msg, _ := FPEScrubber().Scrub(types.Message{Content: "Call 0412 345 678 about invoice no. 99812345."}, sc)
+	if want := "Call [PHONE_1] about invoice no. [ORDER_NUMBER_1]."; msg.Content != want {
+		t.Errorf("got %q, want %q", msg.Content, want)
+	}
+}
+
+func TestSplit_FPEPerUserKEK(t *testing.T) {
+	kms := crypto.NewMockKMS()
+	keks := crypto.NewKEKRegistry(kms, crypto.KEKScopeUser, nil)
+	p := New(nil,
+		WithPipeline(NewPipeline(FPEScrubber())),
+		WithFPE(kms, "default-user-kek", crypto.ModeFF1),
+		WithKEKRegistry(keks),
+	)
+	result, err := p.Split(&types.AuraGatewayRequest{UserID: "user_abc", Prompt: "Call 0412 345 678.", RequestedModel: "m"})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	var zoneB ZoneBContext
+	if err := json.Unmarshal(result.ZoneB, &zoneB); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := keks.KEKID("user_abc", nil)
+	if zoneB.FPE == nil || zoneB.FPE.KEKID != want {
+		t.Fatalf("unexpected FPE record %+v, want KEK %s", zoneB.FPE, want)
+	}
+	restored, err := RestoreSurrogates(result.ZoneA.Messages[0].Content, zoneB.FPE, kms)
+	if err != nil || restored != "Call 0412 345 678." {
+		t.Errorf("RestoreSurrogates = %q, %v", restored, err)
+	}
+
+	if _, err := p.Split(&types.AuraGatewayRequest{Prompt: "Call 0412 345 678.", RequestedModel: "m"}); err == nil {
+		t.Error("expected an error for a request without a user ID")
+	}
+
+	// A preview never provisions a KEK.
+	preview, err := p.Preview(&types.AuraGatewayRequest{UserID: "user_new", Prompt: "Call 0412 345 678.", RequestedModel: "m"})
+	if err != nil {
+		t.Fatalf("Preview failed: %v", err)
+	}
+	if strings.Contains(preview.ZoneA.Messages[0].Content, "0412 345 678") {
+		t.Errorf("preview leaked the phone number: %q", preview.ZoneA.Messages[0].Content)
+	}
+	if !reflect.DeepEqual(preview.Randomized, []string{"fpe"}) {
+		t.Errorf("Randomized = %v, want [fpe]", preview.Randomized)
+	}
+	kekID, _ := keks.KEKID("user_new", nil)
+	if _, err := kms.Wrap(make([]byte, 16), kekID); err == nil {
+		t.Error("the preview created a KEK")
+	}
+}
@@ -0,0 +1,291 @@
+package processor
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+const (
+	CategoryAUTFN        Category = "AU_TFN"
+	CategoryAUMedicare   Category = "AU_MEDICARE"
+	CategoryAUABN        Category = "AU_ABN"
+	CategoryEUVAT        Category = "EU_VAT"
+	CategoryEUNationalID Category = "EU_NATIONAL_ID"
+	CategoryUSSSN        Category = "US_SSN"
+)
+
+// Locales with an identifier pack.
+const (
+	LocaleAU = "AU"
+	LocaleEU = "EU"
+	LocaleUS = "US"
+)
+
+// ScrubberLocale names the scrubber that applies the request's locale pack.
+const ScrubberLocale = "locale"
+
+// euCountries are the EU member states, by ISO 3166-1 alpha-2 code. Greece is
+// also listed under EL, the code it uses for VAT.
+var euCountries = map[string]bool{
+	"AT": true, "BE": true, "BG": true, "HR": true, "CY": true, "CZ": true, "DK": true,
+	"EE": true, "FI": true, "FR": true, "DE": true, "GR": true, "EL": true, "HU": true,
+	"IE": true, "IT": true, "LV": true, "LT": true, "LU": true, "MT": true, "NL": true,
+	"PL": true, "PT": true, "RO": true, "SK": true, "SI": true, "ES": true, "SE": true,
+}
+
+var (
+	abnPattern      = regexp.MustCompile(`\b\d{2} ?\d{3} ?\d{3} ?\d{3}\b`)
+	medicarePattern = regexp.MustCompile(`\b[2-6]\d{3} ?\d{5} ?\d(?:[ /\-]?[1-9])?\b`)
+	tfnPattern      = regexp.MustCompile(`\b\d{3}[ \-]?\d{3}[ \-]?\d{2,3}\b`)
+
+	// VAT numbers carry their country prefix; only countries with a
+	// published check-digit algorithm are recognised.
+	vatPattern = regexp.MustCompile(`\b(?:ATU\d{8}|BE ?[01]\d{9}|DE ?\d{9}|FR ?\d{2} ?\d{9}|IT ?\d{11}|NL ?\d{9}B\d{2})\b`)
+	// French NIR: sex, birth year and month, department (2A/2B for Corsica),
+	// commune, order number and a two-digit key.
+	nirPattern = regexp.MustCompile(`\b[12] ?\d{2} ?\d{2} ?(?:\d{2}|2[AB]) ?\d{3} ?\d{3} ?\d{2}\b`)
+	// Belgian national register number: birth date, order number and key.
+	belgianIDPattern = regexp.MustCompile(`\b\d{2}\.?\d{2}\.?\d{2}-?\d{3}\.?\d{2}\b`)
+	// Spanish DNI and NIE.
+	spanishIDPattern = regexp.MustCompile(`\b[XYZ]?-?\d{7,8}-?[A-Z]\b`)
+	// Dutch BSN, bare or dotted.
+	bsnPattern = regexp.MustCompile(`\b(?:\d{9}|\d{4}\.\d{2}\.\d{3})\b`)
+
+	ssnPattern = regexp.MustCompile(`\b\d{3}([ \-])\d{2}([ \-])\d{4}\b`)
+)
+
+// LocaleDetectors returns the identifier pack for locale, in priority order,
+// or nil when there is none. Locale is one of LocaleAU, LocaleEU and LocaleUS;
+// anything else, including a member state's code, goes through ResolveLocale.
+func LocaleDetectors(locale string) []Detector {
+	switch ResolveLocale(locale) {
+	case LocaleAU:
+		return []Detector{
+			{Category: CategoryAUABN, Pattern: abnPattern, Validate: validABN},
+			{Category: CategoryAUMedicare, Pattern: medicarePattern, Validate: validMedicare},
+			{Category: CategoryAUTFN, Pattern: tfnPattern, Validate: validTFN},
+		}
+	case LocaleEU:
+		return []Detector{
+			{Category: CategoryEUVAT, Pattern: vatPattern, Validate: validEUVAT},
+			{Category: CategoryEUNationalID, Pattern: nirPattern, Validate: validNIR},
+			{Category: CategoryEUNationalID, Pattern: belgianIDPattern, Validate: validBelgianID},
+			{Category: CategoryEUNationalID, Pattern: spanishIDPattern, Validate: validSpanishID},
+			{Category: CategoryEUNationalID, Pattern: bsnPattern, Validate: validBSN},
+		}
+	case LocaleUS:
+		return []Detector{
+			{Category: CategoryUSSSN, Pattern: ssnPattern, Validate: validSSN},
+		}
+	}
+	return nil
+}
+
+// ResolveLocale maps a locale tag ("en-AU"), country code ("DE") or region
+// ("EU") to the locale pack that covers it, or "" when none does.
+func ResolveLocale(s string) string {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if i := strings.LastIndexAny(s, "-_"); i >= 0 {
+		s = s[i+1:]
+	}
+	switch {
+	case s == LocaleAU, s == LocaleEU, s == LocaleUS:
+		return s
+	case euCountries[s]:
+		return LocaleEU
+	}
+	return ""
+}
+
+// RequestLocale picks the locale pack for a request: the explicit locale
+// field wins over the residency policy.
+func RequestLocale(req *types.AuraGatewayRequest) string {
+	if req == nil {
+		return ""
+	}
+	if locale := ResolveLocale(req.Locale); locale != "" {
+		return locale
+	}
+	return ResolveLocale(req.Policy.Residency)
+}
+
+// LocaleScrubber replaces the identifiers of the request's locale pack. It
+// should run before the generic detectors, which would otherwise claim a TFN
+// as a phone number.
+func LocaleScrubber() Scrubber {
+	return funcScrubber{name: ScrubberLocale, identifiers: true, find: func(text string, sc *ScrubContext) []Finding {
+		detectors := LocaleDetectors(RequestLocale(sc.Request))
+		if detectors == nil {
+			return nil
+		}
+		return Detect(text, detectors)
+	}}
+}
+
+// weightedSum multiplies each digit by the matching weight and adds them up.
+func weightedSum(digits string, weights []int) int {
+	sum := 0
+	for i, w := range weights {
+		sum += int(digits[i]-'0') * w
+	}
+	return sum
+}
+
+// validTFN checks the mod-11 weighting of 8 and 9 digit tax file numbers.
+func validTFN(match string) bool {
+	digits := onlyDigits(match)
+	switch len(digits) {
+	case 8:
+		return weightedSum(digits, []int{10, 7, 8, 4, 6, 3, 5, 1})%11 == 0
+	case 9:
+		return weightedSum(digits, []int{1, 4, 3, 7, 5, 8, 6, 9, 10})%11 == 0
+	}
+	return false
+}
+
+// validMedicare checks the ninth digit of a Medicare card number, which may
+// be followed by the issue number and the individual reference number.
+func validMedicare(match string) bool {
+	digits := onlyDigits(match)
+	if len(digits) < 10 {
+		return false
+	}
+	return weightedSum(digits, []int{1, 3, 7, 9, 1, 3, 7, 9})%10 == int(digits[8]-'0')
+}
+
+// validABN checks the mod-89 weighting of an Australian Business Number,
+// computed after subtracting one from the first digit.
+func validABN(match string) bool {
+	digits := []byte(onlyDigits(match))
+	if len(digits) != 11 || digits[0] == '0' {
+		return false
+	}
+	digits[0]--
+	return weightedSum(string(digits), []int{10, 1, 3, 5, 7, 9, 11, 13, 15, 17, 19})%89 == 0
+}
+
+// validEUVAT dispatches on the country prefix to that country's check.
+func validEUVAT(match string) bool {
+	compact := strings.ReplaceAll(match, " ", "")
+	country, number := compact[:2], compact[2:]
+	switch country {
+	case "AT":
+		// U followed by seven digits and a Luhn-like check digit offset by 4.
+		d := number[1:]
+		sum := 0
+		for i := 0; i < 7; i++ {
+			v := int(d[i] - '0')
+			if i%2 == 1 {
+				v *= 2
+				v = v/10 + v%10
+			}
+			sum += v
+		}
+		return (10-(sum+4)%10)%10 == int(d[7]-'0')
+	case "BE":
+		first, _ := strconv.Atoi(number[:8])
+		check, _ := strconv.Atoi(number[8:])
+		return 97-first%97 == check
+	case "DE":
+		return iso7064Mod1110(number)
+	case "FR":
+		siren, _ := strconv.Atoi(number[2:])
+		key, _ := strconv.Atoi(number[:2])
+		return (12+3*(siren%97))%97 == key
+	case "IT":
+		return luhnValid(number)
+	case "NL":
+		// Since 2020 the whole number, letters included, passes mod 97;
+		// older numbers pass an eleven-test on the first nine digits.
+		return mod97(country+number) == 1 ||
+			weightedSum(number, []int{9, 8, 7, 6, 5, 4, 3, 2})%11 == int(number[8]-'0')
+	}
+	return false
+}
+
+// iso7064Mod1110 checks the last digit of number with ISO 7064 MOD 11,10.
+func iso7064Mod1110(number string) bool {
+	product := 10
+	for i := 0; i < len(number)-1; i++ {
+		sum := (int(number[i]-'0') + product) % 10
+		if sum == 0 {
+			sum = 10
+		}
+		product = 2 * sum % 11
+	}
+	check := 11 - product
+	if check == 10 {
+		check = 0
+	}
+	return check == int(number[len(number)-1]-'0')
+}
+
+// validNIR checks the key of a French social security number. Corsican
+// departments 2A and 2B count as 19 and 18.
+func validNIR(match string) bool {
+	compact := strings.ReplaceAll(match, " ", "")
+	body := strings.NewReplacer("2A", "19", "2B", "18").Replace(compact[:13])
+	n, err := strconv.ParseInt(body, 10, 64)
+	if err != nil {
+		return false
+	}
+	key, _ := strconv.ParseInt(compact[13:], 10, 64)
+	return 97-n%97 == key
+}
+
+// validBelgianID checks the key of a national register number, which for
+// people born since 2000 is computed with a leading 2.
+func validBelgianID(match string) bool {
+	digits := onlyDigits(match)
+	if len(digits) != 11 {
+		return false
+	}
+	body, _ := strconv.ParseInt(digits[:9], 10, 64)
+	key, _ := strconv.ParseInt(digits[9:], 10, 64)
+	return 97-body%97 == key || 97-(2_000_000_000+body)%97 == key
+}
+
+// validSpanishID checks the control letter of a DNI or NIE.
+func validSpanishID(match string) bool {
+	compact := strings.ReplaceAll(match, "-", "")
+	number, letter := compact[:len(compact)-1], compact[len(compact)-1]
+	if len(number) != 8 {
+		return false
+	}
+	// An NIE's leading X, Y or Z stands for 0, 1 or 2.
+	if prefix := strings.IndexByte("XYZ", number[0]); prefix >= 0 {
+		number = strconv.Itoa(prefix) + number[1:]
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return false
+	}
+	return "TRWAGMYFPDXBNJZSQVHLCKE"[n%23] == letter
+}
+
+// validBSN applies the Dutch eleven-test, in which the last digit weighs -1.
+func validBSN(match string) bool {
+	digits := onlyDigits(match)
+	if len(digits) != 9 || digits == "000000000" {
+		return false
+	}
+	return (weightedSum(digits, []int{9, 8, 7, 6, 5, 4, 3, 2})-int(digits[8]-'0'))%11 == 0
+}
+
+// validSSN rejects numbers the Social Security Administration never issues.
+// SSNs have no check digit, so the separators must also be consistent.
+func validSSN(match string) bool {
+	m := ssnPattern.FindStringSubmatch(match)
+	if m == nil || m[1] != m[2] {
+		return false
+	}
+	digits := onlyDigits(match)
+	area, group, serial := digits[:3], digits[3:5], digits[5:]
+	if area == "000" || area == "666" || area[0] == '9' {
+		return false
+	}
+	return group != "00" && serial != "0000"
+}
@@ -0,0 +1,98 @@
+package processor
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// TestLocaleCorpora runs each locale pack over its corpus in testdata/locales.
+func TestLocaleCorpora(t *testing.T) {
+	for _, locale := range []string{LocaleAU, LocaleEU, LocaleUS} {
+		t.Run(locale, func(t *testing.T) {
+			f, err := os.Open(filepath.Join("testdata", "locales", strings.ToLower(locale)+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			detectors := LocaleDetectors(locale)
+			scanner := bufio.NewScanner(f)
+			for line := 1; scanner.Scan(); line++ {
+				if scanner.Text() == "" || strings.HasPrefix(scanner.Text(), "#") {
+					continue
+				}
+				category, sample, ok := strings.Cut(scanner.Text(), "\t")
+				if !ok {
+					t.Fatalf("line %d: missing tab", line)
+				}
+				start, end := strings.Index(sample, "{"), strings.Index(sample, "}")
+				text := strings.NewReplacer("{", "", "}", "").Replace(sample)
+
+				findings := Detect(text, detectors)
+				if category == "NONE" {
+					if len(findings) != 0 {
+						t.Errorf("line %d: unexpected findings %+v in %q", line, findings, text)
+					}
+					continue
+				}
+				want := sample[start+1 : end]
+				if len(findings) != 1 || findings[0].Value != want || string(findings[0].Category) != category {
+					t.Errorf("line %d: got %+v, want %s %q", line, findings, category, want)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	tests := map[string]string{
+		"AU":    LocaleAU,
+		"en-AU": LocaleAU,
+		"eu":    LocaleEU,
+		"de_DE": LocaleEU,
+		"FR":    LocaleEU,
+		"en-US": LocaleUS,
+		"en-GB": "",
+		"":      "",
+	}
+	for in, want := range tests {
+		if got := ResolveLocale(in); got != want {
+			t.Errorf("ResolveLocale(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSplitAndScrub_LocalePack(t *testing.T) {
+	prompt := "My TFN is 123 456 782."
+	tests := []struct {
+		name string
+		req  types.AuraGatewayRequest
+		want string
+	}{
+		{"from residency", types.AuraGatewayRequest{Policy: types.Policy{Residency: "AU"}}, "My TFN is [AU_TFN_1]."},
+		{"locale wins over residency", types.AuraGatewayRequest{Locale: "en-AU", Policy: types.Policy{Residency: "EU"}}, "My TFN is [AU_TFN_1]."},
+		{"other locale", types.AuraGatewayRequest{Policy: types.Policy{Residency: "US"}}, "My TFN is [PHONE_1]."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := tt.req
+			req.Prompt = prompt
+			req.RequestedModel = "m"
+			zoneA, _, err := SplitAndScrub(&req)
+			if err != nil {
+				t.Fatalf("SplitAndScrub failed: %v", err)
+			}
+			if got := zoneA.Messages[0].Content; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package processor
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// minSpacedRun is the number of single characters separated by single spaces,
+// as in "j o h n", from which the spaces are ignored for detection.
+const minSpacedRun = 4
+
+// confusables maps Cyrillic and Greek letters that render like Latin ones to
+// the Latin letter, so that "jаne@example.com" with a Cyrillic "а" is still
+// detected. NFKC does not do this; it only covers compatibility forms.
+var confusables = map[rune]rune{
+	// Cyrillic.
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x',
+	'ѕ': 's', 'і': 'i', 'ј': 'j', 'ԁ': 'd', 'һ': 'h', 'ԛ': 'q', 'ԝ': 'w', 'ӏ': 'l',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P',
+	'С': 'C', 'Т': 'T', 'Х': 'X', 'У': 'Y', 'Ѕ': 'S', 'І': 'I', 'Ј': 'J',
+	// Greek.
+	'α': 'a', 'ο': 'o', 'ν': 'v', 'ρ': 'p', 'ι': 'i', 'κ': 'k',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K', 'Μ': 'M',
+	'Ν': 'N', 'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	// Latin lookalikes outside ASCII.
+	'ı': 'i', 'ȷ': 'j', 'ɑ': 'a', 'ɡ': 'g',
+}
+
+// Normalize returns s as the detectors see it: NFKC-normalized, without
+// invisible characters, with confusable letters mapped to Latin and with the
+// spaces dropped from spaced-out runs such as "j o h n".
+func Normalize(s string) string {
+	normalized, _ := normalizeWithOffsets(s)
+	return normalized
+}
+
+// normPiece is the normalized form of one rune of the original text.
+type normPiece struct {
+	text   string
+	offset int
+}
+
+// normalizeWithOffsets normalizes s as Normalize does. offsets[i] is the byte
+// offset in s of the rune that produced normalized byte i, and
+// offsets[len(normalized)] is len(s), as for foldWithOffsets.
+func normalizeWithOffsets(s string) (string, []int) {
+	pieces := make([]normPiece, 0, len(s))
+	for i, r := range s {
+		if isInvisible(r) {
+			continue
+		}
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		pieces = append(pieces, normPiece{text: norm.NFKC.String(string(r)), offset: i})
+	}
+	pieces = collapseSpacedOut(pieces)
+
+	var b strings.Builder
+	offsets := make([]int, 0, len(s)+1)
+	for _, p := range pieces {
+		for j := 0; j < len(p.text); j++ {
+			offsets = append(offsets, p.offset)
+		}
+		b.WriteString(p.text)
+	}
+	offsets = append(offsets, len(s))
+	return b.String(), offsets
+}
+
+// isInvisible reports whether r renders as nothing: format characters such
+// as zero-width spaces, joiners and bidi controls, variation selectors and
+// the combining grapheme joiner.
+func isInvisible(r rune) bool {
+	return unicode.Is(unicode.Cf, r) || unicode.Is(unicode.Variation_Selector, r) || r == '\u034f'
+}
+
+// collapseSpacedOut drops the single spaces inside runs of at least
+// minSpacedRun single characters, turning "j o h n @ x . i o" into "john@x.io".
+func collapseSpacedOut(pieces []normPiece) []normPiece {
+	isSpace := func(i int) bool { return i < 0 || i >= len(pieces) || pieces[i].text == " " }
+	isSingle := func(i int) bool { return !isSpace(i) && isSpace(i-1) && isSpace(i+1) }
+
+	drop := make(map[int]bool)
+	for i := 0; i < len(pieces); i++ {
+		if !isSingle(i) {
+			continue
+		}
+		end := i
+		for end+2 < len(pieces) && pieces[end+1].text == " " && isSingle(end+2) {
+			end += 2
+		}
+		if (end-i)/2+1 >= minSpacedRun {
+			for j := i + 1; j < end; j += 2 {
+				drop[j] = true
+			}
+		}
+		i = end
+	}
+	if len(drop) == 0 {
+		return pieces
+	}
+	kept := pieces[:0]
+	for i, p := range pieces {
+		if !drop[i] {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// originalSpan maps the normalized byte range [start, end) back onto the
+// original text. A range ending inside the expansion of one rune, such as
+// the "f" of a normalized "ﬁ", is widened to cover that whole rune.
+func originalSpan(original string, offsets []int, start, end int) (int, int) {
+	origStart, origEnd := offsets[start], offsets[end]
+	if end > 0 && end < len(offsets)-1 && offsets[end] == offsets[end-1] {
+		_, size := utf8.DecodeRuneInString(original[origEnd:])
+		origEnd += size
+	}
+	return origStart, origEnd
+}
+
+// findNormalized runs find over the normalized form of text and maps the
+// findings back onto text, so that only the original content is ever replaced.
+func findNormalized(text string, find func(normalized string) []Finding) []Finding {
+	normalized, offsets := normalizeWithOffsets(text)
+	findings := find(normalized)
+	if normalized == text {
+		return findings
+	}
+	for i, f := range findings {
+		start, end := originalSpan(text, offsets, f.Start, f.End)
+		findings[i].Start, findings[i].End, findings[i].Value = start, end, text[start:end]
+	}
+	return findings
+}
@@ -0,0 +1,94 @@
+package processor
+
+import (
+	"testing"
+	"unicode/utf8"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestNormalize(t *testing.T) {
+	tests := map[string]string{
+		"０４１２ ３４５ ６７８":                  "0412 345 678",
+		"ja​ne@exa⁠mple.com":            "jane@example.com",
+		"jаnе@еxample.com":              "jane@example.com", // Cyrillic а and е
+		"ｊａｎｅ＠ｅｘａｍｐｌｅ．ｃｏｍ":              "jane@example.com",
+		"mail j o h n @ x . i o please": "mail john@x.io please",
+		"a b c is fine":                 "a b c is fine",
+	}
+	for in, want := range tests {
+		if got := Normalize(in); got != want {
+			t.Errorf("Normalize(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestScrub_ObfuscatedIdentifiers(t *testing.T) {
+	tests := []struct {
+		name, prompt, want string
+	}{
+		{"full-width digits", "Call ０４１２ ３４５ ６７８ now", "Call [PHONE_1] now"},
+		{"zero-width joiner", "Mail ja‍ne@example.com now", "Mail [EMAIL_1] now"},
+		{"homoglyph", "Mail jаne@example.com now", "Mail [EMAIL_1] now"},
+		{"spaced out", "Mail j o h n @ e x a m p l e . c o m now", "Mail [EMAIL_1] now"},
+		{"untouched content", "Ｈｅｌｌｏ​ ｗｏｒｌｄ", "Ｈｅｌｌｏ​ ｗｏｒｌｄ"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := New(nil).Split(&types.AuraGatewayRequest{Prompt: tt.prompt, RequestedModel: "m"})
+			if err != nil {
+				t.Fatalf("Split failed: %v", err)
+			}
+			if got := result.ZoneA.Messages[0].Content; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// Redaction offsets must describe the text the user sent: applying
+			// them to the prompt reproduces the Zone A content.
+			if got := applyRedactions(tt.prompt, result.Redactions); got != tt.want {
+				t.Errorf("redactions applied to the prompt give %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func applyRedactions(text string, redactions []types.Redaction) string {
+	runes := []rune(text)
+	for i := len(redactions) - 1; i >= 0; i-- {
+		r := redactions[i]
+		runes = append(runes[:r.Start], append([]rune(r.Replacement), runes[r.End:]...)...)
+	}
+	return string(runes)
+}
+
+func TestScrub_RedactionOffsetsReferToOriginal(t *testing.T) {
+	prompt := "Hi ｊａｎｅ＠ｅｘａｍｐｌｅ．ｃｏｍ and jane@example.com"
+	result, err := New(nil).Split(&types.AuraGatewayRequest{Prompt: prompt, RequestedModel: "m"})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if want := "Hi [EMAIL_1] and [EMAIL_1]"; result.ZoneA.Messages[0].Content != want {
+		t.Errorf("got %q, want %q", result.ZoneA.Messages[0].Content, want)
+	}
+	if len(result.Redactions) != 2 {
+		t.Fatalf("expected 2 redactions, got %+v", result.Redactions)
+	}
+	first := result.Redactions[0]
+	if first.Start != 3 || first.End != 3+utf8.RuneCountInString("ｊａｎｅ＠ｅｘａｍｐｌｅ．ｃｏｍ") {
+		t.Errorf("unexpected offsets %+v", first)
+	}
+}
+
+func TestFindTerms_Confusables(t *testing.T) {
+	terms := []Term{{Category: CategoryPerson, Value: "Jane Doe"}}
+	findings := FindTerms("Ask Jаne​ Doe", terms) // Cyrillic а
+	if len(findings) != 1 || findings[0].Value != "Jаne​ Doe" {
+		t.Errorf("unexpected findings %+v", findings)
+	}
+}
+
+func TestScanOutput_Obfuscated(t *testing.T) {
+	out, findings := ScanOutput("Reach me at ｊａｎｅ＠ｅｘａｍｐｌｅ．ｃｏｍ.", LeakActionRedact)
+	if len(findings) != 1 || out != "Reach me at [REDACTED_EMAIL]." {
+		t.Errorf("got %q, %+v", out, findings)
+	}
+}
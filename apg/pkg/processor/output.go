@@ -0,0 +1,77 @@
+package processor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// LeakAction decides what happens when identifiers are found in model output.
+type LeakAction string
+
+const (
+	// LeakActionBlock withholds the whole response.
+	LeakActionBlock LeakAction = "block"
+	// LeakActionRedact replaces each finding with a [REDACTED_<CATEGORY>] marker.
+	LeakActionRedact LeakAction = "redact"
+	// LeakActionFlag returns the response unchanged and only records the findings.
+	LeakActionFlag LeakAction = "flag"
+)
+
+// ParseLeakAction validates a configured leak action.
+func ParseLeakAction(s string) (LeakAction, error) {
+	switch action := LeakAction(strings.ToLower(strings.TrimSpace(s))); action {
+	case LeakActionBlock, LeakActionRedact, LeakActionFlag:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown output leak action %q: want block, redact or flag", s)
+	}
+}
+
+// ScanOutput scans model output with the default pipeline and no request, so
+// only the generic PII detectors apply. See Processor.ScanOutput.
+func ScanOutput(text string, action LeakAction, surrogates ...string) (string, []Finding) {
+	return defaultProcessor.ScanOutput(text, nil, action, surrogates...)
+}
+
+// ScanOutput runs the identifier detectors of the configured pipeline over
+// model output: the pattern detectors, the locale pack of req and the word
+// lists, and then the default PII detectors, which scan output even when the
+// pipeline leaves them out. It must be called before rehydration: at that
+// point the output can only contain placeholders, so any identifier found
+// was invented or leaked by the model. With LeakActionRedact the findings
+// are replaced in the returned text; the other actions leave the text
+// untouched and leave the decision to the caller. Findings that are one of
+// surrogates, the FPE and realistic surrogates sent with the request, are
+// the gateway's own and are not reported.
+func (p *Processor) ScanOutput(text string, req *types.AuraGatewayRequest, action LeakAction, surrogates ...string) (string, []Finding) {
+	sc := &ScrubContext{Request: req}
+	findings := findNormalized(text, func(normalized string) []Finding {
+		findings := p.pipeline.findIdentifiers(normalized, sc)
+		for _, f := range Detect(normalized, DefaultDetectors()) {
+			if !overlapsAny(findings, f.Start, f.End) {
+				findings = append(findings, f)
+			}
+		}
+		sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+		return findings
+	})
+	findings = stripSurrogates(findings, surrogates)
+	if len(findings) == 0 || action != LeakActionRedact {
+		return text, findings
+	}
+
+	// Markers deliberately differ from placeholders: a [EMAIL_1] here would be
+	// rehydrated into the user's own address.
+	var b strings.Builder
+	last := 0
+	for _, f := range findings {
+		b.WriteString(text[last:f.Start])
+		b.WriteString("[REDACTED_" + string(f.Category) + "]")
+		last = f.End
+	}
+	b.WriteString(text[last:])
+	return b.String(), findings
+}
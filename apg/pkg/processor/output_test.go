@@ -0,0 +1,77 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestScanOutput(t *testing.T) {
+	text := "Contact [EMAIL_1] or support@example.org, card 4111 1111 1111 1111."
+
+	redacted, findings := ScanOutput(text, LeakActionRedact)
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %+v", findings)
+	}
+	want := "Contact [EMAIL_1] or [REDACTED_EMAIL], card [REDACTED_CREDIT_CARD]."
+	if redacted != want {
+		t.Errorf("ScanOutput(redact) = %q, want %q", redacted, want)
+	}
+
+	for _, action := range []LeakAction{LeakActionFlag, LeakActionBlock} {
+		got, findings := ScanOutput(text, action)
+		if got != text {
+			t.Errorf("ScanOutput(%s) should not modify the text, got %q", action, got)
+		}
+		if len(findings) != 2 {
+			t.Errorf("ScanOutput(%s) expected 2 findings, got %d", action, len(findings))
+		}
+	}
+
+	if _, findings := ScanOutput("Dear [PERSON_1], all the best.", LeakActionRedact); len(findings) != 0 {
+		t.Errorf("placeholders must not be reported as leaks, got %+v", findings)
+	}
+}
+
+func TestProcessor_ScanOutputUsesPipeline(t *testing.T) {
+	// The pipeline leaves out the generic detectors, which still scan output.
+	p := New(nil, WithPipeline(NewPipeline(
+		WordListScrubber("practitioners", "PRACTITIONERS", []string{"Dr Quill"}),
+		LocaleScrubber(),
+	)))
+	text := "Ask Dr Quill about TFN 123 456 782 or SSN 123-45-6789, or mail a@example.org."
+
+	au := &types.AuraGatewayRequest{Locale: "en-AU"}
+	_, findings := p.ScanOutput(text, au, LeakActionFlag)
+	var categories []Category
+	for _, f := range findings {
+		categories = append(categories, f.Category)
+	}
+	want := []Category{"PRACTITIONERS", CategoryAUTFN, CategoryPhone, CategoryEmail}
+	if len(categories) != len(want) {
+		t.Fatalf("AU findings = %v, want %v", categories, want)
+	}
+	for i := range want {
+		if categories[i] != want[i] {
+			t.Errorf("AU findings = %v, want %v", categories, want)
+			break
+		}
+	}
+
+	us := &types.AuraGatewayRequest{Locale: "en-US"}
+	redacted, _ := p.ScanOutput(text, us, LeakActionRedact)
+	if want := "Ask [REDACTED_PRACTITIONERS] about TFN [REDACTED_PHONE] or SSN [REDACTED_US_SSN], or mail [REDACTED_EMAIL]."; redacted != want {
+		t.Errorf("US redaction = %q, want %q", redacted, want)
+	}
+}
+
+func TestParseLeakAction(t *testing.T) {
+	for _, s := range []string{"block", "Redact", " flag "} {
+		if _, err := ParseLeakAction(s); err != nil {
+			t.Errorf("ParseLeakAction(%q) failed: %v", s, err)
+		}
+	}
+	if _, err := ParseLeakAction("ignore"); err == nil {
+		t.Error("expected an error for an unknown action")
+	}
+}
@@ -0,0 +1,339 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Zone is the side of the two-zone split a data element belongs to.
+type Zone string
+
+const (
+	// ZoneA data may be sent to the external model provider.
+	ZoneA Zone = "A"
+	// ZoneB data never leaves the Sacred Shifter infrastructure.
+	ZoneB Zone = "B"
+)
+
+// Transform is applied to a field before its value may enter Zone A.
+type Transform string
+
+const (
+	TransformNone  Transform = "none"
+	TransformScrub Transform = "scrub"
+	TransformRound Transform = "round"
+	TransformFuzz  Transform = "fuzz"
+	// TransformSummarize keeps only the most informative sentences of a
+	// promoted Context value, scrubbed, within a character budget.
+	TransformSummarize Transform = "summarize"
+	// TransformRetrieve promotes, scrubbed, only the items of a Context
+	// collection most relevant to the prompt.
+	TransformRetrieve Transform = "retrieve"
+	// TransformAbstract promotes only counts, a date range and topic and
+	// sentiment tags derived from a Context collection, never its text.
+	TransformAbstract Transform = "abstract"
+)
+
+// Request fields a classification rule can refer to.
+const (
+	FieldPrompt         = "prompt"
+	FieldRequestedModel = "requestedModel"
+	FieldUserID         = "userId"
+	FieldCircleID       = "circleId"
+	FieldContext        = "context"
+	FieldTimestamp      = "timestamp"
+	FieldLocation       = "location"
+)
+
+// zoneAFields lists the fields a policy may place in Zone A. Identifiers such
+// as userId are deliberately absent: no policy file can send them to a provider.
+var zoneAFields = map[string]bool{
+	FieldPrompt:         true,
+	FieldRequestedModel: true,
+	FieldTimestamp:      true,
+	FieldLocation:       true,
+}
+
+// fieldTransforms lists the transforms that make sense for each Zone A field.
+var fieldTransforms = map[string][]Transform{
+	FieldPrompt:         {TransformScrub, TransformNone},
+	FieldRequestedModel: {TransformNone},
+	FieldTimestamp:      {TransformRound},
+	FieldLocation:       {TransformFuzz},
+}
+
+// knownFields lists every field a rule may name.
+var knownFields = map[string]bool{
+	FieldPrompt:         true,
+	FieldRequestedModel: true,
+	FieldUserID:         true,
+	FieldCircleID:       true,
+	FieldContext:        true,
+	FieldTimestamp:      true,
+	FieldLocation:       true,
+}
+
+// PolicyRule is one row of the data classification table.
+type PolicyRule struct {
+	Element        string    `yaml:"element"`
+	Classification string    `yaml:"classification"`
+	Zone           Zone      `yaml:"zone"`
+	Description    string    `yaml:"description,omitempty"`
+	Field          string    `yaml:"field,omitempty"`
+	Transform      Transform `yaml:"transform,omitempty"`
+	// TransformParam refines the transform, e.g. "hour" for a round transform.
+	TransformParam string `yaml:"param,omitempty"`
+}
+
+// ClassificationPolicy decides, per request field, whether its value may go to
+// Zone A and how it must be transformed first. Rules without a Field document a
+// data element but do not drive any processing. A Zone A rule whose field is a
+// Context path, such as "context.journal.mood", promotes the values at that
+// path into Zone A; such rules must scrub.
+type ClassificationPolicy struct {
+	Rules []PolicyRule `yaml:"rules"`
+	// Source records where the policy was loaded from.
+	Source string `yaml:"-"`
+}
+
+// DefaultPolicy mirrors docs/apg/data-classification.csv and is used when no
+// policy file is configured.
+func DefaultPolicy() *ClassificationPolicy {
+	return &ClassificationPolicy{
+		Source: "builtin",
+		Rules: []PolicyRule{
+			{Element: "Core Prompt", Classification: "Model-Needed", Zone: ZoneA, Field: FieldPrompt, Transform: TransformScrub},
+			{Element: "User Name", Classification: "PII", Zone: ZoneB},
+			{Element: "User ID", Classification: "Identifier", Zone: ZoneB, Field: FieldUserID},
+			{Element: "Circle ID", Classification: "Identifier", Zone: ZoneB, Field: FieldCircleID},
+			{Element: "Journal Entry Text", Classification: "Sensitive Context", Zone: ZoneB, Field: FieldContext},
+			{Element: "Codex Content", Classification: "Sensitive Context", Zone: ZoneB, Field: FieldContext},
+			{Element: "Precise Timestamp", Classification: "PII", Zone: ZoneB, Field: FieldTimestamp},
+			{Element: "Rounded Timestamp", Classification: "Metadata", Zone: ZoneA, Field: FieldTimestamp, Transform: TransformRound, TransformParam: RoundHour},
+			{Element: "Precise Geolocation", Classification: "PII", Zone: ZoneB, Field: FieldLocation},
+			{Element: "Fuzzed Geolocation", Classification: "Metadata", Zone: ZoneA, Field: FieldLocation, Transform: TransformFuzz, TransformParam: FuzzCity},
+			{Element: "Requested Model", Classification: "Metadata", Zone: ZoneA, Field: FieldRequestedModel, Transform: TransformNone},
+			{Element: "IP Address", Classification: "Identifier", Zone: ZoneB},
+			{Element: "Internal Request ID", Classification: "Internal Metadata", Zone: ZoneB},
+		},
+	}
+}
+
+// LoadPolicy reads a classification policy from a CSV or YAML file, chosen by
+// its extension, and validates it.
+func LoadPolicy(path string) (*ClassificationPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open policy file: %w", err)
+	}
+	defer f.Close()
+
+	var policy *ClassificationPolicy
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		policy, err = ParsePolicyCSV(f)
+	case ".yaml", ".yml":
+		policy, err = ParsePolicyYAML(f)
+	default:
+		return nil, fmt.Errorf("unsupported policy file extension %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load policy %s: %w", path, err)
+	}
+	policy.Source = path
+	return policy, nil
+}
+
+// ParsePolicyCSV parses the data-classification.csv format. The "Data Element",
+// "Classification" and "Zone" columns are required; "Description", "Field" and
+// "Transform" are optional. A transform parameter follows a colon, as in "round:hour".
+func ParsePolicyCSV(r io.Reader) (*ClassificationPolicy, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy CSV: %w", err)
+	}
+	if len(records) < 2 {
+		return nil, errors.New("policy CSV has no rules")
+	}
+
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"Data Element", "Classification", "Zone"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("policy CSV is missing the %q column", required)
+		}
+	}
+	cell := func(record []string, column string) string {
+		if i, ok := columns[column]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	policy := &ClassificationPolicy{}
+	for _, record := range records[1:] {
+		transform, param, _ := strings.Cut(cell(record, "Transform"), ":")
+		policy.Rules = append(policy.Rules, PolicyRule{
+			Element:        cell(record, "Data Element"),
+			Classification: cell(record, "Classification"),
+			Zone:           Zone(strings.ToUpper(cell(record, "Zone"))),
+			Description:    cell(record, "Description"),
+			Field:          cell(record, "Field"),
+			Transform:      Transform(strings.ToLower(transform)),
+			TransformParam: param,
+		})
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// ParsePolicyYAML parses a policy of the form
+//
+//	rules:
+//	  - element: Core Prompt
+//	    classification: Model-Needed
+//	    zone: A
+//	    field: prompt
+//	    transform: scrub
+func ParsePolicyYAML(r io.Reader) (*ClassificationPolicy, error) {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	policy := &ClassificationPolicy{}
+	if err := decoder.Decode(policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy YAML: %w", err)
+	}
+	for i := range policy.Rules {
+		policy.Rules[i].Zone = Zone(strings.ToUpper(string(policy.Rules[i].Zone)))
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks that every rule is well formed and that the policy lets the
+// prompt and model reach the provider; without them no request can be served.
+func (p *ClassificationPolicy) Validate() error {
+	if len(p.Rules) == 0 {
+		return errors.New("policy has no rules")
+	}
+	for i, rule := range p.Rules {
+		if rule.Element == "" {
+			return fmt.Errorf("rule %d: data element is empty", i+1)
+		}
+		if rule.Zone != ZoneA && rule.Zone != ZoneB {
+			return fmt.Errorf("rule %q: zone must be A or B, got %q", rule.Element, rule.Zone)
+		}
+		switch rule.Transform {
+		case "", TransformNone, TransformScrub, TransformRound, TransformFuzz, TransformSummarize, TransformRetrieve, TransformAbstract:
+		default:
+			return fmt.Errorf("rule %q: unknown transform %q", rule.Element, rule.Transform)
+		}
+		if rule.Field == "" {
+			continue
+		}
+		if isContextPath(rule.Field) {
+			if err := validateContextPath(strings.TrimPrefix(rule.Field, contextFieldPrefix)); err != nil {
+				return fmt.Errorf("rule %q: %w", rule.Element, err)
+			}
+		} else if !knownFields[rule.Field] {
+			return fmt.Errorf("rule %q: unknown field %q", rule.Element, rule.Field)
+		}
+		if rule.Zone == ZoneA && !zoneAFields[rule.Field] && !isContextPath(rule.Field) {
+			return fmt.Errorf("rule %q: field %q cannot be assigned to Zone A", rule.Element, rule.Field)
+		}
+		if rule.Zone == ZoneB {
+			if rule.Transform != "" && rule.Transform != TransformNone {
+				return fmt.Errorf("rule %q: transform %q only applies to Zone A fields", rule.Element, rule.Transform)
+			}
+			continue
+		}
+		if !allowsTransform(rule.Field, rule.Transform) {
+			return fmt.Errorf("rule %q: field %q needs one of the transforms %v", rule.Element, rule.Field, transformsFor(rule.Field))
+		}
+		if err := validateTransformParam(rule.Transform, rule.TransformParam); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Element, err)
+		}
+	}
+	for _, field := range []string{FieldPrompt, FieldRequestedModel} {
+		if _, ok := p.ZoneARule(field); !ok {
+			return fmt.Errorf("policy must assign field %q to Zone A", field)
+		}
+	}
+	return nil
+}
+
+// ID returns a short digest of the policy's rules. It changes whenever a rule
+// does, so provenance records can name the exact policy that was applied.
+func (p *ClassificationPolicy) ID() string {
+	var b strings.Builder
+	for _, rule := range p.Rules {
+		fmt.Fprintf(&b, "%s\x1f%s\x1f%s\x1f%s\x1f%s\x1f%s\x1e",
+			rule.Element, rule.Classification, rule.Zone, rule.Field, rule.Transform, rule.TransformParam)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ZoneARule returns the rule that admits field into Zone A, if any.
+func (p *ClassificationPolicy) ZoneARule(field string) (PolicyRule, bool) {
+	for _, rule := range p.Rules {
+		if rule.Field == field && rule.Zone == ZoneA {
+			return rule, true
+		}
+	}
+	return PolicyRule{}, false
+}
+
+// ZoneAFields returns the fields the policy admits into Zone A, in rule order.
+func (p *ClassificationPolicy) ZoneAFields() []string {
+	var fields []string
+	seen := make(map[string]bool)
+	for _, rule := range p.Rules {
+		if rule.Zone == ZoneA && rule.Field != "" && !seen[rule.Field] {
+			seen[rule.Field] = true
+			fields = append(fields, rule.Field)
+		}
+	}
+	return fields
+}
+
+// allowsTransform reports whether transform may be applied to a Zone A field.
+// An empty transform is treated as "none".
+func allowsTransform(field string, transform Transform) bool {
+	if transform == "" {
+		transform = TransformNone
+	}
+	for _, t := range transformsFor(field) {
+		if t == transform {
+			return true
+		}
+	}
+	return false
+}
+
+// transformsFor returns the transforms allowed for a Zone A field. Promoted
+// Context is free text from the user's records and is always scrubbed, in
+// full, in summary or for the relevant items only, unless only attributes
+// derived from it are sent.
+func transformsFor(field string) []Transform {
+	if isContextPath(field) {
+		return []Transform{TransformScrub, TransformSummarize, TransformRetrieve, TransformAbstract}
+	}
+	return fieldTransforms[field]
+}
@@ -0,0 +1,135 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestLoadPolicy_DocsCSVMatchesDefault(t *testing.T) {
+	policy, err := LoadPolicy(filepath.Join("..", "..", "..", "docs", "apg", "data-classification.csv"))
+	if err != nil {
+		t.Fatalf("LoadPolicy failed: %v", err)
+	}
+
+	def := DefaultPolicy()
+	if len(policy.Rules) != len(def.Rules) {
+		t.Fatalf("docs CSV has %d rules, DefaultPolicy has %d", len(policy.Rules), len(def.Rules))
+	}
+	for i, rule := range policy.Rules {
+		want := def.Rules[i]
+		rule.Description = ""
+		if !reflect.DeepEqual(rule, want) {
+			t.Errorf("rule %d differs from DefaultPolicy: got %+v, want %+v", i, rule, want)
+		}
+	}
+}
+
+func TestParsePolicyYAML(t *testing.T) {
+	doc := `
+rules:
+  - element: Core Prompt
+    classification: Model-Needed
+    zone: a
+    field: prompt
+    transform: none
+  - element: Requested Model
+    classification: Metadata
+    zone: A
+    field: requestedModel
+  - element: User ID
+    classification: Identifier
+    zone: B
+    field: userId
+`
+	policy, err := ParsePolicyYAML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("ParsePolicyYAML failed: %v", err)
+	}
+	if got := policy.ZoneAFields(); !reflect.DeepEqual(got, []string{FieldPrompt, FieldRequestedModel}) {
+		t.Errorf("ZoneAFields() = %v", got)
+	}
+	rule, ok := policy.ZoneARule(FieldPrompt)
+	if !ok || rule.Transform != TransformNone {
+		t.Errorf("unexpected prompt rule %+v", rule)
+	}
+}
+
+func TestParsePolicy_Malformed(t *testing.T) {
+	header := `"Data Element","Classification","Zone","Field","Transform"` + "\n"
+	base := `"Core Prompt","Model-Needed","A","prompt","scrub"` + "\n" +
+		`"Requested Model","Metadata","A","requestedModel",""` + "\n"
+
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{"missing zone column", `"Data Element","Classification"` + "\n" + `"Core Prompt","Model-Needed"` + "\n"},
+		{"bad zone", header + base + `"User ID","Identifier","C","userId",""` + "\n"},
+		{"unknown transform", header + base + `"Other","Metadata","A","","shred"` + "\n"},
+		{"unknown field", header + base + `"Other","Metadata","B","mood",""` + "\n"},
+		{"identifier in zone A", header + base + `"User ID","Identifier","A","userId",""` + "\n"},
+		{"transform on zone B", header + base + `"User ID","Identifier","B","userId","scrub"` + "\n"},
+		{"unscrubbed context path", header + base + `"Mood","Sensitive","A","context.journal.mood","none"` + "\n"},
+		{"bad summary size", header + base + `"Mood","Sensitive","A","context.journal.mood","summarize:0/400"` + "\n"},
+		{"bad retrieval size", header + base + `"Journal","Sensitive","A","context.journal","retrieve:none"` + "\n"},
+		{"empty context segment", header + base + `"Mood","Sensitive","A","context.journal..mood","scrub"` + "\n"},
+		{"prompt not in zone A", header + `"Requested Model","Metadata","A","requestedModel",""` + "\n"},
+		{"ragged row", header + base + `"Broken","PII"` + "\n"},
+		{"header only", header},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePolicyCSV(strings.NewReader(tt.csv)); err == nil {
+				t.Error("expected an error for a malformed policy")
+			}
+		})
+	}
+
+	if _, err := ParsePolicyYAML(strings.NewReader("rules:\n  - element: X\n    zon: A\n")); err == nil {
+		t.Error("expected an error for an unknown YAML key")
+	}
+}
+
+func TestLoadPolicy_UnsupportedExtension(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPolicy(path); err == nil {
+		t.Error("expected an error for a .json policy file")
+	}
+}
+
+func TestProcessor_PromptTransformFromPolicy(t *testing.T) {
+	policy := DefaultPolicy()
+	for i, rule := range policy.Rules {
+		if rule.Field == FieldPrompt {
+			policy.Rules[i].Transform = TransformNone
+		}
+	}
+	req := &types.AuraGatewayRequest{Prompt: "Mail jane@example.com", RequestedModel: "m"}
+
+	zoneA, _, err := New(policy).SplitAndScrub(req)
+	if err != nil {
+		t.Fatalf("SplitAndScrub failed: %v", err)
+	}
+	if got := zoneA.Messages[0].Content; got != req.Prompt {
+		t.Errorf("prompt should pass through unscrubbed, got %q", got)
+	}
+}
+
+func TestClassificationPolicy_ID(t *testing.T) {
+	a, b := DefaultPolicy(), DefaultPolicy()
+	if a.ID() != b.ID() {
+		t.Errorf("identical policies have different IDs: %s != %s", a.ID(), b.ID())
+	}
+	b.Rules[0].Transform = TransformNone
+	if a.ID() == b.ID() {
+		t.Error("changing a rule should change the policy ID")
+	}
+}
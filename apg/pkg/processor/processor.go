@@ -1,51 +1,472 @@
 package processor
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
 
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/crypto"
 	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
 )
 
 // ZoneBContext holds all the sensitive data that must not leave the Sacred Shifter ecosystem.
 // This struct is marshaled to JSON and then encrypted.
 type ZoneBContext struct {
-	UserID   string      `json:"userId"`
-	CircleID *string     `json:"circleId,omitempty"`
-	Context  interface{} `json:"context"`
-	Policy   types.Policy  `json:"policy"`
+	UserID   string       `json:"userId"`
+	CircleID *string      `json:"circleId,omitempty"`
+	Context  interface{}  `json:"context"`
+	Policy   types.Policy `json:"policy"`
+	// Timestamp and Location keep the exact values; Zone A only sees coarse forms.
+	Timestamp *time.Time      `json:"timestamp,omitempty"`
+	Location  *types.GeoPoint `json:"location,omitempty"`
+	// Pseudonyms maps each placeholder used in Zone A back to its original value.
+	Pseudonyms map[string]string `json:"pseudonyms,omitempty"`
+	// FPE holds the wrapped key that decrypts format-preserving surrogates.
+	FPE *FPERecord `json:"fpe,omitempty"`
+}
+
+// RulesetVersion identifies the scrubbing rules: the built-in scrubbers, their
+// detectors and the placeholder format. Bump it whenever any of them change.
+// The configured scrubber order is recorded separately, in PolicyDecision.
+const RulesetVersion = "1.2.0"
+
+// ErrInvalidRequest is returned when a request cannot be split because it is
+// malformed, as opposed to failing for an internal reason.
+var ErrInvalidRequest = errors.New("invalid gateway request")
+
+// Processor splits requests into Zone A and Zone B according to a
+// classification policy.
+type Processor struct {
+	policy     *ClassificationPolicy
+	pipeline   *Pipeline
+	screen     *InjectionScreen
+	fpe        *fpeConfig
+	keks       *crypto.KEKRegistry
+	surrogates bool
+}
+
+// Option configures a Processor.
+type Option func(*Processor)
+
+// WithPipeline sets the scrubbers applied to fields the policy marks for
+// scrubbing. The default is DefaultPipeline.
+func WithPipeline(pipeline *Pipeline) Option {
+	return func(p *Processor) {
+		p.pipeline = pipeline
+	}
+}
+
+// WithInjectionScreen sets the prompt-injection screen applied to user and
+// tool turns. The default is DefaultInjectionScreen; nil disables screening.
+func WithInjectionScreen(screen *InjectionScreen) Option {
+	return func(p *Processor) {
+		p.screen = screen
+	}
+}
+
+// New creates a Processor for the given policy. A nil policy selects DefaultPolicy.
+func New(policy *ClassificationPolicy, opts ...Option) *Processor {
+	if policy == nil {
+		policy = DefaultPolicy()
+	}
+	p := &Processor{policy: policy, pipeline: DefaultPipeline(), screen: DefaultInjectionScreen()}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Policy returns the classification policy the processor enforces.
+func (p *Processor) Policy() *ClassificationPolicy {
+	return p.policy
+}
+
+var defaultProcessor = New(nil)
+
+// Result is the outcome of splitting one request.
+type Result struct {
+	// ZoneA is the sanitized request for the external provider.
+	ZoneA types.OpenRouterRequest
+	// ZoneB is the marshaled ZoneBContext, ready for encryption.
+	ZoneB []byte
+	// Redactions lists every replacement made in the conversation turns.
+	Redactions []types.Redaction
+	// Decision records which fields the policy admitted into Zone A.
+	Decision types.PolicyDecision
+	// Surrogates lists the digits of the format-preserving surrogates and the
+	// realistic surrogates sent to Zone A. They are the gateway's own, so the
+	// output scan may safely ignore them.
+	Surrogates []string
+	// Retrievals lists the Context items that retrieve rules selected.
+	Retrievals []Retrieval
+	// Randomized lists what in ZoneA is drawn afresh on every split of the
+	// same request: "fpe" when digits were encrypted under a new FPE key, and
+	// "surrogates" when realistic surrogates were picked.
+	Randomized []string
+	// Screening is set when prompt-injection screening flagged any turn.
+	Screening *types.InjectionScreening
+}
+
+// RedactionCounts tallies the redactions by category.
+func (r *Result) RedactionCounts() map[string]int {
+	if len(r.Redactions) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, redaction := range r.Redactions {
+		counts[redaction.Category]++
+	}
+	return counts
+}
+
+// SplitAndScrub splits the request using the default classification policy.
+func SplitAndScrub(req *types.AuraGatewayRequest) (types.OpenRouterRequest, []byte, error) {
+	return defaultProcessor.SplitAndScrub(req)
 }
 
 // SplitAndScrub takes the initial request and separates it into a sanitized Zone A request
 // and a Zone B payload (as a raw byte slice, ready for encryption).
-func SplitAndScrub(req *types.AuraGatewayRequest) (types.OpenRouterRequest, []byte, error) {
+func (p *Processor) SplitAndScrub(req *types.AuraGatewayRequest) (types.OpenRouterRequest, []byte, error) {
+	result, err := p.Split(req)
+	if err != nil {
+		return types.OpenRouterRequest{}, nil, err
+	}
+	return result.ZoneA, result.ZoneB, nil
+}
+
+// Split separates the request into Zone A and Zone B and reports the
+// redactions it made along the way.
+func (p *Processor) Split(req *types.AuraGatewayRequest) (*Result, error) {
+	return p.SplitContext(context.Background(), req)
+}
+
+// SplitContext is Split with the KMS calls it makes, to provision the user's
+// KEK and wrap the FPE key, bound to ctx.
+func (p *Processor) SplitContext(ctx context.Context, req *types.AuraGatewayRequest) (*Result, error) {
+	return p.split(ctx, req, false)
+}
+
+// Preview splits the request as Split does, but never provisions a KEK or
+// calls the KMS. The FPE key of a preview is not wrapped, so its Zone B data
+// cannot restore surrogates; a preview is only for showing Zone A. The parts
+// of Zone A listed in Result.Randomized differ from any real split.
+func (p *Processor) Preview(req *types.AuraGatewayRequest) (*Result, error) {
+	return p.split(context.Background(), req, true)
+}
+
+func (p *Processor) split(ctx context.Context, req *types.AuraGatewayRequest, preview bool) (*Result, error) {
 	// 1. Create the sanitized Zone A request for the external provider.
-	// This is the core of the scrubbing logic. For now, it's a simple mapping.
-	// A future implementation could add more advanced PII detection and redaction on the prompt itself.
+	// Only fields the policy admits into Zone A are used, transformed as it dictates.
+	promptRule, ok := p.policy.ZoneARule(FieldPrompt)
+	if !ok {
+		return nil, fmt.Errorf("policy does not admit field %q into Zone A", FieldPrompt)
+	}
+	if _, ok := p.policy.ZoneARule(FieldRequestedModel); !ok {
+		return nil, fmt.Errorf("policy does not admit field %q into Zone A", FieldRequestedModel)
+	}
+
+	turns, err := conversation(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Identifiers in every turn are replaced with typed placeholders before
+	// anything is handed to the provider client. Names and codenames known from
+	// the Zone B data are redacted too, since no pattern can recognise them.
+	// One pseudonymizer serves the whole conversation, so an entity keeps the
+	// same placeholder in every turn.
+	pseudonymizer := p.newPseudonymizer(req)
+	sc := &ScrubContext{
+		Request:       req,
+		Terms:         CollectSensitiveTerms(req.CircleID, req.Context),
+		TimeRule:      p.zoneARule(FieldTimestamp),
+		LocationRule:  p.zoneARule(FieldLocation),
+		Pseudonymizer: pseudonymizer,
+	}
+	if p.fpe != nil && promptRule.Transform == TransformScrub && slices.Contains(p.pipeline.Names(), ScrubberFPE) {
+		if preview {
+			sc.fpe, err = p.fpe.newPreviewSession()
+		} else {
+			var kekID string
+			if kekID, err = p.fpeKEKID(ctx, req); err == nil {
+				sc.fpe, err = p.fpe.newSession(ctx, kekID)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	var redactions []types.Redaction
+	var screening *types.InjectionScreening
+
+	var messages []types.Message
+	coarse, err := p.coarseContext(req)
+	if err != nil {
+		return nil, err
+	}
+	if coarse != "" {
+		messages = append(messages, types.Message{Role: types.RoleSystem, Content: coarse})
+	}
+
+	// Context stays in Zone B except for the paths the policy promotes. Each
+	// promoted value is screened, at the stricter context threshold, and
+	// scrubbed or summarized on its own, so offsets in its redactions refer to
+	// that value.
+	var promoted []string
+	promotedRules := make(map[string]PolicyRule)
+	var contextLines []string
+	var tagContext bool
+	leaves, retrievals := p.promotedLeaves(req)
+	for _, leaf := range leaves {
+		var sanitize []Finding
+		if p.screen != nil {
+			report := p.screen.Screen(leaf.value)
+			if p.screen.FlagsContext(report) {
+				screening = p.recordScreening(screening, report)
+				screening.ContextPaths = append(screening.ContextPaths, leaf.label)
+				switch p.screen.Action {
+				case InjectionActionBlock:
+					return nil, fmt.Errorf("%w: context path %s scored %.2f (%s)", ErrPromptInjection, leaf.label, report.Score, strings.Join(report.Rules, ", "))
+				case InjectionActionSanitize:
+					sanitize = report.Matches
+				case InjectionActionTag:
+					tagContext = true
+				}
+			}
+		}
+
+		value, leafRedactions := p.promoteLeaf(leaf, sanitize, sc)
+		if value == "" {
+			continue
+		}
+		redactions = append(redactions, leafRedactions...)
+		contextLines = append(contextLines, "- "+leaf.label+": "+value)
+		promoted = append(promoted, leaf.label)
+		promotedRules[leaf.rule.Field] = leaf.rule
+	}
+	// Abstracted paths contribute derived attributes only, built from a fixed
+	// vocabulary, so there is nothing in them to scrub or screen.
+	for _, a := range p.abstractions(req, normalizeJSON(req.Context)) {
+		contextLines = append(contextLines, "- "+a.Path+": "+a.String())
+		promoted = append(promoted, a.Path)
+		promotedRules[a.rule.Field] = a.rule
+	}
+	if len(contextLines) > 0 {
+		if tagContext {
+			messages = append(messages, types.Message{Role: types.RoleSystem, Content: injectionTag})
+		}
+		messages = append(messages, types.Message{Role: types.RoleSystem, Content: contextHeader + "\n" + strings.Join(contextLines, "\n")})
+	}
+
+	for i, turn := range turns {
+		var stages []Scrubber
+		if promptRule.Transform == TransformScrub {
+			stages = p.pipeline.scrubbers
+		}
+
+		// User-controlled turns are screened for injection attempts on the
+		// original text, before scrubbing can disguise them.
+		if p.screen != nil && screenedRoles[turn.Role] {
+			report := p.screen.Screen(turn.Content)
+			if p.screen.Flags(report) {
+				screening = p.recordScreening(screening, report)
+				screening.Turns = append(screening.Turns, i)
+				switch p.screen.Action {
+				case InjectionActionBlock:
+					return nil, fmt.Errorf("%w: turn %d scored %.2f (%s)", ErrPromptInjection, i, report.Score, strings.Join(report.Rules, ", "))
+				case InjectionActionSanitize:
+					stages = append([]Scrubber{sanitizer{matches: report.Matches}}, stages...)
+				case InjectionActionTag:
+					messages = append(messages, types.Message{Role: types.RoleSystem, Content: injectionTag})
+				}
+			}
+		}
+
+		if len(stages) > 0 {
+			original := turn.Content
+			var findings []Finding
+			sc.Turn = i
+			turn, findings = NewPipeline(stages...).Scrub(turn, sc)
+			redactions = append(redactions, describeRedactions(i, original, findings)...)
+		}
+		messages = append(messages, turn)
+	}
 	zoneARequest := types.OpenRouterRequest{
-		Model: req.RequestedModel,
-		Messages: []types.Message{
-			{
-				Role:    "user",
-				Content: req.Prompt,
-			},
-		},
+		Model:    req.RequestedModel,
+		Messages: messages,
 	}
 
 	// 2. Package all sensitive and contextual data into the Zone B struct.
 	zoneB := ZoneBContext{
-		UserID:   req.UserID,
-		CircleID: req.CircleID,
-		Context:  req.Context,
-		Policy:   req.Policy,
+		UserID:     req.UserID,
+		CircleID:   req.CircleID,
+		Context:    req.Context,
+		Policy:     req.Policy,
+		Timestamp:  req.Timestamp,
+		Location:   req.Location,
+		Pseudonyms: pseudonymizer.Mapping(),
+	}
+	if sc.fpe != nil && len(sc.fpe.record.Surrogates) > 0 {
+		zoneB.FPE = sc.fpe.record
 	}
 
 	// 3. Marshal the Zone B context into a JSON byte slice.
 	// This payload is what will be encrypted by the crypto layer.
 	zoneBPayload, err := json.Marshal(zoneB)
 	if err != nil {
-		return types.OpenRouterRequest{}, nil, fmt.Errorf("failed to marshal zone B context: %w", err)
+		return nil, fmt.Errorf("failed to marshal zone B context: %w", err)
+	}
+
+	decision := p.decision(req, promptRule)
+	decision.PromotedContext = promoted
+	for field, rule := range promotedRules {
+		decision.Transforms[field] = describeTransform(rule)
+	}
+	var randomized []string
+	if zoneB.FPE != nil {
+		randomized = append(randomized, "fpe")
+	}
+	if len(pseudonymizer.Surrogates()) > 0 {
+		randomized = append(randomized, "surrogates")
+	}
+	return &Result{
+		ZoneA:      zoneARequest,
+		ZoneB:      zoneBPayload,
+		Redactions: redactions,
+		Decision:   decision,
+		Screening:  screening,
+		Surrogates: append(zoneB.FPE.surrogateDigits(), pseudonymizer.Surrogates()...),
+		Retrievals: retrievals,
+		Randomized: randomized,
+	}, nil
+}
+
+// recordScreening merges a flagged report into the screening record, creating
+// it on the first flag. The caller records where the flagged text came from.
+func (p *Processor) recordScreening(screening *types.InjectionScreening, report InjectionReport) *types.InjectionScreening {
+	if screening == nil {
+		screening = &types.InjectionScreening{Action: string(p.screen.Action)}
+	}
+	if report.Score > screening.Score {
+		screening.Score = report.Score
+	}
+	for _, rule := range report.Rules {
+		if !slices.Contains(screening.Rules, rule) {
+			screening.Rules = append(screening.Rules, rule)
+		}
+	}
+	sort.Strings(screening.Rules)
+	return screening
+}
+
+// decision describes which of the request's fields reached Zone A and how.
+func (p *Processor) decision(req *types.AuraGatewayRequest, promptRule PolicyRule) types.PolicyDecision {
+	d := types.PolicyDecision{
+		PolicyID:   p.policy.ID(),
+		Transforms: make(map[string]string),
+	}
+	if promptRule.Transform == TransformScrub {
+		d.Scrubbers = p.pipeline.Names()
+	}
+	present := map[string]bool{
+		FieldPrompt:         true,
+		FieldRequestedModel: true,
+		FieldTimestamp:      req.Timestamp != nil,
+		FieldLocation:       req.Location != nil,
+	}
+	for _, field := range p.policy.ZoneAFields() {
+		if !present[field] {
+			continue
+		}
+		rule, _ := p.policy.ZoneARule(field)
+		d.ZoneAFields = append(d.ZoneAFields, field)
+		d.Transforms[field] = describeTransform(rule)
+	}
+	return d
+}
+
+// describeTransform formats a rule's transform as it appears in a policy
+// file, e.g. "round:hour".
+func describeTransform(rule PolicyRule) string {
+	transform := string(rule.Transform)
+	if transform == "" {
+		transform = string(TransformNone)
+	}
+	if rule.TransformParam != "" {
+		transform += ":" + rule.TransformParam
 	}
+	return transform
+}
 
-	return zoneARequest, zoneBPayload, nil
+// describeRedactions converts findings in one turn into value-free redaction
+// records with character offsets into the original text.
+func describeRedactions(turn int, text string, findings []Finding) []types.Redaction {
+	redactions := make([]types.Redaction, 0, len(findings))
+	for _, f := range findings {
+		start := utf8.RuneCountInString(text[:f.Start])
+		redactions = append(redactions, types.Redaction{
+			Turn:        turn,
+			Category:    string(f.Category),
+			Start:       start,
+			End:         start + utf8.RuneCountInString(text[f.Start:f.End]),
+			Replacement: f.Replacement,
+		})
+	}
+	return redactions
+}
+
+// conversation returns the prior turns of the request followed by the prompt
+// as the final user turn.
+func conversation(req *types.AuraGatewayRequest) ([]types.Message, error) {
+	turns := make([]types.Message, 0, len(req.Messages)+1)
+	for i, m := range req.Messages {
+		switch m.Role {
+		case types.RoleSystem, types.RoleUser, types.RoleAssistant, types.RoleTool:
+		default:
+			return nil, fmt.Errorf("%w: message %d has unknown role %q", ErrInvalidRequest, i, m.Role)
+		}
+		turns = append(turns, m)
+	}
+	if req.Prompt != "" {
+		turns = append(turns, types.Message{Role: types.RoleUser, Content: req.Prompt})
+	}
+	if len(turns) == 0 {
+		return nil, fmt.Errorf("%w: request has neither a prompt nor messages", ErrInvalidRequest)
+	}
+	return turns, nil
+}
+
+// coarseContext renders the request's timestamp and location in the coarse
+// form the policy admits into Zone A. Fields without a Zone A rule are omitted.
+func (p *Processor) coarseContext(req *types.AuraGatewayRequest) (string, error) {
+	var lines []string
+	if rule := p.zoneARule(FieldTimestamp); rule != nil && req.Timestamp != nil {
+		rounded, err := RoundTime(*req.Timestamp, rule.TransformParam)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, "Approximate time of request (UTC): "+rounded)
+	}
+	if rule := p.zoneARule(FieldLocation); rule != nil && req.Location != nil {
+		fuzzed, err := FuzzLocation(*req.Location, rule.TransformParam)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, "Approximate location of user: "+fuzzed)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (p *Processor) zoneARule(field string) *PolicyRule {
+	rule, ok := p.policy.ZoneARule(field)
+	if !ok {
+		return nil
+	}
+	return &rule
 }
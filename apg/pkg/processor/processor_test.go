@@ -2,6 +2,7 @@ package processor
 
 import (
 	"encoding/json"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -57,3 +58,66 @@ func TestSplitAndScrub(t *testing.T) {
 		t.Errorf("Zone B Policy is incorrect. got %+v, want %+v", zoneBResult.Policy, req.Policy)
 	}
 }
+
+func TestSplitAndScrub_RedactsPromptIdentifiers(t *testing.T) {
+	req := &types.AuraGatewayRequest{
+		UserID:         "user_abc",
+		Prompt:         "Write to me at jane@example.com or on 0412 345 678.",
+		RequestedModel: "gpt-4o",
+	}
+
+	zoneAReq, _, err := SplitAndScrub(req)
+	if err != nil {
+		t.Fatalf("SplitAndScrub failed: %v", err)
+	}
+
+	want := "Write to me at [EMAIL_1] or on [PHONE_1]."
+	if got := zoneAReq.Messages[0].Content; got != want {
+		t.Errorf("Zone A prompt was not scrubbed. got %q, want %q", got, want)
+	}
+}
+
+func TestSplitAndScrub_MultiTurnConsistentPlaceholders(t *testing.T) {
+	req := &types.AuraGatewayRequest{
+		UserID:         "user_abc",
+		RequestedModel: "gpt-4o",
+		Messages: []types.Message{
+			{Role: types.RoleSystem, Content: "You are Aura."},
+			{Role: types.RoleUser, Content: "My email is jane@example.com."},
+			{Role: types.RoleAssistant, Content: "Noted, I'll use jane@example.com."},
+			{Role: types.RoleTool, Content: "lookup: bob@example.org", ToolCallID: "call_1"},
+		},
+		Prompt: "Send the summary to JANE@example.com and bob@example.org.",
+	}
+
+	zoneAReq, _, err := SplitAndScrub(req)
+	if err != nil {
+		t.Fatalf("SplitAndScrub failed: %v", err)
+	}
+
+	want := []types.Message{
+		{Role: types.RoleSystem, Content: "You are Aura."},
+		{Role: types.RoleUser, Content: "My email is [EMAIL_1]."},
+		{Role: types.RoleAssistant, Content: "Noted, I'll use [EMAIL_1]."},
+		{Role: types.RoleTool, Content: "lookup: [EMAIL_2]", ToolCallID: "call_1"},
+		{Role: types.RoleUser, Content: "Send the summary to [EMAIL_1] and [EMAIL_2]."},
+	}
+	if !reflect.DeepEqual(zoneAReq.Messages, want) {
+		t.Errorf("Zone A messages are incorrect.\ngot  %+v\nwant %+v", zoneAReq.Messages, want)
+	}
+}
+
+func TestSplitAndScrub_InvalidConversation(t *testing.T) {
+	requests := map[string]*types.AuraGatewayRequest{
+		"unknown role": {
+			RequestedModel: "gpt-4o",
+			Messages:       []types.Message{{Role: "developer", Content: "hi"}},
+		},
+		"empty": {RequestedModel: "gpt-4o"},
+	}
+	for name, req := range requests {
+		if _, _, err := SplitAndScrub(req); !errors.Is(err, ErrInvalidRequest) {
+			t.Errorf("%s: expected ErrInvalidRequest, got %v", name, err)
+		}
+	}
+}
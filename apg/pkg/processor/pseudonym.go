@@ -0,0 +1,203 @@
+package processor
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Pseudonymizer assigns consistent placeholders such as [PERSON_1] to sensitive
+// values and remembers the mapping so that model output can be rehydrated.
+// The mapping itself is Zone B data and must only ever travel encrypted.
+type Pseudonymizer struct {
+	counters map[Category]int
+	assigned map[string]string // category + value -> placeholder
+	mapping  map[string]string // placeholder -> original value
+	// surrogates, when set, supplies realistic values in place of bracketed
+	// placeholders.
+	surrogates *surrogateGenerator
+	// added lists the keys of assigned in the order they were added, so
+	// that rollback can undo them.
+	added []string
+}
+
+// NewPseudonymizer creates an empty Pseudonymizer.
+func NewPseudonymizer() *Pseudonymizer {
+	return &Pseudonymizer{
+		counters: make(map[Category]int),
+		assigned: make(map[string]string),
+		mapping:  make(map[string]string),
+	}
+}
+
+// NewSurrogatePseudonymizer creates a Pseudonymizer that replaces names,
+// emails and locations with realistic fake values from the word lists of
+// locale ("" for all of them), drawn by a generator seeded with seed. A
+// surrogate for which avoid reports true is never used; pass a check against
+// the request's text, so that rehydration only ever replaces what the gateway
+// put there. Other categories, and values for which no fresh surrogate is
+// found, still get placeholders.
+func NewSurrogatePseudonymizer(locale string, seed uint64, avoid func(string) bool) *Pseudonymizer {
+	p := NewPseudonymizer()
+	p.surrogates = newSurrogateGenerator(locale, seed, avoid)
+	return p
+}
+
+// Placeholder returns the placeholder for value, allocating a new one the first
+// time the value is seen for the given category. Values that differ only in
+// case, accents or obfuscation (see Normalize) share a placeholder, which
+// rehydrates to the first spelling.
+func (p *Pseudonymizer) Placeholder(category Category, value string) string {
+	key := string(category) + "\x00" + foldString(Normalize(value))
+	if placeholder, ok := p.assigned[key]; ok {
+		return placeholder
+	}
+	placeholder, ok := "", false
+	if p.surrogates != nil {
+		placeholder, ok = p.surrogates.generate(category, value)
+	}
+	if !ok {
+		p.counters[category]++
+		placeholder = fmt.Sprintf("[%s_%d]", category, p.counters[category])
+	}
+	p.assigned[key] = placeholder
+	p.mapping[placeholder] = value
+	p.added = append(p.added, key)
+	return placeholder
+}
+
+// mark returns the point rollback returns the Pseudonymizer to.
+func (p *Pseudonymizer) mark() int {
+	return len(p.added)
+}
+
+// rollback forgets every placeholder and surrogate assigned since mark, so
+// that they are assigned again as if never seen.
+func (p *Pseudonymizer) rollback(mark int) {
+	for i := len(p.added) - 1; i >= mark; i-- {
+		key := p.added[i]
+		placeholder := p.assigned[key]
+		delete(p.assigned, key)
+		delete(p.mapping, placeholder)
+		if isPlaceholder(placeholder) {
+			category, _, _ := strings.Cut(key, "\x00")
+			p.counters[Category(category)]--
+		} else if p.surrogates != nil {
+			delete(p.surrogates.used, strings.ToLower(placeholder))
+		}
+	}
+	p.added = p.added[:mark]
+}
+
+// Redact runs the default detectors over text and replaces every finding with
+// its placeholder. Occurrences of terms are redacted first, so a codename
+// inside an address is reported as the codename.
+func (p *Pseudonymizer) Redact(text string, terms ...Term) (string, []Finding) {
+	findings := mergeFindings(FindTerms(text, terms), Detect(text, DefaultDetectors()))
+	return p.Apply(text, findings), findings
+}
+
+// Apply replaces the given findings in text with their placeholders, or with
+// their Replacement when one is set. Findings must be non-overlapping and
+// ordered by Start, as returned by Detect.
+func (p *Pseudonymizer) Apply(text string, findings []Finding) string {
+	if len(findings) == 0 {
+		return text
+	}
+	var b strings.Builder
+	last := 0
+	for _, f := range findings {
+		b.WriteString(text[last:f.Start])
+		if f.Replacement != "" {
+			b.WriteString(f.Replacement)
+		} else {
+			b.WriteString(p.Placeholder(f.Category, f.Value))
+		}
+		last = f.End
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+// Mapping returns a copy of the placeholder-to-value mapping.
+func (p *Pseudonymizer) Mapping() map[string]string {
+	if len(p.mapping) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(p.mapping))
+	for k, v := range p.mapping {
+		m[k] = v
+	}
+	return m
+}
+
+// Surrogates lists the realistic surrogates in the mapping, sorted.
+func (p *Pseudonymizer) Surrogates() []string {
+	var surrogates []string
+	for placeholder := range p.mapping {
+		if !isPlaceholder(placeholder) {
+			surrogates = append(surrogates, placeholder)
+		}
+	}
+	sort.Strings(surrogates)
+	return surrogates
+}
+
+func isPlaceholder(s string) bool {
+	return strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]")
+}
+
+// Redact replaces every identifier found by the default detectors with a typed
+// placeholder such as [EMAIL_1]. Repeated values share the same placeholder.
+func Redact(text string) (string, []Finding) {
+	return NewPseudonymizer().Redact(text)
+}
+
+// Rehydrate substitutes the original values back into text for every
+// placeholder present in mapping. Realistic surrogates are matched as whole
+// words and regardless of case, since a model may capitalise a name at the
+// start of a sentence; the original value is restored as it was written.
+func Rehydrate(text string, mapping map[string]string) string {
+	if len(mapping) == 0 {
+		return text
+	}
+	// Longest first, so that "Emma Clarke" is replaced before "Emma"; ties are
+	// sorted for a deterministic pattern.
+	keys := make([]string, 0, len(mapping))
+	folded := make(map[string]string, len(mapping))
+	for key, value := range mapping {
+		keys = append(keys, key)
+		folded[strings.ToLower(key)] = value
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	alternatives := make([]string, len(keys))
+	for i, key := range keys {
+		alternatives[i] = regexp.QuoteMeta(key)
+		if !isPlaceholder(key) {
+			alternatives[i] = wordBoundary(key[0]) + alternatives[i] + wordBoundary(key[len(key)-1])
+		}
+	}
+	// One pass over text, so that a restored value is never replaced again.
+	pattern := regexp.MustCompile(`(?i)` + strings.Join(alternatives, "|"))
+	return pattern.ReplaceAllStringFunc(text, func(match string) string {
+		if value, ok := mapping[match]; ok {
+			return value
+		}
+		return folded[strings.ToLower(match)]
+	})
+}
+
+// wordBoundary returns \b for an edge byte that is an ASCII word character.
+// RE2's \b is ASCII-only, so a surrogate ending in "č" is matched without one.
+func wordBoundary(edge byte) string {
+	if edge == '_' || edge >= '0' && edge <= '9' || edge >= 'a' && edge <= 'z' || edge >= 'A' && edge <= 'Z' {
+		return `\b`
+	}
+	return ""
+}
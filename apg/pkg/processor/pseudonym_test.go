@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPseudonymizer_ConsistentPlaceholders(t *testing.T) {
+	p := NewPseudonymizer()
+
+	first := p.Placeholder(CategoryEmail, "jane@example.com")
+	second := p.Placeholder(CategoryEmail, "bob@example.com")
+	again := p.Placeholder(CategoryEmail, "jane@example.com")
+
+	if first != "[EMAIL_1]" || second != "[EMAIL_2]" {
+		t.Errorf("unexpected placeholders: %s, %s", first, second)
+	}
+	if again != first {
+		t.Errorf("repeated value got a new placeholder: %s != %s", again, first)
+	}
+
+	want := map[string]string{
+		"[EMAIL_1]": "jane@example.com",
+		"[EMAIL_2]": "bob@example.com",
+	}
+	if got := p.Mapping(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Mapping() = %v, want %v", got, want)
+	}
+}
+
+func TestRehydrate(t *testing.T) {
+	mapping := map[string]string{
+		"[EMAIL_1]":  "jane@example.com",
+		"[PHONE_1]":  "0412 345 678",
+		"[PHONE_10]": "0400 000 000",
+	}
+	text := "I'll email [EMAIL_1] and text [PHONE_1], not [PHONE_10]. Unknown: [PERSON_1]."
+
+	got := Rehydrate(text, mapping)
+	want := "I'll email jane@example.com and text 0412 345 678, not 0400 000 000. Unknown: [PERSON_1]."
+	if got != want {
+		t.Errorf("Rehydrate() = %q, want %q", got, want)
+	}
+}
+
+func TestRedactRehydrateRoundTrip(t *testing.T) {
+	p := NewPseudonymizer()
+	original := "Card 4111 1111 1111 1111, IBAN DE89 3704 0044 0532 0130 00."
+
+	redacted, _ := p.Redact(original)
+	if redacted == original {
+		t.Fatal("expected the text to be redacted")
+	}
+	if got := Rehydrate(redacted, p.Mapping()); got != original {
+		t.Errorf("round trip = %q, want %q", got, original)
+	}
+}
+
+func TestPseudonymizer_Rollback(t *testing.T) {
+	p := NewPseudonymizer()
+	kept := p.Placeholder(CategoryEmail, "a@example.com")
+	mark := p.mark()
+	p.Placeholder(CategoryEmail, "b@example.com")
+	p.Placeholder(CategoryEmail, "a@example.com")
+	p.rollback(mark)
+
+	if got := p.Placeholder(CategoryEmail, "c@example.com"); got != "[EMAIL_2]" {
+		t.Errorf("placeholder after rollback = %q, want [EMAIL_2]", got)
+	}
+	want := map[string]string{kept: "a@example.com", "[EMAIL_2]": "c@example.com"}
+	if got := p.Mapping(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Mapping() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,244 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// DefaultRetrieveItems is the number of items a retrieve transform selects
+// when its parameter leaves it out.
+const DefaultRetrieveItems = 3
+
+// BM25 parameters, at the values usual for short documents.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// parseRetrieveParam parses a retrieve parameter, the most items to select,
+// as in "retrieve:5".
+func parseRetrieveParam(param string) (int, error) {
+	if param == "" {
+		return DefaultRetrieveItems, nil
+	}
+	k, err := strconv.Atoi(param)
+	if err != nil || k < 1 {
+		return 0, fmt.Errorf("invalid retrieval size %q: want a positive item count", param)
+	}
+	return k, nil
+}
+
+// Retrieval records the items a retrieve rule selected from one collection in
+// Context. Items holds their IDs, never their content.
+type Retrieval struct {
+	Path  string
+	Items []string
+}
+
+// contextItem is one element of a Context collection.
+type contextItem struct {
+	// path locates the item, e.g. journal.4.
+	path contextPath
+	// id is the item's "id" value, or its position when it has none. A key
+	// is never used, as it may be an identifier.
+	id    string
+	terms []string
+}
+
+// retrieve runs every retrieve rule of the policy against the request. It
+// returns the paths of the selected items, for promotedLeaves, and the
+// selections for the record.
+func (p *Processor) retrieve(req *types.AuraGatewayRequest, context interface{}) (map[string]bool, []Retrieval) {
+	selected := make(map[string]bool)
+	var retrievals []Retrieval
+	query := retrievalTerms(retrievalQuery(req))
+	for _, rule := range p.policy.Rules {
+		if rule.Zone != ZoneA || !isContextPath(rule.Field) || rule.Transform != TransformRetrieve {
+			continue
+		}
+		k, _ := parseRetrieveParam(rule.TransformParam) // checked by Validate
+		pattern := strings.TrimPrefix(rule.Field, contextFieldPrefix)
+		for _, collection := range contextCollections(context, strings.Split(pattern, ".")) {
+			var ids []string
+			for _, item := range selectItems(collection.items, query, k) {
+				selected[item.path.id()] = true
+				ids = append(ids, item.id)
+			}
+			if ids != nil {
+				retrievals = append(retrievals, Retrieval{Path: collection.path.label(pattern), Items: ids})
+			}
+		}
+	}
+	return selected, retrievals
+}
+
+// retrievalQuery is the text relevance is judged against: the prompt, or
+// when there is none, the last user turn.
+func retrievalQuery(req *types.AuraGatewayRequest) string {
+	if strings.TrimSpace(req.Prompt) != "" {
+		return req.Prompt
+	}
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == types.RoleUser {
+			return req.Messages[i].Content
+		}
+	}
+	return ""
+}
+
+// contextCollection is an array or object in Context and its elements.
+type contextCollection struct {
+	path  contextPath
+	items []contextItem
+}
+
+// contextCollections finds the arrays and objects in v at the paths matching
+// pattern exactly, segment for segment.
+func contextCollections(v interface{}, pattern []string) []contextCollection {
+	var collections []contextCollection
+	for _, node := range contextNodes(v, pattern, nil) {
+		var items []contextItem
+		for _, child := range contextChildren(node) {
+			items = append(items, newContextItem(child.value, child.path))
+		}
+		if items != nil {
+			collections = append(collections, contextCollection{path: node.path, items: items})
+		}
+	}
+	return collections
+}
+
+// contextNode is a value anywhere in Context.
+type contextNode struct {
+	path  contextPath
+	value interface{}
+}
+
+// contextNodes finds the values in v at the paths matching pattern exactly,
+// segment for segment, ordered by path.
+func contextNodes(v interface{}, pattern []string, path contextPath) []contextNode {
+	if len(pattern) == 0 {
+		return []contextNode{{path: path, value: v}}
+	}
+	var nodes []contextNode
+	for _, child := range contextChildren(contextNode{path: path, value: v}) {
+		if pattern[0] == "*" || pattern[0] == child.path[len(child.path)-1].key {
+			nodes = append(nodes, contextNodes(child.value, pattern[1:], child.path)...)
+		}
+	}
+	return nodes
+}
+
+// contextChildren returns the elements of an array node or the members of an
+// object node, ordered by index or key. Other nodes have no children.
+func contextChildren(node contextNode) []contextNode {
+	var children []contextNode
+	switch val := node.value.(type) {
+	case []interface{}:
+		for i, child := range val {
+			children = append(children, contextNode{path: node.path.child(strconv.Itoa(i), i), value: child})
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for i, k := range keys {
+			children = append(children, contextNode{path: node.path.child(k, i), value: val[k]})
+		}
+	}
+	return children
+}
+
+// newContextItem indexes the text of every leaf of v.
+func newContextItem(v interface{}, path contextPath) contextItem {
+	item := contextItem{path: path, id: strconv.Itoa(path[len(path)-1].index)}
+	if obj, ok := v.(map[string]interface{}); ok {
+		switch id := obj["id"].(type) {
+		case string:
+			item.id = id
+		case float64:
+			item.id = strconv.FormatFloat(id, 'f', -1, 64)
+		}
+	}
+	for _, leaf := range contextLeaves(v, nil, nil) {
+		item.terms = append(item.terms, retrievalTerms(leaf.value)...)
+	}
+	return item
+}
+
+// retrievalTerms are the index terms of s with plural endings removed, so
+// that "dreams" finds "dream". Words in -ss, -us and -is, such as "stress",
+// "anxious" and "crisis", are left alone.
+func retrievalTerms(s string) []string {
+	terms := indexTerms(s)
+	for i, term := range terms {
+		if len(term) > 3 && strings.HasSuffix(term, "s") && !strings.HasSuffix(term, "ss") && !strings.HasSuffix(term, "us") && !strings.HasSuffix(term, "is") {
+			terms[i] = strings.TrimSuffix(term, "s")
+		}
+	}
+	return terms
+}
+
+// selectItems returns up to k items ranked by their BM25 score for query,
+// best first. Items that share no term with the query are never selected.
+func selectItems(items []contextItem, query []string, k int) []contextItem {
+	if len(items) == 0 || len(query) == 0 {
+		return nil
+	}
+
+	df := make(map[string]int)
+	var totalLen float64
+	for _, item := range items {
+		totalLen += float64(len(item.terms))
+		seen := make(map[string]bool)
+		for _, term := range item.terms {
+			if !seen[term] {
+				seen[term] = true
+				df[term]++
+			}
+		}
+	}
+	n := float64(len(items))
+	avgLen := totalLen / n
+
+	scores := make([]float64, len(items))
+	for i, item := range items {
+		tf := make(map[string]int)
+		for _, term := range item.terms {
+			tf[term]++
+		}
+		seen := make(map[string]bool)
+		for _, term := range query {
+			if seen[term] || tf[term] == 0 {
+				continue
+			}
+			seen[term] = true
+			idf := math.Log(1 + (n-float64(df[term])+0.5)/(float64(df[term])+0.5))
+			f := float64(tf[term])
+			scores[i] += idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*float64(len(item.terms))/avgLen))
+		}
+	}
+
+	order := make([]int, 0, len(items))
+	for i := range items {
+		if scores[i] > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	if len(order) > k {
+		order = order[:k]
+	}
+	selected := make([]contextItem, len(order))
+	for i, j := range order {
+		selected[i] = items[j]
+	}
+	return selected
+}
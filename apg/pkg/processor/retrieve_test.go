@@ -0,0 +1,95 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func journalRequest(prompt string) *types.AuraGatewayRequest {
+	return &types.AuraGatewayRequest{
+		Prompt:         prompt,
+		RequestedModel: "m",
+		Context: map[string]interface{}{
+			"journal": []interface{}{
+				map[string]interface{}{"id": "j-101", "text": "Long walk by the river, felt grounded."},
+				map[string]interface{}{"id": "j-102", "text": "Anxiety spiked before the meeting with jane@example.com."},
+				map[string]interface{}{"id": "j-103", "text": "Dreams about the ocean again."},
+				map[string]interface{}{"id": "j-104", "text": "Breathing helped the anxiety settle by evening."},
+			},
+		},
+	}
+}
+
+func TestSplit_RetrievesRelevantEntries(t *testing.T) {
+	result, err := New(contextPolicy(TransformRetrieve, "2", "journal")).Split(journalRequest("Why does my anxiety keep coming back?"))
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+
+	if len(result.Retrievals) != 1 || result.Retrievals[0].Path != "journal" {
+		t.Fatalf("unexpected retrievals %+v", result.Retrievals)
+	}
+	if got := result.Retrievals[0].Items; !reflect.DeepEqual(got, []string{"j-104", "j-102"}) {
+		t.Errorf("expected the two anxiety entries, shorter first, got %v", got)
+	}
+
+	content := result.ZoneA.Messages[0].Content
+	for _, want := range []string{"journal.1.1: Anxiety spiked before the meeting with [EMAIL_1].", "journal.3.1: Breathing helped"} {
+		if !strings.Contains(content, want) {
+			t.Errorf("promoted context %q lacks %q", content, want)
+		}
+	}
+	for _, unwanted := range []string{"river", "ocean"} {
+		if strings.Contains(content, unwanted) {
+			t.Errorf("irrelevant entry promoted: %q", content)
+		}
+	}
+}
+
+func TestSplit_RetrievesNothingIrrelevant(t *testing.T) {
+	result, err := New(contextPolicy(TransformRetrieve, "", "journal")).Split(journalRequest("Suggest a recipe."))
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if result.Retrievals != nil || result.Decision.PromotedContext != nil {
+		t.Errorf("entries promoted for an unrelated prompt: %+v", result.Retrievals)
+	}
+}
+
+func TestSplit_RetrievalRecordsPositionsForKeys(t *testing.T) {
+	req := journalRequest("Why does my anxiety keep coming back?")
+	req.Context = map[string]interface{}{
+		"journal": map[string]interface{}{
+			"Jane Doe": "Anxiety after the call.",
+			"John Roe": "Calm walk by the river.",
+		},
+	}
+	result, err := New(contextPolicy(TransformRetrieve, "1", "journal")).Split(req)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(result.Retrievals) != 1 || !reflect.DeepEqual(result.Retrievals[0].Items, []string{"0"}) {
+		t.Fatalf("unexpected retrievals %+v", result.Retrievals)
+	}
+	if content := result.ZoneA.Messages[0].Content; strings.Contains(content, "Jane") || !strings.Contains(content, "- journal.0: Anxiety") {
+		t.Errorf("unexpected promoted context %q", content)
+	}
+}
+
+func TestSelectItems_BM25(t *testing.T) {
+	items := []contextItem{
+		{path: contextPath{{key: "0", index: 0}}, id: "short", terms: retrievalTerms("anxiety")},
+		{path: contextPath{{key: "1", index: 1}}, id: "long", terms: retrievalTerms("anxiety during a long day of errands, meetings, calls and chores")},
+		{path: contextPath{{key: "2", index: 2}}, id: "none", terms: retrievalTerms("calm")},
+	}
+	var ids []string
+	for _, item := range selectItems(items, retrievalTerms("anxiety"), 5) {
+		ids = append(ids, item.id)
+	}
+	if !reflect.DeepEqual(ids, []string{"short", "long"}) {
+		t.Errorf("got %v, want the shorter match first and no non-matching items", ids)
+	}
+}
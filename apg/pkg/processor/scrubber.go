@@ -0,0 +1,383 @@
+package processor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// Names of the built-in scrubbers.
+const (
+	ScrubberTerms  = "terms"
+	ScrubberCoarse = "coarse"
+	ScrubberPII    = "pii"
+)
+
+// Scrubber is one stage of the scrubbing pipeline. It receives a message as
+// left by the previous stages and returns it with its own findings replaced.
+// Offsets in the returned findings refer to the content it was given, and
+// each finding's Replacement must be the text that now stands in its place.
+type Scrubber interface {
+	// Name identifies the scrubber in configuration and provenance.
+	Name() string
+	Scrub(msg types.Message, sc *ScrubContext) (types.Message, []Finding)
+}
+
+// ScrubContext carries what scrubbers may need beyond the message itself.
+// It is shared by every stage and turn of one request.
+type ScrubContext struct {
+	// Request is the request being split. Scrubbers must not modify it.
+	Request *types.AuraGatewayRequest
+	// Turn is the index of the message within the conversation.
+	Turn int
+	// Terms are the names and codenames collected from the Zone B data.
+	Terms []Term
+	// TimeRule and LocationRule are the policy's Zone A rules for timestamps
+	// and locations, or nil when the policy keeps them in Zone B.
+	TimeRule     *PolicyRule
+	LocationRule *PolicyRule
+	// Pseudonymizer assigns placeholders consistently across the conversation.
+	Pseudonymizer *Pseudonymizer
+
+	// protected holds the byte ranges of the current content that earlier
+	// stages already replaced.
+	protected []span
+	// fpe encrypts surrogates for the FPE scrubber, when configured.
+	fpe *fpeSession
+}
+
+type span struct{ start, end int }
+
+// scrubMark is a point in the placeholders and surrogates of a ScrubContext
+// that rollback returns it to.
+type scrubMark struct{ pseudonyms, fpe int }
+
+// mark returns the point the ScrubContext is at now.
+func (sc *ScrubContext) mark() scrubMark {
+	m := scrubMark{pseudonyms: sc.Pseudonymizer.mark()}
+	if sc.fpe != nil {
+		m.fpe = len(sc.fpe.added)
+	}
+	return m
+}
+
+// rollback undoes the placeholders and surrogates assigned since m, so that
+// text scrubbed since then and then discarded leaves no trace in the
+// mapping or the FPE record.
+func (sc *ScrubContext) rollback(m scrubMark) {
+	sc.Pseudonymizer.rollback(m.pseudonyms)
+	if sc.fpe != nil {
+		sc.fpe.rollback(m.fpe)
+	}
+}
+
+// Replace substitutes findings in text with their Replacement or, when none is
+// set, with a placeholder. Findings overlapping a value an earlier stage has
+// already replaced are skipped, so no scrubber can corrupt a placeholder.
+// It returns the new text and the findings it applied, with Replacement set.
+func (sc *ScrubContext) Replace(text string, findings []Finding) (string, []Finding) {
+	var applied []Finding
+	for _, f := range findings {
+		if sc.overlapsProtected(f.Start, f.End) || overlapsAny(applied, f.Start, f.End) {
+			continue
+		}
+		if f.Replacement == "" {
+			f.Replacement = sc.Pseudonymizer.Placeholder(f.Category, f.Value)
+		}
+		applied = append(applied, f)
+	}
+	sort.Slice(applied, func(i, j int) bool { return applied[i].Start < applied[j].Start })
+	return sc.Pseudonymizer.Apply(text, applied), applied
+}
+
+func (sc *ScrubContext) overlapsProtected(start, end int) bool {
+	for _, s := range sc.protected {
+		if start < s.end && s.start < end {
+			return true
+		}
+	}
+	return false
+}
+
+// funcScrubber adapts a finder to the Scrubber interface.
+type funcScrubber struct {
+	name string
+	find func(text string, sc *ScrubContext) []Finding
+	// identifiers marks finders whose findings are identifiers wherever they
+	// appear, so that model output is scanned with them too.
+	identifiers bool
+}
+
+func (s funcScrubber) Name() string { return s.name }
+
+// Scrub runs the finder over the normalized content, so that full-width
+// digits, zero-width characters and the like cannot hide an identifier, and
+// replaces the matching ranges of the original content.
+func (s funcScrubber) Scrub(msg types.Message, sc *ScrubContext) (types.Message, []Finding) {
+	findings := findNormalized(msg.Content, func(normalized string) []Finding {
+		return s.find(normalized, sc)
+	})
+	msg.Content, findings = sc.Replace(msg.Content, findings)
+	return msg, findings
+}
+
+// TermScrubber replaces the names and codenames collected from the Zone B data.
+func TermScrubber() Scrubber {
+	return funcScrubber{name: ScrubberTerms, find: func(text string, sc *ScrubContext) []Finding {
+		return FindTerms(text, sc.Terms)
+	}}
+}
+
+// CoarseScrubber replaces timestamps and coordinates with the coarse forms the
+// policy admits into Zone A, or with placeholders when it admits none.
+func CoarseScrubber() Scrubber {
+	return funcScrubber{name: ScrubberCoarse, find: func(text string, sc *ScrubContext) []Finding {
+		return coarseFindings(text, sc.TimeRule, sc.LocationRule)
+	}}
+}
+
+// DetectorScrubber replaces everything the given pattern detectors find.
+func DetectorScrubber(name string, detectors []Detector) Scrubber {
+	return funcScrubber{name: name, identifiers: true, find: func(text string, _ *ScrubContext) []Finding {
+		return Detect(text, detectors)
+	}}
+}
+
+// WordListScrubber replaces whole-word occurrences of any of words, ignoring
+// case and accents, with placeholders of the given category. It suits fixed
+// vocabularies such as practitioner names or private circle jargon.
+func WordListScrubber(name string, category Category, words []string) Scrubber {
+	terms := make([]Term, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			terms = append(terms, Term{Category: category, Value: w})
+		}
+	}
+	// Longer entries first, so "Circle of Dawn" wins over "Dawn".
+	sort.Slice(terms, func(i, j int) bool { return len(terms[i].Value) > len(terms[j].Value) })
+	return funcScrubber{name: name, identifiers: true, find: func(text string, _ *ScrubContext) []Finding {
+		return FindTerms(text, terms)
+	}}
+}
+
+// LoadWordLists builds a WordListScrubber for every .txt file in dir. The file
+// name without its extension names the scrubber, and in upper case it is the
+// placeholder category: practitioners.txt yields [PRACTITIONERS_1]. Each line
+// holds one entry; blank lines and lines starting with # are ignored.
+func LoadWordLists(dir string) ([]Scrubber, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list word lists: %w", err)
+	}
+	sort.Strings(paths)
+
+	scrubbers := make([]Scrubber, 0, len(paths))
+	for _, path := range paths {
+		words, err := readWordList(path)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)))
+		category := Category(strings.ToUpper(strings.NewReplacer("-", "_", " ", "_").Replace(name)))
+		scrubbers = append(scrubbers, WordListScrubber(name, category, words))
+	}
+	return scrubbers, nil
+}
+
+func readWordList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open word list: %w", err)
+	}
+	defer f.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read word list %s: %w", path, err)
+	}
+	return words, nil
+}
+
+// DefaultScrubbers returns the built-in scrubbers in their default order:
+// known terms first, then timestamps and coordinates, then the locale pack
+// and finally the generic pattern detectors.
+func DefaultScrubbers() []Scrubber {
+	return []Scrubber{
+		TermScrubber(),
+		CoarseScrubber(),
+		LocaleScrubber(),
+		DetectorScrubber(ScrubberPII, DefaultDetectors()),
+	}
+}
+
+// Pipeline runs scrubbers in order, each on the output of the one before.
+type Pipeline struct {
+	scrubbers []Scrubber
+}
+
+// NewPipeline creates a pipeline running scrubbers in the given order.
+func NewPipeline(scrubbers ...Scrubber) *Pipeline {
+	return &Pipeline{scrubbers: scrubbers}
+}
+
+// DefaultPipeline runs DefaultScrubbers.
+func DefaultPipeline() *Pipeline {
+	return NewPipeline(DefaultScrubbers()...)
+}
+
+// ParsePipeline selects and orders scrubbers by name from a comma-separated
+// spec such as "terms,pii". Scrubbers left out of the spec are disabled. An
+// empty spec enables every available scrubber in the order given.
+func ParsePipeline(spec string, available ...Scrubber) (*Pipeline, error) {
+	byName := make(map[string]Scrubber, len(available))
+	names := make([]string, 0, len(available))
+	for _, s := range available {
+		if _, dup := byName[s.Name()]; dup {
+			return nil, fmt.Errorf("duplicate scrubber name %q", s.Name())
+		}
+		byName[s.Name()] = s
+		names = append(names, s.Name())
+	}
+	if strings.TrimSpace(spec) == "" {
+		return NewPipeline(available...), nil
+	}
+
+	var selected []Scrubber
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		s, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown scrubber %q: available are %s", name, strings.Join(names, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("scrubber %q is listed twice", name)
+		}
+		seen[name] = true
+		selected = append(selected, s)
+	}
+	return NewPipeline(selected...), nil
+}
+
+// Names returns the names of the pipeline's scrubbers in order.
+func (p *Pipeline) Names() []string {
+	names := make([]string, len(p.scrubbers))
+	for i, s := range p.scrubbers {
+		names[i] = s.Name()
+	}
+	return names
+}
+
+// edit records one replacement made by a stage: [inStart, inEnd) of its input
+// became [outStart, outEnd) of its output.
+type edit struct {
+	inStart, inEnd, outStart, outEnd int
+}
+
+// findIdentifiers runs the finders of the identifier scrubbers over text,
+// without replacing anything. Where findings overlap, the earlier scrubber's
+// wins, as it would when scrubbing.
+func (p *Pipeline) findIdentifiers(text string, sc *ScrubContext) []Finding {
+	var findings []Finding
+	for _, s := range p.scrubbers {
+		f, ok := s.(funcScrubber)
+		if !ok || !f.identifiers {
+			continue
+		}
+		for _, finding := range f.find(text, sc) {
+			if !overlapsAny(findings, finding.Start, finding.End) {
+				findings = append(findings, finding)
+			}
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+	return findings
+}
+
+// Scrub runs every stage over msg. The returned findings are ordered and their
+// offsets refer to the original content, whichever stage produced them.
+func (p *Pipeline) Scrub(msg types.Message, sc *ScrubContext) (types.Message, []Finding) {
+	sc.protected = nil
+	var stages [][]edit
+	var findings []Finding
+	for _, s := range p.scrubbers {
+		var stageFindings []Finding
+		msg, stageFindings = s.Scrub(msg, sc)
+		if len(stageFindings) == 0 {
+			continue
+		}
+
+		edits := make([]edit, len(stageFindings))
+		delta := 0
+		for i, f := range stageFindings {
+			outStart := f.Start + delta
+			delta += len(f.Replacement) - (f.End - f.Start)
+			edits[i] = edit{inStart: f.Start, inEnd: f.End, outStart: outStart, outEnd: f.End + delta}
+		}
+		for i := range sc.protected {
+			sc.protected[i] = span{shiftForward(edits, sc.protected[i].start), shiftForward(edits, sc.protected[i].end)}
+		}
+		for _, e := range edits {
+			sc.protected = append(sc.protected, span{e.outStart, e.outEnd})
+		}
+
+		for _, f := range stageFindings {
+			for i := len(stages) - 1; i >= 0; i-- {
+				f.Start = mapBack(stages[i], f.Start, false)
+				f.End = mapBack(stages[i], f.End, true)
+			}
+			findings = append(findings, f)
+		}
+		stages = append(stages, edits)
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+	return msg, findings
+}
+
+// shiftForward maps an offset in a stage's input to its output. The offset
+// must not fall inside a replaced range.
+func shiftForward(edits []edit, pos int) int {
+	delta := 0
+	for _, e := range edits {
+		if e.inEnd > pos {
+			break
+		}
+		delta = e.outEnd - e.inEnd
+	}
+	return pos + delta
+}
+
+// mapBack maps an offset in a stage's output to its input. An offset strictly
+// inside a replacement widens to cover the whole replaced range.
+func mapBack(edits []edit, pos int, isEnd bool) int {
+	delta := 0
+	for _, e := range edits {
+		if pos <= e.outStart {
+			break
+		}
+		if pos < e.outEnd {
+			if isEnd {
+				return e.inEnd
+			}
+			return e.inStart
+		}
+		delta = e.outEnd - e.inEnd
+	}
+	return pos - delta
+}
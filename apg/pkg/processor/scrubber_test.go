@@ -0,0 +1,125 @@
+package processor
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestPipeline_OffsetsReferToOriginal(t *testing.T) {
+	practitioners := WordListScrubber("practitioners", "PRACTITIONER", []string{"Mother Aurelia"})
+	pipeline := NewPipeline(practitioners, DetectorScrubber(ScrubberPII, DefaultDetectors()))
+	sc := &ScrubContext{Pseudonymizer: NewPseudonymizer()}
+
+	original := "Ask Mother Aurelia, then mail jane@example.com."
+	msg, findings := pipeline.Scrub(types.Message{Role: types.RoleUser, Content: original}, sc)
+
+	if want := "Ask [PRACTITIONER_1], then mail [EMAIL_1]."; msg.Content != want {
+		t.Errorf("got %q, want %q", msg.Content, want)
+	}
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %+v", findings)
+	}
+	for _, f := range findings {
+		if original[f.Start:f.End] != f.Value {
+			t.Errorf("finding %+v does not point at %q in the original", f, f.Value)
+		}
+	}
+}
+
+// placeholderEater matches inside placeholders left by earlier stages.
+type placeholderEater struct{}
+
+func (placeholderEater) Name() string { return "eater" }
+
+func (placeholderEater) Scrub(msg types.Message, sc *ScrubContext) (types.Message, []Finding) {
+	var findings []Finding
+	for _, loc := range regexp.MustCompile(`EMAIL_1`).FindAllStringIndex(msg.Content, -1) {
+		findings = append(findings, Finding{Category: "TERM", Start: loc[0], End: loc[1], Value: "EMAIL_1"})
+	}
+	msg.Content, findings = sc.Replace(msg.Content, findings)
+	return msg, findings
+}
+
+func TestScrubContext_ProtectsEarlierReplacements(t *testing.T) {
+	pipeline := NewPipeline(DetectorScrubber(ScrubberPII, DefaultDetectors()), placeholderEater{})
+	sc := &ScrubContext{Pseudonymizer: NewPseudonymizer()}
+
+	msg, findings := pipeline.Scrub(types.Message{Content: "mail jane@example.com"}, sc)
+	if msg.Content != "mail [EMAIL_1]" || len(findings) != 1 {
+		t.Errorf("a later scrubber rewrote a placeholder: %q, %+v", msg.Content, findings)
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	available := DefaultScrubbers()
+
+	all, err := ParsePipeline("", available...)
+	if err != nil {
+		t.Fatalf("ParsePipeline failed: %v", err)
+	}
+	if got := all.Names(); !reflect.DeepEqual(got, []string{ScrubberTerms, ScrubberCoarse, ScrubberLocale, ScrubberPII}) {
+		t.Errorf("empty spec should enable all scrubbers, got %v", got)
+	}
+
+	reordered, err := ParsePipeline(" PII , terms", available...)
+	if err != nil {
+		t.Fatalf("ParsePipeline failed: %v", err)
+	}
+	if got := reordered.Names(); !reflect.DeepEqual(got, []string{ScrubberPII, ScrubberTerms}) {
+		t.Errorf("got %v, want [pii terms]", got)
+	}
+
+	for _, spec := range []string{"terms,shred", "pii,pii"} {
+		if _, err := ParsePipeline(spec, available...); err == nil {
+			t.Errorf("expected an error for spec %q", spec)
+		}
+	}
+}
+
+func TestLoadWordLists(t *testing.T) {
+	dir := t.TempDir()
+	list := "# private circle jargon\nStarseed Gate\n\nVeil Walk\n"
+	if err := os.WriteFile(filepath.Join(dir, "circle-jargon.txt"), []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	scrubbers, err := LoadWordLists(dir)
+	if err != nil {
+		t.Fatalf("LoadWordLists failed: %v", err)
+	}
+	if len(scrubbers) != 1 || scrubbers[0].Name() != "circle-jargon" {
+		t.Fatalf("unexpected scrubbers %v", scrubbers)
+	}
+
+	sc := &ScrubContext{Pseudonymizer: NewPseudonymizer()}
+	msg, _ := scrubbers[0].Scrub(types.Message{Content: "Before the veil walk at Starseed Gate"}, sc)
+	if want := "Before the [CIRCLE_JARGON_1] at [CIRCLE_JARGON_2]"; msg.Content != want {
+		t.Errorf("got %q, want %q", msg.Content, want)
+	}
+}
+
+func TestProcessor_DisabledScrubber(t *testing.T) {
+	pipeline, err := ParsePipeline("terms", DefaultScrubbers()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := New(nil, WithPipeline(pipeline)).Split(&types.AuraGatewayRequest{
+		Prompt:         "Mail jane@example.com",
+		RequestedModel: "m",
+	})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if got := result.ZoneA.Messages[0].Content; !strings.Contains(got, "jane@example.com") {
+		t.Errorf("disabled pii scrubber still ran: %q", got)
+	}
+	if got := result.Decision.Scrubbers; !reflect.DeepEqual(got, []string{ScrubberTerms}) {
+		t.Errorf("Decision.Scrubbers = %v", got)
+	}
+}
@@ -0,0 +1,149 @@
+package processor
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Defaults for the summarize transform, used when its parameter leaves them out.
+const (
+	DefaultSummarySentences = 3
+	DefaultSummaryChars     = 500
+)
+
+// sentenceEnd matches the end of a sentence: terminal punctuation, with any
+// closing quotes or brackets, followed by white space, or a line break.
+var sentenceEnd = regexp.MustCompile(`[.!?…]+["'”’)\]]*\s+|\n+`)
+
+// stopwords are too common to say anything about a sentence or an entry.
+var stopwords = map[string]bool{
+	"a": true, "about": true, "after": true, "again": true, "all": true, "am": true, "an": true, "and": true,
+	"any": true, "are": true, "as": true, "at": true, "be": true, "been": true, "before": true, "but": true,
+	"by": true, "can": true, "could": true, "did": true, "do": true, "does": true, "for": true, "from": true,
+	"had": true, "has": true, "have": true, "he": true, "her": true, "him": true, "his": true, "how": true,
+	"i": true, "if": true, "in": true, "into": true, "is": true, "it": true, "its": true, "just": true,
+	"me": true, "more": true, "my": true, "no": true, "not": true, "of": true, "on": true, "or": true,
+	"our": true, "out": true, "over": true, "she": true, "so": true, "some": true, "than": true, "that": true,
+	"the": true, "their": true, "them": true, "then": true, "there": true, "these": true, "they": true,
+	"this": true, "to": true, "too": true, "up": true, "us": true, "very": true, "was": true, "we": true,
+	"were": true, "what": true, "when": true, "which": true, "while": true, "who": true, "will": true,
+	"with": true, "would": true, "you": true, "your": true,
+}
+
+// SummaryParam holds the parsed parameter of a summarize transform.
+type SummaryParam struct {
+	// Sentences is the most sentences a summary keeps.
+	Sentences int
+	// Chars is the most characters a summary may take after scrubbing.
+	Chars int
+}
+
+// ParseSummaryParam parses a summarize parameter of the form "k" or "k/chars",
+// as in "summarize:3/400". Missing values take the defaults.
+func ParseSummaryParam(param string) (SummaryParam, error) {
+	sp := SummaryParam{Sentences: DefaultSummarySentences, Chars: DefaultSummaryChars}
+	if param == "" {
+		return sp, nil
+	}
+	k, chars, hasChars := strings.Cut(param, "/")
+	var err error
+	if sp.Sentences, err = strconv.Atoi(k); err != nil || sp.Sentences < 1 {
+		return SummaryParam{}, fmt.Errorf("invalid summary size %q: want a sentence count, optionally followed by /characters", param)
+	}
+	if hasChars {
+		if sp.Chars, err = strconv.Atoi(chars); err != nil || sp.Chars < 1 {
+			return SummaryParam{}, fmt.Errorf("invalid summary size %q: want a sentence count, optionally followed by /characters", param)
+		}
+	}
+	return sp, nil
+}
+
+// sentence is a byte range of a text.
+type sentence struct {
+	start, end int
+}
+
+// splitSentences cuts text into sentences, trimming the white space around
+// each. Text without terminal punctuation is one sentence.
+func splitSentences(text string) []sentence {
+	var sentences []sentence
+	add := func(start, end int) {
+		for start < end && unicode.IsSpace(rune(text[start])) {
+			start++
+		}
+		for end > start && unicode.IsSpace(rune(text[end-1])) {
+			end--
+		}
+		if start < end {
+			sentences = append(sentences, sentence{start: start, end: end})
+		}
+	}
+	start := 0
+	for _, loc := range sentenceEnd.FindAllStringIndex(text, -1) {
+		add(start, loc[1])
+		start = loc[1]
+	}
+	add(start, len(text))
+	return sentences
+}
+
+// indexTerms returns the lower-cased words of s, without stopwords and
+// single characters.
+func indexTerms(s string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if len([]rune(word)) > 1 && !stopwords[word] {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// rankSentences orders the sentences of text from most to least informative.
+// A sentence scores the TF-IDF weights of its terms, with each sentence as a
+// document, divided by the square root of its length so that long sentences
+// do not win on length alone. Ties keep the earlier sentence first.
+func rankSentences(text string, sentences []sentence) []int {
+	terms := make([][]string, len(sentences))
+	df := make(map[string]int)
+	for i, s := range sentences {
+		terms[i] = indexTerms(text[s.start:s.end])
+		seen := make(map[string]bool)
+		for _, term := range terms[i] {
+			if !seen[term] {
+				seen[term] = true
+				df[term]++
+			}
+		}
+	}
+
+	n := float64(len(sentences))
+	scores := make([]float64, len(sentences))
+	for i := range sentences {
+		if len(terms[i]) == 0 {
+			continue
+		}
+		tf := make(map[string]int)
+		for _, term := range terms[i] {
+			tf[term]++
+		}
+		for term, count := range tf {
+			scores[i] += float64(count) * math.Log(1+n/float64(df[term]))
+		}
+		scores[i] /= math.Sqrt(float64(len(terms[i])))
+	}
+
+	order := make([]int, len(sentences))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	return order
+}
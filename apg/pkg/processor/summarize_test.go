@@ -0,0 +1,128 @@
+package processor
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestParseSummaryParam(t *testing.T) {
+	tests := map[string]SummaryParam{
+		"":      {Sentences: DefaultSummarySentences, Chars: DefaultSummaryChars},
+		"2":     {Sentences: 2, Chars: DefaultSummaryChars},
+		"2/120": {Sentences: 2, Chars: 120},
+	}
+	for in, want := range tests {
+		got, err := ParseSummaryParam(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSummaryParam(%q) = %+v, %v; want %+v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"0", "two", "2/", "2/-5"} {
+		if _, err := ParseSummaryParam(in); err == nil {
+			t.Errorf("expected an error for %q", in)
+		}
+	}
+}
+
+func TestSplitSentences(t *testing.T) {
+	text := "  First one. \"Second?\" Third!\nFourth without a stop"
+	var got []string
+	for _, s := range splitSentences(text) {
+		got = append(got, text[s.start:s.end])
+	}
+	want := []string{"First one.", `"Second?"`, "Third!", "Fourth without a stop"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// journal has two sentences about the breathwork retreat, which the ranking
+// should prefer over filler, and an email address in one of them.
+const journal = "Today was fine. " +
+	"The breathwork retreat at the lake finally eased my panic attacks. " +
+	"It was fine. " +
+	"I emailed jane@example.com about returning to the lake retreat for breathwork. " +
+	"Fine, fine."
+
+func TestSplit_SummarizesPromotedContext(t *testing.T) {
+	req := &types.AuraGatewayRequest{
+		Prompt:         "What helps me?",
+		RequestedModel: "m",
+		Context:        map[string]interface{}{"journal": map[string]interface{}{"entry": journal}},
+	}
+
+	result, err := New(contextPolicy(TransformSummarize, "2/200", "journal.entry")).Split(req)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	want := contextHeader + "\n- journal.entry: " +
+		"The breathwork retreat at the lake finally eased my panic attacks. " +
+		"I emailed [EMAIL_1] about returning to the lake retreat for breathwork."
+	if got := result.ZoneA.Messages[0].Content; got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+	if len(result.Redactions) != 1 {
+		t.Fatalf("unexpected redactions %+v", result.Redactions)
+	}
+	r := result.Redactions[0]
+	if got := string([]rune(journal)[r.Start:r.End]); got != "jane@example.com" {
+		t.Errorf("redaction offsets point at %q", got)
+	}
+	if got := result.Decision.Transforms["context.journal.entry"]; got != "summarize:2/200" {
+		t.Errorf("Decision.Transforms = %v", result.Decision.Transforms)
+	}
+}
+
+func TestSplit_SummaryRespectsBudget(t *testing.T) {
+	for _, chars := range []int{80, 10} {
+		req := &types.AuraGatewayRequest{
+			Prompt:         "What helps me?",
+			RequestedModel: "m",
+			Context:        map[string]interface{}{"journal": journal},
+		}
+		result, err := New(contextPolicy(TransformSummarize, "3/"+strconv.Itoa(chars), "journal")).Split(req)
+		if err != nil {
+			t.Fatalf("Split failed: %v", err)
+		}
+		content := result.ZoneA.Messages[0].Content
+		if value, ok := strings.CutPrefix(content, contextHeader+"\n- journal: "); ok {
+			if n := utf8.RuneCountInString(value); n > chars {
+				t.Errorf("budget %d: summary of %d characters: %q", chars, n, value)
+			}
+		}
+		if chars == 10 && result.Decision.PromotedContext != nil {
+			t.Errorf("budget 10: promoted %v, but no sentence fits", result.Decision.PromotedContext)
+		}
+	}
+}
+
+func TestSplit_DroppedSentencesLeaveNoMapping(t *testing.T) {
+	req := &types.AuraGatewayRequest{
+		Prompt:         "What helps me?",
+		RequestedModel: "m",
+		Context:        map[string]interface{}{"journal": journal},
+	}
+	result, err := New(contextPolicy(TransformSummarize, "2/70", "journal"), WithSurrogates()).Split(req)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	// The sentence with the email address is over the budget.
+	want := contextHeader + "\n- journal: The breathwork retreat at the lake finally eased my panic attacks."
+	if got := result.ZoneA.Messages[0].Content; got != want {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+	var zoneB ZoneBContext
+	if err := json.Unmarshal(result.ZoneB, &zoneB); err != nil {
+		t.Fatal(err)
+	}
+	if len(zoneB.Pseudonyms) != 0 || len(result.Surrogates) != 0 || len(result.Redactions) != 0 {
+		t.Errorf("dropped sentence left Pseudonyms = %v, Surrogates = %v, Redactions = %+v",
+			zoneB.Pseudonyms, result.Surrogates, result.Redactions)
+	}
+}
@@ -0,0 +1,182 @@
+package processor
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+// maxSurrogateAttempts bounds the draws for a fresh surrogate before the
+// pseudonymizer falls back to a placeholder.
+const maxSurrogateAttempts = 32
+
+// surrogateDomains are reserved for documentation (RFC 2606), so a surrogate
+// email can never reach a real mailbox.
+var surrogateDomains = []string{"example.com", "example.org", "example.net"}
+
+// countryLocale assigns the gazetteer's countries to the locale packs.
+var countryLocale = map[string]string{
+	"Australia": LocaleAU, "United States": LocaleUS,
+	"Austria": LocaleEU, "Belgium": LocaleEU, "Czechia": LocaleEU, "Denmark": LocaleEU,
+	"Estonia": LocaleEU, "Finland": LocaleEU, "France": LocaleEU, "Germany": LocaleEU,
+	"Greece": LocaleEU, "Hungary": LocaleEU, "Ireland": LocaleEU, "Italy": LocaleEU,
+	"Luxembourg": LocaleEU, "Netherlands": LocaleEU, "Poland": LocaleEU, "Portugal": LocaleEU,
+	"Spain": LocaleEU, "Sweden": LocaleEU,
+}
+
+// WithSurrogates makes the processor replace names, emails and locations with
+// realistic surrogates instead of bracketed placeholders. Models tend to
+// reword a [PERSON_1] but carry a name through unchanged, so the reply reads
+// naturally and rehydrates reliably. The mapping is kept in Zone B like the
+// placeholders'.
+func WithSurrogates() Option {
+	return func(p *Processor) {
+		p.surrogates = true
+	}
+}
+
+// newPseudonymizer creates the pseudonymizer for one request. Surrogates are
+// drawn from the request's locale, by a generator seeded afresh, and never
+// repeat a word that already occurs in the request.
+func (p *Processor) newPseudonymizer(req *types.AuraGatewayRequest) *Pseudonymizer {
+	if !p.surrogates {
+		return NewPseudonymizer()
+	}
+	var b strings.Builder
+	b.WriteString(req.Prompt)
+	for _, m := range req.Messages {
+		b.WriteString("\n" + m.Content)
+	}
+	for _, leaf := range contextLeaves(normalizeJSON(req.Context), nil, nil) {
+		b.WriteString("\n" + leaf.value)
+	}
+	text := strings.ToLower(b.String())
+	// math/rand/v2's global source is seeded from the operating system.
+	return NewSurrogatePseudonymizer(RequestLocale(req), rand.Uint64(), func(surrogate string) bool {
+		return strings.Contains(text, strings.ToLower(surrogate))
+	})
+}
+
+// surrogateLists holds the fake values of one locale.
+type surrogateLists struct {
+	given, family, cities []string
+}
+
+//go:embed surrogates.csv
+var surrogatesCSV []byte
+
+var (
+	surrogatesOnce     sync.Once
+	surrogatesByLocale map[string]*surrogateLists
+)
+
+// loadSurrogates parses the bundled name lists and takes the cities from the
+// gazetteer. The "" locale holds every value. Like the gazetteer, the lists
+// are compiled into the binary, so a parse failure is a build defect and panics.
+func loadSurrogates() map[string]*surrogateLists {
+	surrogatesOnce.Do(func() {
+		records, err := csv.NewReader(bytes.NewReader(surrogatesCSV)).ReadAll()
+		if err != nil {
+			panic(fmt.Sprintf("processor: invalid bundled surrogates: %v", err))
+		}
+		surrogatesByLocale = map[string]*surrogateLists{"": {}}
+		lists := func(locale string) []*surrogateLists {
+			if surrogatesByLocale[locale] == nil {
+				surrogatesByLocale[locale] = &surrogateLists{}
+			}
+			return []*surrogateLists{surrogatesByLocale[locale], surrogatesByLocale[""]}
+		}
+		for _, r := range records[1:] {
+			for _, l := range lists(r[0]) {
+				switch r[1] {
+				case "given":
+					l.given = append(l.given, r[2])
+				case "family":
+					l.family = append(l.family, r[2])
+				default:
+					panic(fmt.Sprintf("processor: unknown surrogate kind %q", r[1]))
+				}
+			}
+		}
+		for _, p := range loadGazetteer() {
+			for _, l := range lists(countryLocale[p.Country]) {
+				l.cities = append(l.cities, p.City)
+			}
+		}
+	})
+	return surrogatesByLocale
+}
+
+// surrogateGenerator draws realistic fake names, emails and cities for one
+// session. Each surrogate is used once, and none that avoid reports as
+// already present in the request is used at all, so that reverse
+// substitution cannot touch a value the user wrote.
+type surrogateGenerator struct {
+	lists *surrogateLists
+	rng   *rand.Rand
+	avoid func(string) bool
+	used  map[string]bool
+}
+
+func newSurrogateGenerator(locale string, seed uint64, avoid func(string) bool) *surrogateGenerator {
+	all := loadSurrogates()
+	lists, ok := all[locale]
+	if !ok || len(lists.given) == 0 {
+		lists = all[""]
+	}
+	return &surrogateGenerator{
+		lists: lists,
+		rng:   rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15)),
+		avoid: avoid,
+		used:  make(map[string]bool),
+	}
+}
+
+// generate returns a surrogate for value, or false for categories without
+// realistic surrogates and when no unused one could be found.
+func (g *surrogateGenerator) generate(category Category, value string) (string, bool) {
+	for attempt := 0; attempt < maxSurrogateAttempts; attempt++ {
+		var candidate string
+		switch category {
+		case CategoryPerson:
+			candidate = g.pick(g.lists.given)
+			if len(strings.Fields(value)) > 1 {
+				candidate += " " + g.pick(g.lists.family)
+			}
+		case CategoryEmail:
+			candidate = emailPart(g.pick(g.lists.given)) + "." + emailPart(g.pick(g.lists.family)) + "@" + g.pick(surrogateDomains)
+		case CategoryLocation:
+			candidate = g.pick(g.lists.cities)
+		default:
+			return "", false
+		}
+		key := strings.ToLower(candidate)
+		if g.used[key] || (g.avoid != nil && g.avoid(candidate)) {
+			continue
+		}
+		g.used[key] = true
+		return candidate, true
+	}
+	return "", false
+}
+
+func (g *surrogateGenerator) pick(values []string) string {
+	return values[g.rng.IntN(len(values))]
+}
+
+// emailPart folds a name into the ASCII letters an address would use.
+func emailPart(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || !unicode.IsLetter(r) {
+			return -1
+		}
+		return r
+	}, foldString(name))
+}
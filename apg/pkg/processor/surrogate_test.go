@@ -0,0 +1,116 @@
+package processor
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestSurrogatePseudonymizer(t *testing.T) {
+	p := NewSurrogatePseudonymizer(LocaleAU, 42, nil)
+
+	full := p.Placeholder(CategoryPerson, "Jane Doe")
+	given := p.Placeholder(CategoryPerson, "Bob")
+	email := p.Placeholder(CategoryEmail, "jane@work.org")
+	city := p.Placeholder(CategoryLocation, "-33.87, 151.21")
+	phone := p.Placeholder(CategoryPhone, "0412 345 678")
+
+	if len(strings.Fields(full)) != 2 || len(strings.Fields(given)) != 1 {
+		t.Errorf("names should keep their number of words: %q, %q", full, given)
+	}
+	if !strings.Contains(email, "@example.") || strings.ContainsAny(email, " []") {
+		t.Errorf("unexpected email surrogate %q", email)
+	}
+	if isPlaceholder(city) || city == "" {
+		t.Errorf("unexpected location surrogate %q", city)
+	}
+	if phone != "[PHONE_1]" {
+		t.Errorf("categories without surrogates should get placeholders, got %q", phone)
+	}
+	if again := p.Placeholder(CategoryPerson, "jane doe"); again != full {
+		t.Errorf("repeated value got a new surrogate: %q != %q", again, full)
+	}
+	if got := p.Surrogates(); len(got) != 4 {
+		t.Errorf("Surrogates() = %v", got)
+	}
+	if got := p.Mapping()[full]; got != "Jane Doe" {
+		t.Errorf("mapping of %q = %q", full, got)
+	}
+}
+
+func TestSurrogatePseudonymizer_Avoid(t *testing.T) {
+	// Refusing every surrogate falls back to a placeholder.
+	p := NewSurrogatePseudonymizer("", 1, func(string) bool { return true })
+	if got := p.Placeholder(CategoryPerson, "Jane"); got != "[PERSON_1]" {
+		t.Errorf("got %q, want [PERSON_1]", got)
+	}
+
+	// Surrogates are unique within a session.
+	p = NewSurrogatePseudonymizer(LocaleUS, 7, nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 15; i++ {
+		s := p.Placeholder(CategoryPerson, string(rune('A'+i))+" Person")
+		if seen[strings.ToLower(s)] {
+			t.Fatalf("surrogate %q issued twice", s)
+		}
+		seen[strings.ToLower(s)] = true
+	}
+}
+
+func TestRehydrate_Surrogates(t *testing.T) {
+	mapping := map[string]string{
+		"Emma Clarke":            "Jane Doe",
+		"Emma":                   "Bob",
+		"liam.kovač@example.org": "jane@work.org",
+		"Kovač":                  "Smith",
+		"[PHONE_1]":              "0412 345 678",
+	}
+	text := "EMMA CLARKE met emma, Emmanuel and Kovač; mail liam.kovač@example.org or call [PHONE_1]."
+
+	got := Rehydrate(text, mapping)
+	want := "Jane Doe met Bob, Emmanuel and Smith; mail jane@work.org or call 0412 345 678."
+	if got != want {
+		t.Errorf("Rehydrate() = %q, want %q", got, want)
+	}
+}
+
+func TestSplit_Surrogates(t *testing.T) {
+	p := New(nil, WithSurrogates())
+	req := &types.AuraGatewayRequest{
+		Prompt:         "Draft a note from Jane Doe to jane@work.org about the retreat.",
+		RequestedModel: "m",
+		Context:        map[string]interface{}{"members": []interface{}{"Jane Doe"}},
+	}
+	result, err := p.Split(req)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	sent := result.ZoneA.Messages[0].Content
+	if strings.Contains(sent, "Jane") || strings.Contains(sent, "work.org") || strings.Contains(sent, "[") {
+		t.Fatalf("expected realistic surrogates, got %q", sent)
+	}
+
+	var zoneB ZoneBContext
+	if err := json.Unmarshal(result.ZoneB, &zoneB); err != nil {
+		t.Fatal(err)
+	}
+	if len(zoneB.Pseudonyms) != 2 || len(result.Surrogates) != 2 {
+		t.Fatalf("Pseudonyms = %v, Surrogates = %v", zoneB.Pseudonyms, result.Surrogates)
+	}
+
+	// The model writes the surrogates back, one of them upper-cased.
+	reply := sent
+	for surrogate := range zoneB.Pseudonyms {
+		if strings.Contains(surrogate, "@") {
+			reply = strings.ReplaceAll(reply, surrogate, strings.ToUpper(surrogate))
+		}
+	}
+	if _, findings := ScanOutput(reply, LeakActionFlag, result.Surrogates...); len(findings) != 0 {
+		t.Errorf("the output scan flagged a surrogate: %+v", findings)
+	}
+	if got := Rehydrate(reply, zoneB.Pseudonyms); got != req.Prompt {
+		t.Errorf("Rehydrate() = %q, want %q", got, req.Prompt)
+	}
+}
@@ -0,0 +1,329 @@
+package processor
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	CategoryPerson  Category = "PERSON"
+	CategoryProject Category = "PROJECT"
+	CategoryCircle  Category = "CIRCLE"
+	CategoryTerm    Category = "TERM"
+)
+
+const (
+	// Terms outside these bounds are either too short to redact safely
+	// (every "Al" in a prompt would vanish) or are free text, not names.
+	minTermRunes = 3
+	maxTermRunes = 64
+	maxTermWords = 5
+)
+
+// Term is a sensitive string taken from the Zone B data of a request.
+type Term struct {
+	Category Category
+	Value    string
+}
+
+// termKeys maps words of Context keys to the category of the strings found
+// under them. A key is split into words at '_', '-' and camelCase humps, and
+// a word matches its entry or its plural, so "memberNames" matches "name" but
+// "filename", "namespace" and "hostname" match nothing. Entries of several
+// words match consecutive words of the key.
+var termKeys = []struct {
+	words    []string
+	category Category
+}{
+	{[]string{"codename"}, CategoryProject},
+	{[]string{"code", "name"}, CategoryProject},
+	{[]string{"project"}, CategoryProject},
+	{[]string{"codex"}, CategoryProject},
+	{[]string{"member"}, CategoryPerson},
+	{[]string{"name"}, CategoryPerson},
+	{[]string{"alias"}, CategoryPerson},
+	{[]string{"handle"}, CategoryPerson},
+	{[]string{"circle"}, CategoryCircle},
+	{[]string{"sensitive", "term"}, CategoryTerm},
+	{[]string{"private", "term"}, CategoryTerm},
+}
+
+// CollectSensitiveTerms gathers the names, codenames and identifiers in a
+// request's Zone B data that may also appear in its free-text prompt.
+// Strings are collected from Context wherever they sit under a key that
+// names people, projects or circles, together with the CircleID itself.
+func CollectSensitiveTerms(circleID *string, context interface{}) []Term {
+	var terms []Term
+	seen := make(map[string]bool)
+	add := func(category Category, value string) {
+		value = strings.TrimSpace(value)
+		n := utf8.RuneCountInString(value)
+		if n < minTermRunes || n > maxTermRunes || len(strings.Fields(value)) > maxTermWords {
+			return
+		}
+		key := foldString(value)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		terms = append(terms, Term{Category: category, Value: value})
+	}
+
+	if circleID != nil {
+		add(CategoryCircle, *circleID)
+	}
+	walkContext(normalizeJSON(context), "", "", func(category Category, value string) {
+		add(category, value)
+	})
+
+	// Longer terms first, so "Jane Doe" is matched before "Jane".
+	sort.Slice(terms, func(i, j int) bool {
+		if len(terms[i].Value) != len(terms[j].Value) {
+			return len(terms[i].Value) > len(terms[j].Value)
+		}
+		return terms[i].Value < terms[j].Value
+	})
+	return terms
+}
+
+// FindTerms locates every occurrence of the terms in text. Matching ignores
+// case and accents, and only whole words match.
+func FindTerms(text string, terms []Term) []Finding {
+	if len(terms) == 0 {
+		return nil
+	}
+	folded, offsets := foldWithOffsets(text)
+
+	var findings []Finding
+	for _, term := range terms {
+		needle := foldString(term.Value)
+		if needle == "" {
+			continue
+		}
+		for from := 0; from < len(folded); {
+			i := strings.Index(folded[from:], needle)
+			if i < 0 {
+				break
+			}
+			start := from + i
+			end := start + len(needle)
+			from = end
+			// Skip matches that start or end inside the folding of a single rune.
+			if !isWordBoundary(folded, start, end) || splitsRune(offsets, start) || splitsRune(offsets, end) {
+				continue
+			}
+			origStart, origEnd := offsets[start], offsets[end]
+			// Combining accents that folded away still belong to the match.
+			for origEnd < len(text) {
+				r, size := utf8.DecodeRuneInString(text[origEnd:])
+				if !unicode.Is(unicode.Mn, r) {
+					break
+				}
+				origEnd += size
+			}
+			if overlapsAny(findings, origStart, origEnd) {
+				continue
+			}
+			findings = append(findings, Finding{
+				Category: term.Category,
+				Start:    origStart,
+				End:      origEnd,
+				Value:    text[origStart:origEnd],
+			})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Start < findings[j].Start })
+	return findings
+}
+
+// mergeFindings combines two ordered sets of findings. Findings in secondary
+// that overlap one in primary are dropped.
+func mergeFindings(primary, secondary []Finding) []Finding {
+	merged := append([]Finding(nil), primary...)
+	for _, f := range secondary {
+		if !overlapsAny(primary, f.Start, f.End) {
+			merged = append(merged, f)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Start < merged[j].Start })
+	return merged
+}
+
+// walkContext visits every string leaf of a decoded JSON value and reports
+// those that sit under a sensitive key. parent is the key of the object that
+// holds key, so that the bare "name" of a circle or project is collected as
+// one.
+func walkContext(v interface{}, parent, key string, visit func(Category, string)) {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, child := range val {
+			walkContext(child, key, k, visit)
+		}
+	case []interface{}:
+		// Array elements inherit the key of the array, e.g. "members": ["Ana", "Luis"].
+		for _, child := range val {
+			walkContext(child, parent, key, visit)
+		}
+	case string:
+		words := keyWords(key)
+		category, ok := categoryForWords(words)
+		if !ok {
+			return
+		}
+		if matchesWords(words, []string{"name"}) && len(words) == 1 {
+			if c, ok := categoryForWords(keyWords(parent)); ok {
+				category = c
+			}
+		}
+		visit(category, val)
+	}
+}
+
+// categoryForWords returns the category of the first word that starts a
+// termKeys entry; at the same word, earlier entries win.
+func categoryForWords(words []string) (Category, bool) {
+	for i := range words {
+		for _, tk := range termKeys {
+			if matchesWords(words[i:], tk.words) {
+				return tk.category, true
+			}
+		}
+	}
+	return "", false
+}
+
+// matchesWords reports whether words starts with want, allowing the last
+// word to be plural.
+func matchesWords(words, want []string) bool {
+	if len(words) < len(want) {
+		return false
+	}
+	for i, w := range want {
+		if words[i] == w {
+			continue
+		}
+		if i == len(want)-1 && (words[i] == w+"s" || words[i] == w+"es") {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// keyWords splits a key into lower-case words at '_', '-', other
+// punctuation and camelCase humps, so "circleMemberNames" gives "circle",
+// "member", "names" and "HTTPHost" gives "http", "host".
+func keyWords(key string) []string {
+	var words []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			words = append(words, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	runes := []rune(key)
+	for i, r := range runes {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			flush()
+			continue
+		}
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return words
+}
+
+// normalizeJSON round-trips v through JSON so that typed Go values such as
+// map[string]string are walked the same way as decoded request bodies.
+func normalizeJSON(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+// foldRune lower-cases r and strips any accents from it. Compatibility forms
+// such as full-width letters fold to their plain form, confusable letters to
+// their Latin lookalike, and invisible characters to nothing.
+func foldRune(r rune) string {
+	if isInvisible(r) {
+		return ""
+	}
+	if c, ok := confusables[r]; ok {
+		r = c
+	}
+	var b strings.Builder
+	for _, d := range norm.NFKD.String(string(r)) {
+		if unicode.Is(unicode.Mn, d) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(d))
+	}
+	return b.String()
+}
+
+func foldString(s string) string {
+	folded, _ := foldWithOffsets(s)
+	return folded
+}
+
+// foldWithOffsets folds s rune by rune. offsets[i] is the byte offset in s of
+// the rune that produced folded byte i; offsets[len(folded)] is len(s).
+func foldWithOffsets(s string) (string, []int) {
+	var b strings.Builder
+	offsets := make([]int, 0, len(s)+1)
+	for i, r := range s {
+		f := foldRune(r)
+		for j := 0; j < len(f); j++ {
+			offsets = append(offsets, i)
+		}
+		b.WriteString(f)
+	}
+	offsets = append(offsets, len(s))
+	return b.String(), offsets
+}
+
+func splitsRune(offsets []int, i int) bool {
+	return i > 0 && i < len(offsets)-1 && offsets[i] == offsets[i-1]
+}
+
+func isWordBoundary(s string, start, end int) bool {
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(s[:start])
+		if isWordRune(r) {
+			return false
+		}
+	}
+	if end < len(s) {
+		r, _ := utf8.DecodeRuneInString(s[end:])
+		if isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+}
@@ -0,0 +1,136 @@
+package processor
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCollectSensitiveTerms(t *testing.T) {
+	circleID := "circ_f6e5d4"
+	context := map[string]interface{}{
+		"displayName": "Zoë Ångström",
+		"circle": map[string]interface{}{
+			"members": []interface{}{"Luis", "Al"},
+		},
+		"codex": map[string]interface{}{
+			"project_codename": "Phoenix",
+			"notes":            "My project notes for project Phoenix and the rest of the year...",
+		},
+		"journal": "Today I felt anxious about the upcoming presentation.",
+	}
+
+	terms := CollectSensitiveTerms(&circleID, context)
+
+	want := map[string]Category{
+		"Zoë Ångström": CategoryPerson,
+		"circ_f6e5d4":  CategoryCircle,
+		"Phoenix":      CategoryProject,
+		"Luis":         CategoryPerson,
+	}
+	if len(terms) != len(want) {
+		t.Fatalf("got %d terms %+v, want %d", len(terms), terms, len(want))
+	}
+	for _, term := range terms {
+		if category, ok := want[term.Value]; !ok || category != term.Category {
+			t.Errorf("unexpected term %+v", term)
+		}
+	}
+	if terms[0].Value != "Zoë Ångström" {
+		t.Errorf("expected the longest term first, got %q", terms[0].Value)
+	}
+}
+
+func TestCollectSensitiveTerms_WholeKeyWords(t *testing.T) {
+	context := map[string]interface{}{
+		"filename":     "report_final.pdf",
+		"namespace":    "production",
+		"hostname":     "db-primary",
+		"renamedFrom":  "Old Draft",
+		"member_names": []interface{}{"Ana"},
+		"circles": []interface{}{
+			map[string]interface{}{"name": "Moonlight", "purpose": "Weekly check-ins"},
+		},
+		"project":        map[string]interface{}{"code-name": "Nightjar"},
+		"sensitiveTerms": []interface{}{"Blue Lotus"},
+		"nickName":       "Lulu",
+	}
+
+	want := map[string]Category{
+		"Ana":        CategoryPerson,
+		"Moonlight":  CategoryCircle,
+		"Nightjar":   CategoryProject,
+		"Blue Lotus": CategoryTerm,
+		"Lulu":       CategoryPerson,
+	}
+	terms := CollectSensitiveTerms(nil, context)
+	if len(terms) != len(want) {
+		t.Fatalf("got %d terms %+v, want %d", len(terms), terms, len(want))
+	}
+	for _, term := range terms {
+		if category, ok := want[term.Value]; !ok || category != term.Category {
+			t.Errorf("unexpected term %+v", term)
+		}
+	}
+}
+
+func TestKeyWords(t *testing.T) {
+	cases := map[string]string{
+		"displayName":       "display name",
+		"circle_member-ids": "circle member ids",
+		"HTTPHost":          "http host",
+		"filename":          "filename",
+		"v2Name":            "v2 name",
+	}
+	for key, want := range cases {
+		if got := strings.Join(keyWords(key), " "); got != want {
+			t.Errorf("keyWords(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestFindTerms_CaseAndAccentInsensitive(t *testing.T) {
+	terms := []Term{
+		{Category: CategoryPerson, Value: "Zoë Ångström"},
+		{Category: CategoryProject, Value: "Phoenix"},
+	}
+	text := "zoe angstrom asked about PHOENIX, not Phoenixville."
+
+	findings := FindTerms(text, terms)
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings, got %+v", findings)
+	}
+	if findings[0].Value != "zoe angstrom" || findings[0].Category != CategoryPerson {
+		t.Errorf("unexpected first finding %+v", findings[0])
+	}
+	if findings[1].Value != "PHOENIX" || findings[1].Category != CategoryProject {
+		t.Errorf("unexpected second finding %+v", findings[1])
+	}
+}
+
+func TestFindTerms_DecomposedAccents(t *testing.T) {
+	terms := []Term{{Category: CategoryPerson, Value: "Zoe"}}
+	text := "Zoe\u0308 is here" // "Zoë" with a combining diaeresis
+
+	findings := FindTerms(text, terms)
+	if len(findings) != 1 {
+		t.Fatalf("expected 1 finding, got %+v", findings)
+	}
+	if findings[0].Value != "Zoe\u0308" {
+		t.Errorf("combining mark should be part of the match, got %q", findings[0].Value)
+	}
+}
+
+func TestPseudonymizer_RedactWithTerms(t *testing.T) {
+	terms := []Term{{Category: CategoryProject, Value: "Phoenix"}}
+	p := NewPseudonymizer()
+
+	got, _ := p.Redact("Email jane@example.com about Phoenix. phoenix is late.", terms...)
+
+	want := "Email [EMAIL_1] about [PROJECT_1]. [PROJECT_1] is late."
+	if got != want {
+		t.Errorf("Redact() = %q, want %q", got, want)
+	}
+	if v := p.Mapping()["[PROJECT_1]"]; v != "Phoenix" {
+		t.Errorf("placeholder should rehydrate to the first spelling, got %q", v)
+	}
+}
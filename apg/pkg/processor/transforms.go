@@ -0,0 +1,269 @@
+package processor
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+const (
+	CategoryTimestamp Category = "TIMESTAMP"
+	CategoryLocation  Category = "LOCATION"
+)
+
+// Parameters for the round and fuzz transforms.
+const (
+	RoundHour   = "hour"
+	RoundDay    = "day"
+	FuzzCity    = "city"
+	FuzzRegion  = "region"
+	defaultGrid = 1.0 // degrees, used when no gazetteer entry is close enough
+
+	cityRadiusKm   = 50
+	regionRadiusKm = 300
+	earthRadiusKm  = 6371
+)
+
+var (
+	timestampPattern  = regexp.MustCompile(`\b\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(?::\d{2}(?:\.\d+)?)?(?:Z|[+\-]\d{2}:?\d{2})?`)
+	coordinatePattern = regexp.MustCompile(`(-?\d{1,2}\.\d{3,})\s*°?\s*([NSns])?\s*,\s*(-?\d{1,3}\.\d{3,})\s*°?\s*([EWew])?`)
+)
+
+// RoundTime truncates t to the start of its UTC hour or day and formats it.
+// Converting to UTC first also drops the user's time zone offset.
+func RoundTime(t time.Time, bucket string) (string, error) {
+	t = t.UTC()
+	switch bucket {
+	case RoundHour:
+		return t.Truncate(time.Hour).Format("2006-01-02T15:04Z"), nil
+	case RoundDay:
+		return t.Format("2006-01-02"), nil
+	default:
+		return "", fmt.Errorf("unknown rounding bucket %q", bucket)
+	}
+}
+
+// SnapToGrid moves p to the centre of its cell on a grid of the given size in degrees.
+func SnapToGrid(p types.GeoPoint, cell float64) types.GeoPoint {
+	snap := func(v float64) float64 {
+		return math.Floor(v/cell)*cell + cell/2
+	}
+	return types.GeoPoint{Latitude: snap(p.Latitude), Longitude: snap(p.Longitude)}
+}
+
+// FuzzLocation coarsens p according to param: "city" or "region" resolve it
+// through the bundled gazetteer, and a number snaps it to a grid of that many
+// degrees. Points far from any gazetteer entry fall back to a one-degree grid.
+func FuzzLocation(p types.GeoPoint, param string) (string, error) {
+	switch param {
+	case FuzzCity:
+		if place, ok := nearestPlace(p, cityRadiusKm); ok {
+			return place.City + ", " + place.Country, nil
+		}
+		if place, ok := nearestPlace(p, regionRadiusKm); ok {
+			return place.Region + ", " + place.Country, nil
+		}
+	case FuzzRegion:
+		if place, ok := nearestPlace(p, regionRadiusKm); ok {
+			return place.Region + ", " + place.Country, nil
+		}
+	default:
+		cell, err := parseGridSize(param)
+		if err != nil {
+			return "", err
+		}
+		return formatGridPoint(SnapToGrid(p, cell), cell), nil
+	}
+	return formatGridPoint(SnapToGrid(p, defaultGrid), defaultGrid), nil
+}
+
+func parseGridSize(param string) (float64, error) {
+	cell, err := strconv.ParseFloat(param, 64)
+	if err != nil || cell <= 0 || cell > 10 {
+		return 0, fmt.Errorf("invalid location fuzz %q: want city, region or a grid size in degrees", param)
+	}
+	return cell, nil
+}
+
+func formatGridPoint(p types.GeoPoint, cell float64) string {
+	decimals := 0
+	for c := cell; c < 1 && decimals < 6; c *= 10 {
+		decimals++
+	}
+	// The cell centre needs one more digit than the cell edges.
+	decimals++
+	return fmt.Sprintf("%.*f, %.*f", decimals, p.Latitude, decimals, p.Longitude)
+}
+
+// validateTransformParam checks that a round or fuzz rule names a usable parameter.
+func validateTransformParam(transform Transform, param string) error {
+	switch transform {
+	case TransformRound:
+		if param != RoundHour && param != RoundDay {
+			return fmt.Errorf("round transform needs %q or %q, got %q", RoundHour, RoundDay, param)
+		}
+	case TransformFuzz:
+		if param == FuzzCity || param == FuzzRegion {
+			return nil
+		}
+		_, err := parseGridSize(param)
+		return err
+	case TransformSummarize:
+		_, err := ParseSummaryParam(param)
+		return err
+	case TransformRetrieve:
+		_, err := parseRetrieveParam(param)
+		return err
+	}
+	return nil
+}
+
+// coarseFindings locates timestamps and coordinates in text and pairs each
+// with its coarse replacement. A nil rule means the policy keeps that kind of
+// value out of Zone A entirely, so it is reported without a replacement and
+// ends up as a placeholder.
+func coarseFindings(text string, timeRule, locationRule *PolicyRule) []Finding {
+	var findings []Finding
+	for _, loc := range timestampPattern.FindAllStringIndex(text, -1) {
+		match := text[loc[0]:loc[1]]
+		t, ok := parseTimestamp(match)
+		if !ok {
+			continue
+		}
+		f := Finding{Category: CategoryTimestamp, Start: loc[0], End: loc[1], Value: match}
+		if timeRule != nil {
+			f.Replacement, _ = RoundTime(t, timeRule.TransformParam)
+		}
+		findings = append(findings, f)
+	}
+	for _, m := range coordinatePattern.FindAllStringSubmatchIndex(text, -1) {
+		if overlapsAny(findings, m[0], m[1]) {
+			continue
+		}
+		p, ok := parseCoordinate(text, m)
+		if !ok {
+			continue
+		}
+		f := Finding{Category: CategoryLocation, Start: m[0], End: m[1], Value: text[m[0]:m[1]]}
+		if locationRule != nil {
+			f.Replacement, _ = FuzzLocation(p, locationRule.TransformParam)
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+func parseTimestamp(s string) (time.Time, bool) {
+	s = strings.Replace(s, " ", "T", 1)
+	layouts := []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04Z07:00",
+		"2006-01-02T15:04:05Z0700",
+		"2006-01-02T15:04Z0700",
+		"2006-01-02T15:04:05",
+		"2006-01-02T15:04",
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseCoordinate converts a coordinatePattern submatch into a point, applying
+// hemisphere letters and rejecting out-of-range values.
+func parseCoordinate(text string, m []int) (types.GeoPoint, bool) {
+	group := func(i int) string {
+		if m[2*i] < 0 {
+			return ""
+		}
+		return text[m[2*i]:m[2*i+1]]
+	}
+	lat, err1 := strconv.ParseFloat(group(1), 64)
+	lon, err2 := strconv.ParseFloat(group(3), 64)
+	if err1 != nil || err2 != nil {
+		return types.GeoPoint{}, false
+	}
+	if strings.EqualFold(group(2), "S") {
+		lat = -math.Abs(lat)
+	}
+	if strings.EqualFold(group(4), "W") {
+		lon = -math.Abs(lon)
+	}
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return types.GeoPoint{}, false
+	}
+	return types.GeoPoint{Latitude: lat, Longitude: lon}, true
+}
+
+// place is one entry of the bundled gazetteer.
+type place struct {
+	City    string
+	Region  string
+	Country string
+	Point   types.GeoPoint
+}
+
+//go:embed gazetteer.csv
+var gazetteerCSV []byte
+
+var (
+	gazetteerOnce sync.Once
+	gazetteer     []place
+)
+
+// loadGazetteer parses the bundled gazetteer. It is compiled into the binary,
+// so a parse failure is a build defect and panics.
+func loadGazetteer() []place {
+	gazetteerOnce.Do(func() {
+		records, err := csv.NewReader(bytes.NewReader(gazetteerCSV)).ReadAll()
+		if err != nil {
+			panic(fmt.Sprintf("processor: invalid bundled gazetteer: %v", err))
+		}
+		for _, r := range records[1:] {
+			lat, err1 := strconv.ParseFloat(r[3], 64)
+			lon, err2 := strconv.ParseFloat(r[4], 64)
+			if err1 != nil || err2 != nil {
+				panic(fmt.Sprintf("processor: invalid gazetteer coordinates for %s", r[0]))
+			}
+			gazetteer = append(gazetteer, place{
+				City:    r[0],
+				Region:  r[1],
+				Country: r[2],
+				Point:   types.GeoPoint{Latitude: lat, Longitude: lon},
+			})
+		}
+	})
+	return gazetteer
+}
+
+// nearestPlace returns the gazetteer entry closest to p, if it lies within maxKm.
+func nearestPlace(p types.GeoPoint, maxKm float64) (place, bool) {
+	var best place
+	bestKm := math.Inf(1)
+	for _, candidate := range loadGazetteer() {
+		if d := haversineKm(p, candidate.Point); d < bestKm {
+			best, bestKm = candidate, d
+		}
+	}
+	return best, bestKm <= maxKm
+}
+
+func haversineKm(a, b types.GeoPoint) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(b.Latitude - a.Latitude)
+	dLon := toRad(b.Longitude - a.Longitude)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Latitude))*math.Cos(toRad(b.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
@@ -0,0 +1,155 @@
+package processor
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SacredShifter/sacredshiftercommunity/apg/pkg/types"
+)
+
+func TestRoundTime(t *testing.T) {
+	ts := time.Date(2023, 10, 27, 21, 47, 13, 0, time.FixedZone("AEDT", 11*60*60))
+
+	hour, err := RoundTime(ts, RoundHour)
+	if err != nil || hour != "2023-10-27T10:00Z" {
+		t.Errorf("RoundTime(hour) = %q, %v", hour, err)
+	}
+	day, err := RoundTime(ts, RoundDay)
+	if err != nil || day != "2023-10-27" {
+		t.Errorf("RoundTime(day) = %q, %v", day, err)
+	}
+	if _, err := RoundTime(ts, "minute"); err == nil {
+		t.Error("expected an error for an unknown bucket")
+	}
+}
+
+func TestFuzzLocation(t *testing.T) {
+	eiffelTower := types.GeoPoint{Latitude: 48.8584, Longitude: 2.2945}
+	bondiBeach := types.GeoPoint{Latitude: -33.8915, Longitude: 151.2767}
+	outback := types.GeoPoint{Latitude: -25.3444, Longitude: 131.0369}
+
+	tests := []struct {
+		point types.GeoPoint
+		param string
+		want  string
+	}{
+		{eiffelTower, FuzzCity, "Paris, France"},
+		{eiffelTower, FuzzRegion, "Île-de-France, France"},
+		{bondiBeach, FuzzCity, "Sydney, Australia"},
+		{bondiBeach, "0.1", "-33.85, 151.25"},
+		{outback, FuzzCity, "-25.5, 131.5"},
+	}
+	for _, tt := range tests {
+		got, err := FuzzLocation(tt.point, tt.param)
+		if err != nil {
+			t.Errorf("FuzzLocation(%v, %q) failed: %v", tt.point, tt.param, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("FuzzLocation(%v, %q) = %q, want %q", tt.point, tt.param, got, tt.want)
+		}
+	}
+
+	if _, err := FuzzLocation(eiffelTower, "street"); err == nil {
+		t.Error("expected an error for an unknown fuzz parameter")
+	}
+}
+
+func TestSplitAndScrub_CoarseTimeAndLocation(t *testing.T) {
+	ts := time.Date(2023, 10, 27, 10, 42, 0, 0, time.UTC)
+	req := &types.AuraGatewayRequest{
+		UserID:         "user_abc",
+		Prompt:         "At 2023-10-27T10:42:31Z I was at 48.8584° N, 2.2945° E. Any tips?",
+		RequestedModel: "gpt-4o",
+		Timestamp:      &ts,
+		Location:       &types.GeoPoint{Latitude: 48.8584, Longitude: 2.2945},
+	}
+
+	result, err := New(nil).Split(req)
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	zoneA, zoneBPayload := result.ZoneA, result.ZoneB
+	if len(zoneA.Messages) != 2 || zoneA.Messages[0].Role != "system" {
+		t.Fatalf("expected a system message with coarse context, got %+v", zoneA.Messages)
+	}
+	system := zoneA.Messages[0].Content
+	if !strings.Contains(system, "2023-10-27T10:00Z") || !strings.Contains(system, "Paris, France") {
+		t.Errorf("unexpected coarse context %q", system)
+	}
+	wantPrompt := "At 2023-10-27T10:00Z I was at Paris, France. Any tips?"
+	if got := zoneA.Messages[1].Content; got != wantPrompt {
+		t.Errorf("prompt = %q, want %q", got, wantPrompt)
+	}
+
+	var zoneB ZoneBContext
+	if err := json.Unmarshal(zoneBPayload, &zoneB); err != nil {
+		t.Fatalf("Failed to unmarshal zoneBPayload: %v", err)
+	}
+	if zoneB.Timestamp == nil || !zoneB.Timestamp.Equal(ts) || zoneB.Location == nil {
+		t.Errorf("Zone B should keep the exact values, got %+v / %+v", zoneB.Timestamp, zoneB.Location)
+	}
+
+	wantTransforms := map[string]string{
+		FieldPrompt:         "scrub",
+		FieldRequestedModel: "none",
+		FieldTimestamp:      "round:hour",
+		FieldLocation:       "fuzz:city",
+	}
+	if !reflect.DeepEqual(result.Decision.Transforms, wantTransforms) {
+		t.Errorf("Decision.Transforms = %v, want %v", result.Decision.Transforms, wantTransforms)
+	}
+	wantCounts := map[string]int{"TIMESTAMP": 1, "LOCATION": 1}
+	if got := result.RedactionCounts(); !reflect.DeepEqual(got, wantCounts) {
+		t.Errorf("RedactionCounts() = %v, want %v", got, wantCounts)
+	}
+}
+
+func TestSplitAndScrub_PolicyWithoutCoarseRules(t *testing.T) {
+	policy := DefaultPolicy()
+	var rules []PolicyRule
+	for _, rule := range policy.Rules {
+		if rule.Zone == ZoneA && (rule.Field == FieldTimestamp || rule.Field == FieldLocation) {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	policy.Rules = rules
+
+	ts := time.Now()
+	req := &types.AuraGatewayRequest{
+		Prompt:         "Logged 2023-10-27T10:42:31Z at -33.8688, 151.2093",
+		RequestedModel: "gpt-4o",
+		Timestamp:      &ts,
+	}
+	zoneA, _, err := New(policy).SplitAndScrub(req)
+	if err != nil {
+		t.Fatalf("SplitAndScrub failed: %v", err)
+	}
+	if len(zoneA.Messages) != 1 {
+		t.Fatalf("time and location should be omitted, got %+v", zoneA.Messages)
+	}
+	want := "Logged [TIMESTAMP_1] at [LOCATION_1]"
+	if got := zoneA.Messages[0].Content; got != want {
+		t.Errorf("prompt = %q, want %q", got, want)
+	}
+}
+
+func TestValidate_TransformParams(t *testing.T) {
+	bad := map[string]PolicyRule{
+		"round without bucket": {Element: "T", Zone: ZoneA, Field: FieldTimestamp, Transform: TransformRound},
+		"fuzz on timestamp":    {Element: "T", Zone: ZoneA, Field: FieldTimestamp, Transform: TransformFuzz, TransformParam: FuzzCity},
+		"grid too large":       {Element: "L", Zone: ZoneA, Field: FieldLocation, Transform: TransformFuzz, TransformParam: "45"},
+		"raw location":         {Element: "L", Zone: ZoneA, Field: FieldLocation, Transform: TransformNone},
+	}
+	for name, rule := range bad {
+		policy := DefaultPolicy()
+		policy.Rules = append(policy.Rules, rule)
+		if err := policy.Validate(); err == nil {
+			t.Errorf("%s: expected a validation error", name)
+		}
+	}
+}
@@ -1,27 +1,53 @@
 package types
 
+import "time"
+
 // AuraGatewayRequest is the initial request from a client to the APG.
 type AuraGatewayRequest struct {
-	UserID          string      `json:"userId"`
-	CircleID        *string     `json:"circleId"`
-	Prompt          string      `json:"prompt"`
-	Context         interface{} `json:"context"` // Can be any JSON object
-	Policy          Policy      `json:"policy"`
-	RequestedModel  string      `json:"requestedModel"`
+	UserID         string      `json:"userId"`
+	CircleID       *string     `json:"circleId"`
+	Prompt         string      `json:"prompt"`
+	Context        interface{} `json:"context"` // Can be any JSON object
+	Policy         Policy      `json:"policy"`
+	RequestedModel string      `json:"requestedModel"`
+	// Timestamp is the exact client time of the request. Only a rounded form may reach Zone A.
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	// Location is the user's precise position, if shared. Only a fuzzed form may reach Zone A.
+	Location *GeoPoint `json:"location,omitempty"`
+	// Messages holds the prior turns of a conversation, oldest first. The
+	// prompt, if set, is sent as the final user turn after them.
+	Messages []Message `json:"messages,omitempty"`
+	// PromoteContext lists the Context paths, e.g. "journal.mood", this request
+	// would like the model to see. Only paths the classification policy also
+	// allows are promoted; when empty, every allowed path is.
+	PromoteContext []string `json:"promoteContext,omitempty"`
+	// Locale selects the identifier pack used when scrubbing, e.g. "en-AU".
+	// When empty, the pack is chosen from Policy.Residency.
+	Locale string `json:"locale,omitempty"`
+}
+
+// GeoPoint is a WGS 84 coordinate in decimal degrees.
+type GeoPoint struct {
+	Latitude  float64 `json:"lat"`
+	Longitude float64 `json:"lon"`
 }
 
 // Policy defines the data handling policies for the request.
 type Policy struct {
-	Residency         string `json:"residency"`
-	AllowCrossBorder  bool   `json:"allowCrossBorder"`
+	Residency        string `json:"residency"`
+	AllowCrossBorder bool   `json:"allowCrossBorder"`
 }
 
 // AuraGatewayTransformed is the internal representation of the split request.
 type AuraGatewayTransformed struct {
-	ZoneAPrompt             OpenRouterRequest `json:"zoneA_prompt"`
-	ZoneBEncryptedPayload   []byte            `json:"zoneB_encrypted_payload"`
-	ZoneBWrappedDEK         []byte            `json:"zoneB_dek_wrapped"`
-	AssociatedData          []byte            `json:"associatedData"`
+	ZoneAPrompt           OpenRouterRequest `json:"zoneA_prompt"`
+	ZoneBEncryptedPayload []byte            `json:"zoneB_encrypted_payload"`
+	ZoneBWrappedDEK       []byte            `json:"zoneB_dek_wrapped"`
+	ZoneBNonce            []byte            `json:"zoneB_nonce"`
+	// KEKID names the KEK the DEK is wrapped under. It is part of
+	// AssociatedData, so the record does not decrypt under any other KEK ID.
+	KEKID          string `json:"zoneB_kek_id"`
+	AssociatedData []byte `json:"associatedData"`
 }
 
 // OpenRouterRequest is the sanitized request sent to OpenRouter.
@@ -31,10 +57,20 @@ type OpenRouterRequest struct {
 	Messages []Message `json:"messages"`
 }
 
+// Message roles accepted in a conversation.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	RoleTool      = "tool"
+)
+
 // Message is a single message in a chat completion request.
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// ToolCallID links a tool message to the assistant call it answers.
+	ToolCallID string `json:"tool_call_id,omitempty"`
 }
 
 // OpenRouterResponse is a simplified representation of the response from OpenRouter.
@@ -64,10 +100,88 @@ type AuraGatewayResponse struct {
 	Provenance        Provenance `json:"provenance"`
 }
 
+// Redaction describes one value the gateway replaced before calling the provider.
+// It never carries the replaced value itself.
+type Redaction struct {
+	// Turn indexes the request's messages; the prompt, if any, follows the last
+	// message. It is -1 for promoted context, which Path identifies instead.
+	Turn     int    `json:"turn"`
+	Path     string `json:"path,omitempty"`
+	Category string `json:"category"`
+	// Start and End are character (Unicode code point) offsets into the original
+	// turn or context value.
+	Start       int    `json:"start"`
+	End         int    `json:"end"`
+	Replacement string `json:"replacement"`
+}
+
+// GatewayPreview shows exactly what a request would send to the provider,
+// without sending it.
+type GatewayPreview struct {
+	ZoneARequest OpenRouterRequest `json:"zoneA_request"`
+	// ZoneAHash is the hash the request's provenance would carry. It is
+	// omitted when Differs is set, since the hashes could not match.
+	ZoneAHash  string      `json:"zoneA_hash,omitempty"`
+	Redactions []Redaction `json:"redactions"`
+	// Differs lists what the request, when sent, carries differently from
+	// ZoneARequest: "fpe" for format-preserving surrogates, which are
+	// encrypted under a new key, "surrogates" for realistic surrogates, which
+	// are picked anew, and "canaries" for the canary message planted first.
+	Differs []string `json:"differs,omitempty"`
+	// Screening is set when prompt-injection screening flagged the request.
+	Screening *InjectionScreening `json:"screening,omitempty"`
+}
+
 // Provenance provides auditable information about the request processing.
 type Provenance struct {
-	ModelUsed   string `json:"modelUsed"`
-	Provider    string `json:"provider"`
-	LatencyMs   int64  `json:"latencyMs"`
-	ZoneAHash   string `json:"zoneA_hash"`
+	ModelUsed string `json:"modelUsed"`
+	Provider  string `json:"provider"`
+	LatencyMs int64  `json:"latencyMs"`
+	ZoneAHash string `json:"zoneA_hash"`
+	// Redactions counts the replacements made per category. The replaced
+	// values themselves are never recorded.
+	Redactions map[string]int `json:"redactions,omitempty"`
+	// RulesetVersion identifies the scrubber rules that were applied.
+	RulesetVersion string `json:"rulesetVersion"`
+	// PolicyDecision records what the classification policy let into Zone A.
+	PolicyDecision PolicyDecision `json:"policyDecision"`
+	// OutputScan is set when identifiers were found in the model's output.
+	OutputScan *OutputScan `json:"outputScan,omitempty"`
+	// Screening is set when prompt-injection screening flagged the request.
+	Screening *InjectionScreening `json:"screening,omitempty"`
+}
+
+// InjectionScreening records the turns that prompt-injection screening
+// flagged and what was done about them.
+type InjectionScreening struct {
+	// Action is "sanitize" or "tag"; blocked requests get no response.
+	Action string `json:"action"`
+	// Score is the highest score of any flagged turn, between 0 and 1.
+	Score float64  `json:"score"`
+	Rules []string `json:"rules"`
+	Turns []int    `json:"turns"`
+	// ContextPaths lists flagged Context values promoted into Zone A.
+	ContextPaths []string `json:"contextPaths,omitempty"`
+}
+
+// OutputScan records identifiers found in model output and what was done about them.
+type OutputScan struct {
+	// Action is "block", "redact" or "flag".
+	Action   string         `json:"action"`
+	Findings map[string]int `json:"findings"`
+}
+
+// PolicyDecision records how the classification policy treated a request.
+type PolicyDecision struct {
+	// PolicyID is a digest of the classification policy that was in force.
+	PolicyID string `json:"policyId"`
+	// ZoneAFields lists the request fields that reached Zone A, and Transforms
+	// how each was treated on the way (e.g. "prompt": "scrub").
+	ZoneAFields []string          `json:"zoneAFields"`
+	Transforms  map[string]string `json:"transforms,omitempty"`
+	// Scrubbers lists the scrubbers applied to the conversation, in order.
+	Scrubbers []string `json:"scrubbers,omitempty"`
+	// PromotedContext lists the Context paths whose values, scrubbed, were
+	// sent to Zone A. The rest of Context stayed encrypted in Zone B.
+	PromotedContext []string `json:"promotedContext,omitempty"`
 }